@@ -38,34 +38,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	shutdown(cancel, logger)
+	shutdown(srv, logger)
 
-	err = services.StartAndAwaitRunning(ctx, srv)
+	err = services.StartAndAwaitRunning(context.Background(), srv)
 	if err != nil {
 		level.Error(logger).Log("msg", "error running application", "err", err)
 		os.Exit(1)
 	}
 
-	// Block until the context is cancelled, then shutdown the server
-	<-ctx.Done()
-
-	err = services.StopAndAwaitTerminated(context.Background(), srv)
+	// Block until the server has stopped, either because of a signal, a client
+	// running the shutdown command, or an error.
+	err = srv.AwaitTerminated(context.Background())
 	if err != nil {
 		level.Error(logger).Log("msg", "error stopping application", "err", err)
 		os.Exit(1)
 	}
 }
 
-// TODO: Shutdown delay?
-
-func shutdown(cancel context.CancelFunc, logger log.Logger) {
+func shutdown(srv *server.Server, logger log.Logger) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		sig := <-sigs
 		level.Info(logger).Log("msg", "stopping on signal", "signal", sig)
-		cancel()
+		srv.StopAsync()
 	}()
 }
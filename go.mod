@@ -6,13 +6,21 @@ require (
 	github.com/dgraph-io/ristretto v0.1.0
 	github.com/go-kit/log v0.2.1
 	github.com/grafana/dskit v0.0.0-20220831093637-e414922a81f2
+	github.com/prometheus/client_golang v1.13.0
+	github.com/prometheus/client_model v0.2.0
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
 	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
-)
\ No newline at end of file
+	google.golang.org/protobuf v1.28.1 // indirect
+)
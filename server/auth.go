@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+type AuthConfig struct {
+	CredentialsFile string
+}
+
+func (c *AuthConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	fs.StringVar(&c.CredentialsFile, prefix+"credentials-file", "", "Path to a file of 'username:password:permission' lines, one per user, where permission is read-only, read-write, or admin. "+
+		"Clients must authenticate if set, which means UDP clients are not able to run any commands. Set to an empty string to disable authentication")
+}
+
+func (c *AuthConfig) Validate() error {
+	return nil
+}
+
+// Permission is the level of access a user has. Each level includes all the access
+// of the levels below it.
+type Permission int
+
+const (
+	PermissionNone Permission = iota
+	PermissionReadOnly
+	PermissionReadWrite
+	PermissionAdmin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionNone:
+		return "none"
+	case PermissionReadOnly:
+		return "read-only"
+	case PermissionReadWrite:
+		return "read-write"
+	case PermissionAdmin:
+		return "admin"
+	}
+
+	return fmt.Sprintf("Permission(%d)", int(p))
+}
+
+func parsePermission(s string) (Permission, error) {
+	switch s {
+	case "read-only":
+		return PermissionReadOnly, nil
+	case "read-write":
+		return PermissionReadWrite, nil
+	case "admin":
+		return PermissionAdmin, nil
+	}
+
+	return PermissionNone, fmt.Errorf("invalid permission '%s'", s)
+}
+
+// requiredPermission returns the permission a user needs to run an operation. Operations
+// that are allowed before authenticating require PermissionNone.
+func requiredPermission(op proto.Op) Permission {
+	switch op.Type() {
+	case proto.OpTypeMetaNoOp, proto.OpTypeQuit, proto.OpTypeSaslAuth, proto.OpTypeSaslListMechs, proto.OpTypeVersion:
+		return PermissionNone
+	case proto.OpTypeStats:
+		// Resetting affects the entire server and connection stats expose the addresses
+		// of other clients, along with the IDs used to close their connections.
+		switch op.(proto.StatsOp).Group {
+		case proto.StatsConns, proto.StatsReset:
+			return PermissionAdmin
+		}
+
+		return PermissionReadOnly
+	case proto.OpTypeMetaGet:
+		// Touching or creating entries with a meta get is the same as a write
+		if mg := op.(*proto.MetaGetOp); mg.AutoVivify || mg.UpdateExpire {
+			return PermissionReadWrite
+		}
+
+		return PermissionReadOnly
+	case proto.OpTypeGet, proto.OpTypeMetaDebug:
+		return PermissionReadOnly
+	case proto.OpTypeAdd, proto.OpTypeAppend, proto.OpTypeCas, proto.OpTypeDecr, proto.OpTypeDelete, proto.OpTypeGat,
+		proto.OpTypeIncr, proto.OpTypeMetaArithmetic, proto.OpTypeMetaDelete, proto.OpTypeMetaSet, proto.OpTypePrepend,
+		proto.OpTypeReplace, proto.OpTypeSet, proto.OpTypeTouch:
+		return PermissionReadWrite
+	}
+
+	// Anything else, including cache_memlimit, close_conn, and flush_all, affects the
+	// entire server
+	return PermissionAdmin
+}
+
+// User is a client that has successfully authenticated.
+type User struct {
+	Name       string
+	Permission Permission
+}
+
+type credential struct {
+	password   string
+	permission Permission
+}
+
+// Credentials are the usernames, passwords, and permissions of users allowed to
+// connect to the server.
+type Credentials struct {
+	users map[string]credential
+}
+
+// LoadCredentials reads credentials from a file of 'username:password:permission' lines.
+// Blank lines and lines starting with '#' are ignored. Passwords may contain ':'.
+func LoadCredentials(path string) (*Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	creds := &Credentials{users: make(map[string]credential)}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, rest, ok := strings.Cut(line, ":")
+		sep := strings.LastIndex(rest, ":")
+		if !ok || name == "" || sep < 0 {
+			return nil, fmt.Errorf("invalid credentials on line %d of %s", lineNum, path)
+		}
+
+		perm, err := parsePermission(rest[sep+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials on line %d of %s: %w", lineNum, path, err)
+		}
+
+		creds.users[name] = credential{password: rest[:sep], permission: perm}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read credentials file: %w", err)
+	}
+
+	return creds, nil
+}
+
+// Authenticate returns the user with the given name if the password is correct.
+func (c *Credentials) Authenticate(username, password string) (*User, bool) {
+	cred, ok := c.users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(cred.password), []byte(password)) != 1 {
+		return nil, false
+	}
+
+	return &User{Name: username, Permission: cred.permission}, true
+}
+
+// authenticate checks the credentials sent by a client and marks the connection as
+// belonging to that user if they are correct.
+func (h *Handler) authenticate(conn *bufferedConnection, op *proto.SaslAuthOp) error {
+	h.metrics.AuthCommands.Add(1)
+	if h.credentials == nil {
+		return nil
+	}
+
+	user, ok := h.credentials.Authenticate(op.Username, op.Password)
+	if !ok {
+		h.metrics.AuthErrors.Add(1)
+		return core.ErrAuthFailed
+	}
+
+	conn.user = user
+	return nil
+}
+
+// authorize returns an error if the user of a connection isn't allowed to run an
+// operation. All operations that are enabled are allowed if authentication is disabled.
+func (h *Handler) authorize(conn *bufferedConnection, op proto.Op) error {
+	if err := h.enabled(op); err != nil {
+		return err
+	}
+
+	required := requiredPermission(op)
+	if h.credentials == nil || required == PermissionNone {
+		return nil
+	}
+
+	if conn.user == nil {
+		return core.ErrUnauthenticated
+	}
+
+	if conn.user.Permission < required {
+		return core.ErrPermissionDenied
+	}
+
+	return nil
+}
+
+// enabled returns an error if an operation must be explicitly enabled by the server
+// configuration and hasn't been. These operations affect other clients so they can't
+// be allowed just because authentication is disabled.
+func (h *Handler) enabled(op proto.Op) error {
+	switch op.Type() {
+	case proto.OpTypeCloseConn, proto.OpTypeShutdown:
+		if !h.settings.ShutdownCommand {
+			return core.ClientError("%s not enabled", op.Type())
+		}
+	}
+
+	return nil
+}
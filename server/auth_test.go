@@ -0,0 +1,216 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+func TestRequiredPermission_Stats(t *testing.T) {
+	tests := []struct {
+		group    string
+		expected Permission
+	}{
+		{group: proto.StatsGeneral, expected: PermissionReadOnly},
+		{group: proto.StatsItems, expected: PermissionReadOnly},
+		{group: proto.StatsLatency, expected: PermissionReadOnly},
+		{group: proto.StatsSettings, expected: PermissionReadOnly},
+		{group: proto.StatsSizes, expected: PermissionReadOnly},
+		{group: proto.StatsConns, expected: PermissionAdmin},
+		{group: proto.StatsReset, expected: PermissionAdmin},
+	}
+
+	for _, tc := range tests {
+		if p := requiredPermission(proto.StatsOp{Group: tc.group}); p != tc.expected {
+			t.Errorf("expected permission %v for stats group %q, got %v", tc.expected, tc.group, p)
+		}
+	}
+}
+
+func TestRequiredPermission_MetaGet(t *testing.T) {
+	tests := []struct {
+		op       *proto.MetaGetOp
+		expected Permission
+	}{
+		{op: &proto.MetaGetOp{Key: "a"}, expected: PermissionReadOnly},
+		{op: &proto.MetaGetOp{Key: "a", Recache: true, RecacheTTL: 10}, expected: PermissionReadOnly},
+		{op: &proto.MetaGetOp{Key: "a", UpdateExpire: true, Expire: 10}, expected: PermissionReadWrite},
+		{op: &proto.MetaGetOp{Key: "a", AutoVivify: true, VivifyExpire: 10}, expected: PermissionReadWrite},
+	}
+
+	for _, tc := range tests {
+		if p := requiredPermission(tc.op); p != tc.expected {
+			t.Errorf("expected permission %v for %+v, got %v", tc.expected, tc.op, p)
+		}
+	}
+}
+
+// newTestCredentials writes a credentials file with a user for each permission level and
+// loads it.
+func newTestCredentials(t *testing.T) *Credentials {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "credentials")
+	contents := "# Users for tests\n\nreader:rpass:read-only\nwriter:w:pass:read-write\nadmin:apass:admin\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("unexpected error writing credentials: %s", err)
+	}
+
+	creds, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading credentials: %s", err)
+	}
+
+	return creds
+}
+
+func TestLoadCredentials(t *testing.T) {
+	creds := newTestCredentials(t)
+	tests := []struct {
+		username string
+		password string
+		expected Permission
+		ok       bool
+	}{
+		{username: "reader", password: "rpass", expected: PermissionReadOnly, ok: true},
+		{username: "writer", password: "w:pass", expected: PermissionReadWrite, ok: true},
+		{username: "admin", password: "apass", expected: PermissionAdmin, ok: true},
+		{username: "admin", password: "rpass"},
+		{username: "admin", password: ""},
+		{username: "missing", password: "apass"},
+	}
+
+	for _, tc := range tests {
+		user, ok := creds.Authenticate(tc.username, tc.password)
+		if ok != tc.ok {
+			t.Errorf("expected authentication of %s with %q to be %v", tc.username, tc.password, tc.ok)
+		} else if ok && (user.Name != tc.username || user.Permission != tc.expected) {
+			t.Errorf("expected user %s with permission %v, got %+v", tc.username, tc.expected, user)
+		}
+	}
+}
+
+func TestLoadCredentials_Invalid(t *testing.T) {
+	for _, contents := range []string{
+		"reader\n",
+		"reader:rpass\n",
+		":rpass:read-only\n",
+		"reader:rpass:superuser\n",
+	} {
+		path := filepath.Join(t.TempDir(), "credentials")
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatalf("unexpected error writing credentials: %s", err)
+		}
+
+		if _, err := LoadCredentials(path); err == nil {
+			t.Errorf("expected error loading credentials %q", contents)
+		}
+	}
+
+	if _, err := LoadCredentials(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("expected error loading missing credentials file")
+	}
+}
+
+func TestRequiredPermission(t *testing.T) {
+	tests := []struct {
+		op       proto.Op
+		expected Permission
+	}{
+		{op: proto.VersionOp{}, expected: PermissionNone},
+		{op: proto.MetaNoOpOp{}, expected: PermissionNone},
+		{op: &proto.SaslAuthOp{}, expected: PermissionNone},
+		{op: &proto.GetOp{}, expected: PermissionReadOnly},
+		{op: &proto.MetaDebugOp{}, expected: PermissionReadOnly},
+		{op: &proto.SetOp{}, expected: PermissionReadWrite},
+		{op: &proto.DeleteOp{}, expected: PermissionReadWrite},
+		{op: &proto.GatOp{}, expected: PermissionReadWrite},
+		{op: &proto.MetaSetOp{}, expected: PermissionReadWrite},
+		{op: &proto.FlushAllOp{}, expected: PermissionAdmin},
+		{op: &proto.CacheMemLimitOp{}, expected: PermissionAdmin},
+		{op: &proto.CloseConnOp{}, expected: PermissionAdmin},
+	}
+
+	for _, tc := range tests {
+		if p := requiredPermission(tc.op); p != tc.expected {
+			t.Errorf("expected permission %v for %s, got %v", tc.expected, tc.op.Type(), p)
+		}
+	}
+}
+
+func TestHandler_TextAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		expected string
+	}{
+		{
+			name:     "unauthenticated",
+			in:       "get a\r\nmn\r\n",
+			expected: "CLIENT_ERROR unauthenticated\r\nMN\r\n",
+		},
+		{
+			name:     "wrong password",
+			in:       "set auth 0 0 12\r\nreader wrong\r\nget a\r\n",
+			expected: "CLIENT_ERROR authentication failure\r\nCLIENT_ERROR unauthenticated\r\n",
+		},
+		{
+			name:     "read-only",
+			in:       "set auth 0 0 12\r\nreader rpass\r\nget a\r\nset a 0 0 1\r\n1\r\n",
+			expected: "STORED\r\nEND\r\nCLIENT_ERROR permission denied\r\n",
+		},
+		{
+			name:     "read-write",
+			in:       "set auth 0 0 13\r\nwriter w:pass\r\nset a 0 0 1\r\n1\r\nflush_all\r\n",
+			expected: "STORED\r\nSTORED\r\nCLIENT_ERROR permission denied\r\n",
+		},
+		{
+			name:     "admin",
+			in:       "set auth 0 0 11\r\nadmin apass\r\nflush_all\r\n",
+			expected: "STORED\r\nOK\r\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler()
+			h.credentials = newTestCredentials(t)
+
+			if out := serve(t, h, &chunkedConn{chunks: []string{tc.in}}); out != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestHandler_BinarySaslAuth(t *testing.T) {
+	h := newTestHandler()
+	h.credentials = newTestCredentials(t)
+
+	get := binaryRequest(proto.BinaryOpGet, 0, nil, "a", "")
+	in := get +
+		binaryRequest(proto.BinaryOpSaslList, 0, nil, "", "") +
+		binaryRequest(proto.BinaryOpSaslAuth, 0, nil, proto.SaslMechPlain, "\x00reader\x00wrong") +
+		binaryRequest(proto.BinaryOpSaslAuth, 0, nil, proto.SaslMechPlain, "\x00reader\x00rpass") +
+		get
+
+	var statuses []proto.BinaryStatus
+	for _, res := range binaryResponses(t, serve(t, h, &chunkedConn{chunks: []string{in}})) {
+		statuses = append(statuses, res.status)
+	}
+
+	expected := []proto.BinaryStatus{
+		proto.BinaryStatusAuthError,
+		proto.BinaryStatusOk,
+		proto.BinaryStatusAuthError,
+		proto.BinaryStatusOk,
+		proto.BinaryStatusNotFound,
+	}
+
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected statuses %v, got %v", expected, statuses)
+	}
+}
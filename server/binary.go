@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/56quarters/jankcache/server/cache"
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// serveBinary reads, executes, and writes the response for a single binary protocol
+// command from a client connection. Output is only flushed once there are no more
+// pipelined commands buffered.
+func (h *Handler) serveBinary(conn *bufferedConnection) error {
+	if err := h.begin(conn); err != nil {
+		return err
+	}
+	defer h.finish(conn)
+
+	if err := h.handleBinary(conn); err != nil {
+		return err
+	}
+
+	return conn.Flush()
+}
+
+func (h *Handler) handleBinary(conn *bufferedConnection) error {
+	output := proto.NewBinaryEncoder(conn)
+
+	req, op, err := h.parser.ParseBinary(conn.Reader)
+	if err != nil && req == nil {
+		return err
+	} else if err != nil {
+		h.countError(err)
+		output.Error(&req.Header, err)
+		return nil
+	}
+
+	conn.parsed(op)
+	header := &req.Header
+	quiet := header.Opcode.Quiet()
+
+	if err := h.authorize(conn, op); err != nil {
+		output.Error(header, err)
+		return nil
+	}
+
+	switch op.Type() {
+	case proto.OpTypeAdd:
+		res, err := h.cacheFor(conn, string(req.Key)).Add(op.(*proto.AddOp))
+		h.binaryStoreResult(output, header, res, err)
+	case proto.OpTypeAppend:
+		res, err := h.cacheFor(conn, string(req.Key)).Append(op.(*proto.AppendOp))
+		h.binaryStoreResult(output, header, res, err)
+	case proto.OpTypeCas:
+		res, err := h.cacheFor(conn, string(req.Key)).Cas(op.(*proto.CasOp))
+		h.binaryStoreResult(output, header, res, err)
+	case proto.OpTypeDelete:
+		err := h.cacheFor(conn, string(req.Key)).Delete(op.(*proto.DeleteOp))
+		if err != nil {
+			output.Error(header, err)
+		} else if !quiet {
+			output.Ok(header, 0)
+		}
+	case proto.OpTypeFlushAll:
+		err := h.tenants.FlushAll(op.(*proto.FlushAllOp))
+		if err != nil {
+			output.Error(header, err)
+		} else if !quiet {
+			output.Ok(header, 0)
+		}
+	case proto.OpTypeGat:
+		res, err := h.tenants.Gat(conn.user, op.(*proto.GatOp))
+		binaryRetrievalResult(output, header, req.Key, res, err)
+	case proto.OpTypeGet:
+		res, err := h.tenants.Get(conn.user, op.(*proto.GetOp))
+		binaryRetrievalResult(output, header, req.Key, res, err)
+	case proto.OpTypeMetaArithmetic:
+		res, err := h.cacheFor(conn, string(req.Key)).MetaArithmetic(op.(*proto.MetaArithmeticOp))
+		if err == nil {
+			err = metaStatusError(res.Status)
+		}
+
+		if err != nil {
+			output.Error(header, err)
+		} else if res.Status != proto.MetaStatusHeader && res.Status != proto.MetaStatusValue {
+			output.Error(header, core.ServerError("unexpected arithmetic result %s", res.Status))
+		} else if !quiet {
+			value, err := strconv.ParseUint(string(res.Entry.Value), 10, 64)
+			if err != nil {
+				output.Error(header, err)
+			} else {
+				output.Response(header, proto.BinaryStatusOk, res.Entry.Unique, nil, nil, binary.BigEndian.AppendUint64(nil, value))
+			}
+		}
+	case proto.OpTypeMetaDelete:
+		res, err := h.cacheFor(conn, string(req.Key)).MetaDelete(op.(*proto.MetaDeleteOp))
+		h.binaryMetaResult(output, header, res, err)
+	case proto.OpTypeMetaNoOp:
+		output.Ok(header, 0)
+	case proto.OpTypeQuit:
+		if !quiet {
+			output.Ok(header, 0)
+		}
+
+		return core.ErrQuit
+	case proto.OpTypePrepend:
+		res, err := h.cacheFor(conn, string(req.Key)).Prepend(op.(*proto.PrependOp))
+		h.binaryStoreResult(output, header, res, err)
+	case proto.OpTypeReplace:
+		res, err := h.cacheFor(conn, string(req.Key)).Replace(op.(*proto.ReplaceOp))
+		h.binaryStoreResult(output, header, res, err)
+	case proto.OpTypeSaslAuth:
+		if err := h.authenticate(conn, op.(*proto.SaslAuthOp)); err != nil {
+			output.Error(header, err)
+		} else {
+			output.Response(header, proto.BinaryStatusOk, 0, nil, nil, []byte("Authenticated"))
+		}
+	case proto.OpTypeMetaSet:
+		res, err := h.cacheFor(conn, string(req.Key)).MetaSet(op.(*proto.MetaSetOp))
+		h.binaryMetaResult(output, header, res, err)
+	case proto.OpTypeSaslListMechs:
+		output.Response(header, proto.BinaryStatusOk, 0, nil, nil, []byte(proto.SaslMechPlain))
+	case proto.OpTypeSet:
+		res, err := h.cacheFor(conn, string(req.Key)).Set(op.(*proto.SetOp))
+		h.binaryStoreResult(output, header, res, err)
+	case proto.OpTypeStats:
+		statsOp := op.(proto.StatsOp)
+		if statsOp.Group == proto.StatsReset {
+			// Only the terminator is sent in response to a reset
+			h.metrics.Reset()
+			h.tenants.ResetStats()
+		} else {
+			for _, v := range h.stats(statsOp) {
+				output.Response(header, proto.BinaryStatusOk, 0, nil, []byte(v.Name), []byte(v.Value))
+			}
+		}
+
+		// An empty key and value signal the end of the stats
+		output.Ok(header, 0)
+	case proto.OpTypeTouch:
+		err := h.cacheFor(conn, string(req.Key)).Touch(op.(*proto.TouchOp))
+		if err != nil {
+			output.Error(header, err)
+		} else {
+			output.Ok(header, 0)
+		}
+	case proto.OpTypeVersion:
+		output.Response(header, proto.BinaryStatusOk, 0, nil, nil, []byte(version))
+	default:
+		panic(fmt.Sprintf("unexpected operation type: %+v", op))
+	}
+
+	return nil
+}
+
+// binaryStoreResult writes the response to a binary storage command: the CAS value of
+// the stored entry, or an error status if it wasn't stored.
+func (h *Handler) binaryStoreResult(output *proto.BinaryEncoder, header *proto.BinaryHeader, res *cache.Entry, err error) {
+	h.countError(err)
+	if err != nil {
+		output.Error(header, err)
+	} else if !header.Opcode.Quiet() {
+		output.Ok(header, res.Unique)
+	}
+}
+
+// binaryMetaResult writes the response to a binary command run as a meta command so that
+// it can compare CAS values: the CAS value of the modified entry, if any, or an error status
+// if the entry wasn't modified.
+func (h *Handler) binaryMetaResult(output *proto.BinaryEncoder, header *proto.BinaryHeader, res *cache.MetaResult, err error) {
+	if err == nil {
+		err = metaStatusError(res.Status)
+	}
+
+	h.countError(err)
+	if err != nil {
+		output.Error(header, err)
+	} else if !header.Opcode.Quiet() {
+		var unique uint64
+		if res.Entry != nil {
+			unique = res.Entry.Unique
+		}
+
+		output.Ok(header, unique)
+	}
+}
+
+// metaStatusError returns the error equivalent to a meta status that means an entry
+// wasn't found or modified, nil for any other status.
+func metaStatusError(status proto.MetaStatus) error {
+	switch status {
+	case proto.MetaStatusNotFound:
+		return core.ErrNotFound
+	case proto.MetaStatusExists:
+		return core.ErrExists
+	case proto.MetaStatusNotStored:
+		return core.ErrNotStored
+	}
+
+	return nil
+}
+
+// binaryRetrievalResult writes the response to a binary get command. Binary gets are
+// always for a single key so there is at most one result.
+func binaryRetrievalResult(output *proto.BinaryEncoder, header *proto.BinaryHeader, key []byte, res []*cache.Entry, err error) {
+	if err != nil {
+		output.Error(header, err)
+		return
+	}
+
+	if len(res) == 0 {
+		if !header.Opcode.Quiet() {
+			output.Error(header, core.ErrNotFound)
+		}
+
+		return
+	}
+
+	var retKey []byte
+	if header.Opcode.ReturnKey() {
+		retKey = key
+	}
+
+	entry := res[0]
+	extras := binary.BigEndian.AppendUint32(nil, entry.Flags)
+	output.Response(header, proto.BinaryStatusOk, entry.Unique, extras, retKey, entry.Value)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// binaryRequest encodes a binary protocol request with the given body.
+func binaryRequest(opcode proto.BinaryOpcode, cas uint64, extras []byte, key string, value string) string {
+	var buf [24]byte
+	buf[0] = proto.BinaryMagicRequest
+	buf[1] = byte(opcode)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+
+	return string(buf[:]) + string(extras) + key + value
+}
+
+// binaryResponse is a decoded binary protocol response.
+type binaryResponse struct {
+	opcode proto.BinaryOpcode
+	status proto.BinaryStatus
+	cas    uint64
+	extras string
+	key    string
+	value  string
+}
+
+// binaryResponses decodes all binary responses written to out.
+func binaryResponses(t *testing.T, out string) []binaryResponse {
+	t.Helper()
+
+	var responses []binaryResponse
+	for len(out) > 0 {
+		if len(out) < 24 || out[0] != proto.BinaryMagicResponse {
+			t.Fatalf("invalid response header %q", out)
+		}
+
+		keyLength := int(binary.BigEndian.Uint16([]byte(out[2:4])))
+		extrasLength := int(out[4])
+		bodyLength := int(binary.BigEndian.Uint32([]byte(out[8:12])))
+		if len(out) < 24+bodyLength {
+			t.Fatalf("truncated response body %q", out)
+		}
+
+		body := out[24 : 24+bodyLength]
+		responses = append(responses, binaryResponse{
+			opcode: proto.BinaryOpcode(out[1]),
+			status: proto.BinaryStatus(binary.BigEndian.Uint16([]byte(out[6:8]))),
+			cas:    binary.BigEndian.Uint64([]byte(out[16:24])),
+			extras: body[:extrasLength],
+			key:    body[extrasLength : extrasLength+keyLength],
+			value:  body[extrasLength+keyLength:],
+		})
+
+		out = out[24+bodyLength:]
+	}
+
+	return responses
+}
+
+func TestHandler_BinaryCompareCas(t *testing.T) {
+	incr := make([]byte, 20)
+	binary.BigEndian.PutUint64(incr[0:8], 1)
+	binary.BigEndian.PutUint32(incr[16:20], 0xffffffff)
+
+	tests := []struct {
+		name     string
+		request  func(cas uint64) string
+		expected string
+	}{
+		{
+			name:     "append",
+			request:  func(cas uint64) string { return binaryRequest(proto.BinaryOpAppend, cas, nil, "foo", "1") },
+			expected: "11",
+		},
+		{
+			name:     "prepend",
+			request:  func(cas uint64) string { return binaryRequest(proto.BinaryOpPrepend, cas, nil, "foo", "2") },
+			expected: "21",
+		},
+		{
+			name:     "increment",
+			request:  func(cas uint64) string { return binaryRequest(proto.BinaryOpIncrement, cas, incr, "foo", "") },
+			expected: "2",
+		},
+		{
+			name:     "decrement",
+			request:  func(cas uint64) string { return binaryRequest(proto.BinaryOpDecrement, cas, incr, "foo", "") },
+			expected: "0",
+		},
+		{
+			name:    "delete",
+			request: func(cas uint64) string { return binaryRequest(proto.BinaryOpDelete, cas, nil, "foo", "") },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler()
+			if _, err := h.tenants.Default().Set(&proto.SetOp{Key: "foo", Bytes: []byte("1")}); err != nil {
+				t.Fatalf("unexpected error setting entry: %s", err)
+			}
+
+			cas := unique(t, h, "foo")
+			out := serve(t, h, &chunkedConn{chunks: []string{tc.request(cas+1) + tc.request(cas)}})
+
+			res := binaryResponses(t, out)
+			if len(res) != 2 || res[0].status != proto.BinaryStatusExists || res[1].status != proto.BinaryStatusOk {
+				t.Fatalf("expected exists then ok, got %+v", res)
+			}
+
+			entries, err := h.tenants.Default().Get(&proto.GetOp{Keys: []string{"foo"}})
+			if err != nil {
+				t.Fatalf("unexpected error getting entry: %s", err)
+			}
+
+			if tc.expected == "" && len(entries) != 0 {
+				t.Errorf("expected entry to be deleted, got %q", entries[0].Value)
+			} else if tc.expected != "" && (len(entries) != 1 || string(entries[0].Value) != tc.expected) {
+				t.Errorf("expected value %q, got %v", tc.expected, entries)
+			}
+		})
+	}
+}
+
+func TestHandler_BinarySetGet(t *testing.T) {
+	storage := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 5), 0)
+	in := binaryRequest(proto.BinaryOpSet, 0, storage, "foo", "bar") +
+		binaryRequest(proto.BinaryOpSetQ, 0, storage, "baz", "qux") +
+		binaryRequest(proto.BinaryOpGetQ, 0, nil, "missing", "") +
+		binaryRequest(proto.BinaryOpGetK, 0, nil, "foo", "") +
+		binaryRequest(proto.BinaryOpGet, 0, nil, "missing", "") +
+		binaryRequest(proto.BinaryOpNoOp, 0, nil, "", "")
+
+	h := newTestHandler()
+	res := binaryResponses(t, serve(t, h, &chunkedConn{chunks: []string{in}}))
+
+	// Quiet set and a quiet get miss don't write responses
+	cas := unique(t, h, "foo")
+	expected := []binaryResponse{
+		{opcode: proto.BinaryOpSet, status: proto.BinaryStatusOk, cas: cas},
+		{opcode: proto.BinaryOpGetK, status: proto.BinaryStatusOk, cas: cas, extras: "\x00\x00\x00\x05", key: "foo", value: "bar"},
+		{opcode: proto.BinaryOpGet, status: proto.BinaryStatusNotFound, value: core.ErrNotFound.Error()},
+		{opcode: proto.BinaryOpNoOp, status: proto.BinaryStatusOk},
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected responses %+v, got %+v", expected, res)
+	}
+
+	if _, err := h.tenants.Default().Get(&proto.GetOp{Keys: []string{"baz"}}); err != nil {
+		t.Errorf("unexpected error getting quietly set entry: %s", err)
+	}
+}
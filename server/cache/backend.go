@@ -0,0 +1,433 @@
+package cache
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+const (
+	BackendRistretto = "ristretto"
+	BackendLRU       = "lru"
+
+	// settleInterval is how often entries buffered by ristretto are checked for
+	// whether they've been stored.
+	settleInterval = 100 * time.Millisecond
+)
+
+// Backend is the storage for cache entries. Backends are responsible for expiration
+// and for evicting entries when they exceed their max cost. They must be safe for
+// concurrent use.
+type Backend interface {
+	// Get returns the entry for key if it exists and hasn't expired. Gets are used both
+	// by commands that return entries and commands that modify them so hits and misses
+	// are counted by the Cache rather than the backend.
+	Get(key string) (*Entry, bool)
+
+	// GetTTL returns the time left before the entry for key expires, zero if
+	// it never expires. False is returned if the entry doesn't exist.
+	GetTTL(key string) (time.Duration, bool)
+
+	// SetWithTTL stores an entry, replacing any existing entry for the same key. Backends
+	// may store entries asynchronously but the entry must be visible to Get and GetTTL as
+	// soon as this returns, until it's rejected or removed. Returns false if the entry was
+	// dropped or rejected.
+	SetWithTTL(entry *Entry, ttl time.Duration) bool
+
+	// Wait blocks until all entries stored asynchronously have been stored or rejected.
+	Wait()
+
+	// Delete removes the entry for key if it exists.
+	Delete(key string)
+
+	// Metrics returns counts of the operations performed by the backend.
+	Metrics() Metrics
+
+	// Usage returns the number of entries currently stored and their total cost.
+	Usage() Usage
+
+	// MaxCost returns the max total cost of all stored entries.
+	MaxCost() int64
+
+	// UpdateMaxCost changes the max total cost of all stored entries, evicting
+	// entries if required.
+	UpdateMaxCost(maxCost int64)
+
+	// Close stops any background work done by the backend. Entries can't be stored
+	// once the backend has been closed.
+	Close()
+}
+
+// Metrics are counts of operations performed by a Backend. Keys and cost that are
+// evicted are entries removed to make room for other entries. Ristretto doesn't make
+// that distinction so it also counts entries that were deleted or expired.
+type Metrics interface {
+	GetsDropped() uint64
+	KeysAdded() uint64
+	KeysUpdated() uint64
+	KeysEvicted() uint64
+	CostAdded() uint64
+	CostEvicted() uint64
+	SetsDropped() uint64
+	SetsRejected() uint64
+}
+
+// Usage is the number of entries stored by a Backend and their total cost. Entries
+// that are deleted, expired, evicted, or rejected are not included.
+type Usage struct {
+	Items uint64
+	Bytes uint64
+	// Sizes are the number of entries by cost, smallest first. Only sizes with at
+	// least one entry are included.
+	Sizes []SizeCount
+}
+
+// SizeCount is the number of entries with a cost greater than half of Size and at
+// most Size.
+type SizeCount struct {
+	Size  uint64
+	Count uint64
+}
+
+// usageCounter tracks the number and cost of stored entries. Counts can briefly go
+// negative when an entry is removed concurrently with being added.
+type usageCounter struct {
+	items atomic.Int64
+	bytes atomic.Int64
+	sizes [64]atomic.Int64 // entries by power of two cost
+}
+
+// sizeBucket returns the index of the smallest power of two that is at least cost.
+func sizeBucket(cost int64) int {
+	if cost <= 1 {
+		return 0
+	}
+
+	return bits.Len64(uint64(cost - 1))
+}
+
+func (u *usageCounter) add(e *Entry) {
+	cost := e.Cost()
+	u.items.Add(1)
+	u.bytes.Add(cost)
+	u.sizes[sizeBucket(cost)].Add(1)
+}
+
+func (u *usageCounter) remove(e *Entry) {
+	cost := e.Cost()
+	u.items.Add(-1)
+	u.bytes.Add(-cost)
+	u.sizes[sizeBucket(cost)].Add(-1)
+}
+
+func (u *usageCounter) usage() Usage {
+	var usage Usage
+	if items := u.items.Load(); items > 0 {
+		usage.Items = uint64(items)
+	}
+
+	if bytes := u.bytes.Load(); bytes > 0 {
+		usage.Bytes = uint64(bytes)
+	}
+
+	for i := range u.sizes {
+		if count := u.sizes[i].Load(); count > 0 {
+			usage.Sizes = append(usage.Sizes, SizeCount{Size: 1 << i, Count: uint64(count)})
+		}
+	}
+
+	return usage
+}
+
+// NewBackend creates the backend with the given name.
+func NewBackend(name string, maxCost int64) (Backend, error) {
+	switch name {
+	case BackendRistretto:
+		return NewRistrettoBackend(maxCost)
+	case BackendLRU:
+		return NewLRUBackend(maxCost), nil
+	}
+
+	return nil, fmt.Errorf("unknown cache backend '%s'", name)
+}
+
+// RistrettoBackend is a Backend that uses TinyLFU admission and eviction. New entries
+// are stored asynchronously and may be rejected if they're less valuable than entries
+// that would be evicted to make room for them.
+type RistrettoBackend struct {
+	cache *ristretto.Cache
+	usage usageCounter
+
+	// New entries are kept here until ristretto has processed them so that they're
+	// visible to readers immediately. Sets hold the barrier for reading while adding
+	// entries to the ristretto buffer so that Wait knows which entries were buffered
+	// before it started.
+	barrier sync.RWMutex
+	gen     uint64
+	mtx     sync.Mutex
+	pending map[string]pendingEntry
+
+	// Anything that sends to ristretto holds closeMtx for reading since ristretto
+	// panics if the cache is closed at the same time. done stops settling entries.
+	closeMtx sync.RWMutex
+	closed   bool
+	done     chan struct{}
+}
+
+// pendingEntry is an entry that has been set but may not be stored by ristretto yet.
+type pendingEntry struct {
+	entry   *Entry
+	expires time.Time
+	gen     uint64
+}
+
+func NewRistrettoBackend(maxCost int64) (*RistrettoBackend, error) {
+	r := &RistrettoBackend{
+		pending: make(map[string]pendingEntry),
+		done:    make(chan struct{}),
+	}
+
+	rcache, err := ristretto.NewCache(
+		&ristretto.Config{
+			NumCounters:        maxNumCounters,
+			MaxCost:            maxCost,
+			BufferItems:        64,
+			Metrics:            true,
+			IgnoreInternalCost: false,
+			OnExit:             r.exit,
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.cache = rcache
+	go r.settle()
+	return r, nil
+}
+
+// settle periodically removes pending entries once ristretto has processed them,
+// running until the backend is closed. Entries are settled in the background rather
+// than after each set since waiting for ristretto blocks until its buffers are empty.
+func (r *RistrettoBackend) settle() {
+	ticker := time.NewTicker(settleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if r.hasPending() {
+				r.Wait()
+			}
+		}
+	}
+}
+
+func (r *RistrettoBackend) hasPending() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return len(r.pending) > 0
+}
+
+// exit is called by ristretto exactly once for every value accepted by SetWithTTL
+// when it leaves the cache for any reason: replaced, deleted, expired, evicted, or
+// rejected by the admission policy.
+func (r *RistrettoBackend) exit(val interface{}) {
+	if e, ok := val.(*Entry); ok {
+		r.usage.remove(e)
+		r.forget(e)
+	}
+}
+
+// forget removes entry from the pending entries if it hasn't been replaced by a
+// newer entry for the same key.
+func (r *RistrettoBackend) forget(entry *Entry) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if p, ok := r.pending[entry.Key]; ok && p.entry == entry {
+		delete(r.pending, entry.Key)
+	}
+}
+
+// lookupPending returns the pending entry for key if there is one and it hasn't expired.
+func (r *RistrettoBackend) lookupPending(key string) (pendingEntry, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	p, ok := r.pending[key]
+	if !ok || (!p.expires.IsZero() && !time.Now().Before(p.expires)) {
+		return pendingEntry{}, false
+	}
+
+	return p, true
+}
+
+// buffered returns true if there's a pending entry for key that ristretto hasn't
+// stored yet. Entries that have been stored but not settled yet are not included.
+func (r *RistrettoBackend) buffered(key string) bool {
+	if _, ok := r.lookupPending(key); !ok {
+		return false
+	}
+
+	// Unlike Get, this doesn't count as an access of the key by the admission policy
+	_, stored := r.cache.GetTTL(key)
+	return !stored
+}
+
+func (r *RistrettoBackend) Get(key string) (*Entry, bool) {
+	if e, ok := r.cache.Get(key); ok {
+		return e.(*Entry), true
+	}
+
+	if p, ok := r.lookupPending(key); ok {
+		return p.entry, true
+	}
+
+	return nil, false
+}
+
+func (r *RistrettoBackend) GetTTL(key string) (time.Duration, bool) {
+	if ttl, ok := r.cache.GetTTL(key); ok {
+		return ttl, true
+	}
+
+	p, ok := r.lookupPending(key)
+	if !ok {
+		return 0, false
+	}
+
+	if p.expires.IsZero() {
+		return 0, true
+	}
+
+	return time.Until(p.expires), true
+}
+
+func (r *RistrettoBackend) SetWithTTL(entry *Entry, ttl time.Duration) bool {
+	// Same as ristretto, a negative TTL means the entry is already expired
+	if ttl < 0 {
+		return false
+	}
+
+	// Ristretto only updates entries synchronously once it has stored them. If an
+	// earlier entry for the key is still buffered, this one would be buffered as a
+	// second new entry and rejected when the first is admitted, so wait for the first
+	// one to be stored or rejected. Callers serialize sets for the same key.
+	if r.buffered(entry.Key) {
+		r.Wait()
+	}
+
+	r.closeMtx.RLock()
+	defer r.closeMtx.RUnlock()
+
+	if r.closed {
+		return false
+	}
+
+	r.barrier.RLock()
+	defer r.barrier.RUnlock()
+
+	p := pendingEntry{entry: entry, gen: r.gen}
+	if ttl > 0 {
+		p.expires = time.Now().Add(ttl)
+	}
+
+	// The entry is made visible before giving it to ristretto so there's no point
+	// where it's in neither place. Ristretto may call the exit callback before
+	// returning so the lock can't be held.
+	r.mtx.Lock()
+	r.pending[entry.Key] = p
+	r.mtx.Unlock()
+
+	if !r.cache.SetWithTTL(entry.Key, entry, entry.Cost(), ttl) {
+		r.forget(entry)
+		return false
+	}
+
+	// Count the entry as soon as it's accepted, if it's rejected later the
+	// exit callback will remove it again.
+	r.usage.add(entry)
+	return true
+}
+
+func (r *RistrettoBackend) Wait() {
+	r.closeMtx.RLock()
+	defer r.closeMtx.RUnlock()
+
+	if r.closed {
+		return
+	}
+
+	r.barrier.Lock()
+	gen := r.gen
+	r.gen++
+	r.barrier.Unlock()
+
+	// Every entry with the same or an earlier generation is in the ristretto buffer
+	// ahead of this wait and has either been stored or rejected once it returns.
+	r.cache.Wait()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for key, p := range r.pending {
+		if p.gen <= gen {
+			delete(r.pending, key)
+		}
+	}
+}
+
+func (r *RistrettoBackend) Delete(key string) {
+	r.closeMtx.RLock()
+	defer r.closeMtx.RUnlock()
+
+	r.mtx.Lock()
+	delete(r.pending, key)
+	r.mtx.Unlock()
+
+	if !r.closed {
+		r.cache.Del(key)
+	}
+}
+
+// Metrics returns the metrics tracked by ristretto. Note that ristretto also counts hits
+// and misses for every Get but those aren't exposed since they include internal lookups.
+func (r *RistrettoBackend) Metrics() Metrics {
+	return r.cache.Metrics
+}
+
+func (r *RistrettoBackend) Usage() Usage {
+	return r.usage.usage()
+}
+
+func (r *RistrettoBackend) MaxCost() int64 {
+	return r.cache.MaxCost()
+}
+
+func (r *RistrettoBackend) UpdateMaxCost(maxCost int64) {
+	r.cache.UpdateMaxCost(maxCost)
+}
+
+// Close stops settling pending entries and closes the ristretto cache, stopping the
+// goroutines it runs. It's safe to call more than once.
+func (r *RistrettoBackend) Close() {
+	r.closeMtx.Lock()
+	defer r.closeMtx.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.closed = true
+	close(r.done)
+	r.cache.Close()
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestRistrettoBackend(t *testing.T) *RistrettoBackend {
+	t.Helper()
+
+	r, err := NewRistrettoBackend(1024 * 1024)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %s", err)
+	}
+
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestRistrettoBackend_SetNewKeyTwice(t *testing.T) {
+	r := newTestRistrettoBackend(t)
+
+	// Both sets happen before ristretto has processed either of them
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		first := &Entry{Key: key, Value: []byte("first")}
+		second := &Entry{Key: key, Value: []byte("second")}
+
+		if !r.SetWithTTL(first, 0) || !r.SetWithTTL(second, 0) {
+			t.Fatalf("expected entries for %s to be stored", key)
+		}
+
+		r.Wait()
+		if e, ok := r.Get(key); !ok || e != second {
+			t.Fatalf("expected second entry for %s after wait, got %v, %v", key, e, ok)
+		}
+	}
+}
+
+func TestRistrettoBackend_SettlesPending(t *testing.T) {
+	r := newTestRistrettoBackend(t)
+	if !r.SetWithTTL(&Entry{Key: "a", Value: []byte("value")}, 0) {
+		t.Fatalf("expected entry to be stored")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.hasPending() {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending entries weren't settled")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := r.Get("a"); !ok {
+		t.Errorf("expected entry to exist after being settled")
+	}
+}
+
+func TestRistrettoBackend_Close(t *testing.T) {
+	r := newTestRistrettoBackend(t)
+	r.Close()
+
+	select {
+	case <-r.done:
+	default:
+		t.Fatalf("expected settling to be stopped")
+	}
+
+	if r.SetWithTTL(&Entry{Key: "a", Value: []byte("value")}, 0) {
+		t.Errorf("expected set after close to fail")
+	}
+
+	// Neither of these may panic after the ristretto cache is closed
+	r.Delete("a")
+	r.Wait()
+	r.Close()
+}
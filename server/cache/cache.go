@@ -3,26 +3,35 @@ package cache
 import (
 	"flag"
 	"fmt"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 
+	"github.com/56quarters/jankcache/server/core"
 	"github.com/56quarters/jankcache/server/proto"
 )
 
 const secondsInThirtyDays = 60 * 60 * 24 * 30
 const maxNumCounters = 100_000
+const numLocks = 256
 
 type Config struct {
-	MaxSizeMb   uint64
-	MaxItemSize uint64
+	Backend        string
+	MaxSizeMb      uint64
+	MaxItemSize    uint64
+	ReadYourWrites bool
 }
 
 func (c *Config) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	fs.StringVar(&c.Backend, prefix+"backend", BackendRistretto, "Storage for cache entries: 'ristretto' for TinyLFU admission and eviction, 'lru' for strict LRU eviction that always admits new entries")
 	fs.Uint64Var(&c.MaxSizeMb, prefix+"max-size-mb", 64, "Max cache size in megabytes")
 	fs.Uint64Var(&c.MaxItemSize, prefix+"max-item-size", 1024*1024, "Max size of a cache entry in bytes")
+	fs.BoolVar(&c.ReadYourWrites, prefix+"read-your-writes", false, "Only reply to storage commands once the backend has stored the entry, and reply with an error if the backend drops or rejects the entry. Slows down writes when using the ristretto backend")
 }
 
 func (c *Config) Validate() error {
@@ -34,6 +43,10 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid valid for max-item-size: %d", c.MaxItemSize)
 	}
 
+	if c.Backend != BackendRistretto && c.Backend != BackendLRU {
+		return fmt.Errorf("invalid value for backend: %s", c.Backend)
+	}
+
 	return nil
 }
 
@@ -41,12 +54,17 @@ type Entry struct {
 	Key    string
 	Unique uint64
 	Flags  uint32
+	Time   int64
 	Value  []byte
+
+	// winSent is true once a meta client has been told to populate this entry, so that
+	// other clients are told it's already being populated.
+	winSent atomic.Bool
 }
 
 func (e *Entry) Cost() int64 {
-	// unique (8 bytes) + flags (4 bytes) + key + payload
-	return 12 + int64(len(e.Key)) + int64(len(e.Value))
+	// unique (8 bytes) + flags (4 bytes) + time (8 bytes) + key + payload
+	return 20 + int64(len(e.Key)) + int64(len(e.Value))
 }
 
 func (e *Entry) MarshallMemcached(o *proto.Encoder) {
@@ -63,35 +81,113 @@ func (e *NoCasEntry) MarshallMemcached(o *proto.Encoder) {
 	o.Bytes(e.Value)
 }
 
+// Counters are counts of command outcomes tracked by the cache in addition to the
+// metrics that the backend tracks.
+type Counters struct {
+	GetHits   atomic.Uint64
+	GetMisses atomic.Uint64
+
+	// Sets is the number of storage commands run, whether or not they stored an entry:
+	// set, cas, add, replace, append, prepend, and ms.
+	Sets atomic.Uint64
+
+	IncrHits   atomic.Uint64
+	IncrMisses atomic.Uint64
+	DecrHits   atomic.Uint64
+	DecrMisses atomic.Uint64
+
+	DeleteHits   atomic.Uint64
+	DeleteMisses atomic.Uint64
+
+	Touches     atomic.Uint64
+	TouchHits   atomic.Uint64
+	TouchMisses atomic.Uint64
+
+	Flushes    atomic.Uint64
+	GetFlushed atomic.Uint64
+
+	Collisions  atomic.Uint64
+	SetsDropped atomic.Uint64
+}
+
+// HitRatio returns the ratio of gets for entries that exist to all gets.
+func (c *Counters) HitRatio() float64 {
+	hits, misses := c.GetHits.Load(), c.GetMisses.Load()
+	if hits == 0 && misses == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(hits+misses)
+}
+
+// Reset zeroes all counters, as done by a Memcached `stats reset` command.
+func (c *Counters) Reset() {
+	c.GetHits.Store(0)
+	c.GetMisses.Store(0)
+	c.Sets.Store(0)
+	c.IncrHits.Store(0)
+	c.IncrMisses.Store(0)
+	c.DecrHits.Store(0)
+	c.DecrMisses.Store(0)
+	c.DeleteHits.Store(0)
+	c.DeleteMisses.Store(0)
+	c.Touches.Store(0)
+	c.TouchHits.Store(0)
+	c.TouchMisses.Store(0)
+	c.Flushes.Store(0)
+	c.GetFlushed.Store(0)
+	c.Collisions.Store(0)
+	c.SetsDropped.Store(0)
+}
+
+func (c *Counters) arithmetic(decr bool, hit bool) {
+	if decr && hit {
+		c.DecrHits.Add(1)
+	} else if decr {
+		c.DecrMisses.Add(1)
+	} else if hit {
+		c.IncrHits.Add(1)
+	} else {
+		c.IncrMisses.Add(1)
+	}
+}
+
 type Cache struct {
-	delegate *ristretto.Cache
-	cas      atomic.Uint64
-	logger   log.Logger
+	delegate       Backend
+	maxItemSize    uint64
+	readYourWrites bool
+	cas            atomic.Uint64
+	counters       Counters
+	locks          [numLocks]sync.Mutex
+	logger         log.Logger
+
+	// Entries stored at or before flushedBefore have been invalidated by an immediate
+	// "flush_all". Entries stored at or before pendingFlush are invalidated once that
+	// time has passed, zero if there is no delayed "flush_all". flushMtx serializes
+	// updates to both, reads don't need it.
+	flushMtx      sync.Mutex
+	flushedBefore atomic.Int64
+	pendingFlush  atomic.Int64
 }
 
 func New(cfg Config, logger log.Logger) *Cache {
-	rcache, err := ristretto.NewCache(
-		&ristretto.Config{
-			NumCounters:        maxNumCounters,
-			MaxCost:            int64(cfg.MaxSizeMb * 1024 * 1024),
-			BufferItems:        64,
-			Metrics:            true,
-			IgnoreInternalCost: false,
-		},
-	)
-
+	backend, err := NewBackend(cfg.Backend, int64(cfg.MaxSizeMb*1024*1024))
 	if err != nil {
-		// This can only happen if we pass bad config values to ristretto
+		// This can only happen if we pass bad config values to the backend
 		panic(fmt.Sprintf("unexpected error initializing cache: %s", err))
 	}
 
-	return NewFromBacking(rcache, logger)
+	return NewFromBacking(backend, cfg.MaxItemSize, cfg.ReadYourWrites, logger)
 }
 
-func NewFromBacking(cache *ristretto.Cache, logger log.Logger) *Cache {
+// NewFromBacking creates a Cache that stores entries in backend. If readYourWrites is true,
+// storage commands only return once the backend has stored or rejected the entry.
+func NewFromBacking(backend Backend, maxItemSize uint64, readYourWrites bool, logger log.Logger) *Cache {
 	return &Cache{
-		delegate: cache,
-		logger:   logger,
+		delegate:       backend,
+		maxItemSize:    maxItemSize,
+		readYourWrites: readYourWrites,
+		logger:         logger,
 	}
 }
 
@@ -99,8 +195,69 @@ func (c *Cache) MaxBytes() uint64 {
 	return uint64(c.delegate.MaxCost())
 }
 
-func (c *Cache) Metrics() *ristretto.Metrics {
-	return c.delegate.Metrics
+func (c *Cache) Metrics() Metrics {
+	return c.delegate.Metrics()
+}
+
+// Usage returns the number of entries stored and their total cost. Entries invalidated
+// by a "flush_all" command are included until they are read, evicted, or replaced.
+func (c *Cache) Usage() Usage {
+	return c.delegate.Usage()
+}
+
+func (c *Cache) Counters() *Counters {
+	return &c.counters
+}
+
+// Close stops any background work done by the backend. Entries can't be stored once
+// the cache has been closed.
+func (c *Cache) Close() {
+	c.delegate.Close()
+}
+
+func (c *Cache) Add(op *proto.AddOp) (*Entry, error) {
+	c.counters.Sets.Add(1)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if _, ok := c.lookup(op.Key); ok {
+		return nil, core.ErrNotStored
+	}
+
+	entry := c.newEntry(op.Key, op.Flags, op.Bytes)
+	if err := c.store(entry, c.ttl(op.Expire)); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (c *Cache) Append(op *proto.AppendOp) (*Entry, error) {
+	c.counters.Sets.Add(1)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	return c.concat(op.Key, op.Bytes, false)
+}
+
+func (c *Cache) Cas(op *proto.CasOp) (*Entry, error) {
+	c.counters.Sets.Add(1)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if err := c.compare(op.Key, op.Unique); err != nil {
+		return nil, err
+	}
+
+	entry := c.newEntry(op.Key, op.Flags, op.Bytes)
+	if err := c.store(entry, c.ttl(op.Expire)); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
 }
 
 func (c *Cache) CacheMemLimit(op *proto.CacheMemLimitOp) error {
@@ -108,11 +265,79 @@ func (c *Cache) CacheMemLimit(op *proto.CacheMemLimitOp) error {
 	return nil
 }
 
+func (c *Cache) Decr(op *proto.DecrOp) (*Entry, error) {
+	return c.incrOrDecr(op.Key, op.Delta, true)
+}
+
 func (c *Cache) Delete(op *proto.DeleteOp) error {
-	c.delegate.Del(op.Key)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	// Never remove an entry for a different key with the same hash.
+	entry, ok := c.delegate.Get(op.Key)
+	if ok && c.collision(op.Key, entry) {
+		c.counters.DeleteMisses.Add(1)
+		return core.ErrNotFound
+	}
+
+	// Delete even if there's no entry since a new entry for the key may still be buffered
+	// by the backend. The delete is ordered after it so the entry doesn't appear later.
+	c.delegate.Delete(op.Key)
+	if !ok || c.flushed(entry) {
+		c.counters.DeleteMisses.Add(1)
+		return core.ErrNotFound
+	}
+
+	c.counters.DeleteHits.Add(1)
+	return nil
+}
+
+// FlushAll invalidates all entries stored before the time of the flush, optionally
+// delayed. Entries stored after the flush time are unaffected. Invalidated entries are
+// treated as missing by all reads and removed when read, until then they are still
+// included in Usage. A delayed flush replaces any earlier delayed flush that hasn't
+// happened yet but never undoes a flush that already has.
+func (c *Cache) FlushAll(op *proto.FlushAllOp) error {
+	c.flushMtx.Lock()
+	defer c.flushMtx.Unlock()
+
+	c.counters.Flushes.Add(1)
+	now := time.Now().UnixNano()
+
+	// A delayed flush whose time has passed becomes permanent before it can be replaced.
+	// The immediate epoch only moves forward since it's always set to the current time.
+	if pending := c.pendingFlush.Load(); pending != 0 && pending <= now {
+		if pending > c.flushedBefore.Load() {
+			c.flushedBefore.Store(pending)
+		}
+
+		c.pendingFlush.Store(0)
+	}
+
+	if delay := c.ttl(op.Delay); delay > 0 {
+		c.pendingFlush.Store(now + int64(delay))
+	} else {
+		c.flushedBefore.Store(now)
+	}
+
 	return nil
 }
 
+func (c *Cache) Gat(op *proto.GatOp) ([]*Entry, error) {
+	// Same as Get, we don't deduplicate keys or results
+	ttl := c.ttl(op.Expire)
+	out := make([]*Entry, 0, len(op.Keys))
+	for _, k := range op.Keys {
+		e, ok := c.touch(k, ttl)
+		if ok {
+			out = append(out, e)
+		}
+	}
+
+	return out, nil
+}
+
 func (c *Cache) Get(op *proto.GetOp) ([]*Entry, error) {
 	// Slice of entries instead of a map since users can request the same
 	// key multiple times and memcached will return it multiple times. We
@@ -120,28 +345,373 @@ func (c *Cache) Get(op *proto.GetOp) ([]*Entry, error) {
 	// We immediately serialize and write all entries to output.
 	out := make([]*Entry, 0, len(op.Keys))
 	for _, k := range op.Keys {
-		e, ok := c.delegate.Get(k)
+		e, ok := c.get(k)
 		if ok {
-			out = append(out, e.(*Entry))
+			out = append(out, e)
 		}
 	}
 
 	return out, nil
 }
 
-func (c *Cache) Set(op *proto.SetOp) error {
-	ttl := c.ttl(op.Expire)
-	entry := &Entry{
-		Key:    op.Key,
-		Unique: c.unique(),
-		Flags:  op.Flags,
-		Value:  op.Bytes,
+func (c *Cache) Incr(op *proto.IncrOp) (*Entry, error) {
+	return c.incrOrDecr(op.Key, op.Delta, false)
+}
+
+func (c *Cache) Prepend(op *proto.PrependOp) (*Entry, error) {
+	c.counters.Sets.Add(1)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	return c.concat(op.Key, op.Bytes, true)
+}
+
+func (c *Cache) Replace(op *proto.ReplaceOp) (*Entry, error) {
+	c.counters.Sets.Add(1)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if _, ok := c.lookup(op.Key); !ok {
+		return nil, core.ErrNotStored
+	}
+
+	entry := c.newEntry(op.Key, op.Flags, op.Bytes)
+	if err := c.store(entry, c.ttl(op.Expire)); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (c *Cache) Set(op *proto.SetOp) (*Entry, error) {
+	c.counters.Sets.Add(1)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	entry := c.newEntry(op.Key, op.Flags, op.Bytes)
+	if err := c.store(entry, c.ttl(op.Expire)); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (c *Cache) Touch(op *proto.TouchOp) error {
+	if _, ok := c.touch(op.Key, c.ttl(op.Expire)); !ok {
+		return core.ErrNotFound
 	}
 
-	c.delegate.SetWithTTL(entry.Key, entry, entry.Cost(), ttl)
 	return nil
 }
 
+// touch updates the TTL of the entry for key without changing its value or unique
+// value. The entry is removed if the TTL is negative, i.e. the new expiration time
+// is in the past.
+func (c *Cache) touch(key string, ttl time.Duration) (*Entry, bool) {
+	mtx := c.lockFor(key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	c.counters.Touches.Add(1)
+	existing, ok := c.lookup(key)
+	if !ok {
+		c.counters.TouchMisses.Add(1)
+		return nil, false
+	}
+
+	if ttl < 0 {
+		c.delegate.Delete(key)
+	} else {
+		// If the new TTL is dropped the entry is unchanged and still exists, so
+		// this is still a hit. The drop is counted by store.
+		_ = c.store(existing, ttl)
+	}
+
+	c.counters.TouchHits.Add(1)
+	return existing, true
+}
+
+func (c *Cache) incrOrDecr(key string, delta uint64, decr bool) (*Entry, error) {
+	mtx := c.lockFor(key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	existing, ok := c.lookup(key)
+	if !ok {
+		c.counters.arithmetic(decr, false)
+		return nil, core.ErrNotFound
+	}
+
+	ttl, ok := c.remaining(key)
+	if !ok {
+		c.counters.arithmetic(decr, false)
+		return nil, core.ErrNotFound
+	}
+
+	return c.arithmetic(existing, delta, decr, ttl)
+}
+
+// lockFor returns the lock that must be held while reading and then modifying
+// an entry so that commands like "ma" are atomic with respect to other writers.
+func (c *Cache) lockFor(key string) *sync.Mutex {
+	h, _ := z.KeyToHash(key)
+	return &c.locks[h%numLocks]
+}
+
+// concat replaces the entry for key with a copy that has value appended (or prepended)
+// to its existing value. The flags and remaining TTL of the entry are preserved and it
+// is given a new unique value. Callers must hold the lock for the key.
+func (c *Cache) concat(key string, value []byte, prepend bool) (*Entry, error) {
+	existing, ok := c.lookup(key)
+	if !ok {
+		return nil, core.ErrNotStored
+	}
+
+	size := uint64(len(existing.Value)) + uint64(len(value))
+	if size > c.maxItemSize {
+		return nil, core.ErrObjectTooLarge
+	}
+
+	ttl, ok := c.remaining(key)
+	if !ok {
+		return nil, core.ErrNotStored
+	}
+
+	combined := make([]byte, 0, size)
+	if prepend {
+		combined = append(append(combined, value...), existing.Value...)
+	} else {
+		combined = append(append(combined, existing.Value...), value...)
+	}
+
+	entry := c.newEntry(key, existing.Flags, combined)
+	if err := c.store(entry, ttl); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// arithmetic replaces existing with a copy whose value has had delta added to or
+// subtracted from it using memcached semantics: increments wrap at 64 bits and
+// decrements stop at zero. The flags of the entry are preserved and it is given
+// a new unique value. Callers must hold the lock for the key.
+func (c *Cache) arithmetic(existing *Entry, delta uint64, decr bool, ttl time.Duration) (*Entry, error) {
+	current, err := strconv.ParseUint(string(existing.Value), 10, 64)
+	if err != nil {
+		return nil, core.ErrNonNumeric
+	}
+
+	var value uint64
+	if !decr {
+		value = current + delta
+	} else if delta < current {
+		value = current - delta
+	}
+
+	entry := c.newEntry(existing.Key, existing.Flags, []byte(strconv.FormatUint(value, 10)))
+	if err := c.store(entry, ttl); err != nil {
+		return nil, err
+	}
+
+	c.counters.arithmetic(decr, true)
+	return entry, nil
+}
+
+// compare returns core.ErrNotFound if there is no entry for key or core.ErrExists
+// if the entry has been modified since the client read the unique value. Callers
+// must hold the lock for the key.
+func (c *Cache) compare(key string, unique uint64) error {
+	existing, ok := c.lookup(key)
+	if !ok {
+		return core.ErrNotFound
+	}
+
+	if existing.Unique != unique {
+		return core.ErrExists
+	}
+
+	return nil
+}
+
+// lookup returns the entry for key if it exists and has not expired or been
+// invalidated by a "flush_all" command, removing it if it was invalidated. This is
+// used by commands that modify entries and isn't counted as a get. Callers must hold
+// the lock for the key.
+func (c *Cache) lookup(key string) (*Entry, bool) {
+	entry, ok, flushed := c.find(key)
+	if flushed {
+		c.delegate.Delete(key)
+	}
+
+	return entry, ok
+}
+
+// get is lookup for commands that return entries to clients, counting whether the
+// entry was found. Callers must not hold the lock for the key.
+func (c *Cache) get(key string) (*Entry, bool) {
+	entry, ok, flushed := c.find(key)
+	if flushed {
+		c.counters.GetFlushed.Add(1)
+		c.removeFlushed(key, entry)
+	}
+
+	c.countGet(ok)
+	return entry, ok
+}
+
+// getLocked is get for callers that hold the lock for the key.
+func (c *Cache) getLocked(key string) (*Entry, bool) {
+	entry, ok, flushed := c.find(key)
+	if flushed {
+		c.counters.GetFlushed.Add(1)
+		c.delegate.Delete(key)
+	}
+
+	c.countGet(ok)
+	return entry, ok
+}
+
+func (c *Cache) countGet(hit bool) {
+	if hit {
+		c.counters.GetHits.Add(1)
+	} else {
+		c.counters.GetMisses.Add(1)
+	}
+}
+
+// find returns the entry for key if it exists and has not expired or been invalidated
+// by a "flush_all" command. The final return value is true if the entry exists but was
+// invalidated, in which case the entry is returned but the second value is false.
+func (c *Cache) find(key string) (*Entry, bool, bool) {
+	entry, ok := c.delegate.Get(key)
+	if !ok {
+		return nil, false, false
+	}
+
+	if c.collision(key, entry) {
+		return nil, false, false
+	}
+
+	if c.flushed(entry) {
+		return entry, false, true
+	}
+
+	return entry, true, false
+}
+
+// removeFlushed deletes entry, invalidated by a "flush_all" command, if it's still the
+// entry stored for key. Another command may have replaced it since it was read without
+// holding the lock for the key.
+func (c *Cache) removeFlushed(key string, entry *Entry) {
+	mtx := c.lockFor(key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if current, ok := c.delegate.Get(key); ok && current == entry {
+		c.delegate.Delete(key)
+	}
+}
+
+// collision returns true if entry, retrieved for key, is actually the entry for a
+// different key. Backends may identify entries by hashes of the key (ristretto uses a
+// pair of 64-bit hashes) so this is extremely unlikely but we never want to return the
+// wrong value.
+func (c *Cache) collision(key string, entry *Entry) bool {
+	if entry.Key != key {
+		c.counters.Collisions.Add(1)
+		level.Warn(c.logger).Log("msg", "hash collision for cache key", "key", key, "existing", entry.Key)
+		return true
+	}
+
+	return false
+}
+
+// flushed returns true if entry was stored before an immediate "flush_all" command or
+// before a delayed "flush_all" command whose time has passed.
+func (c *Cache) flushed(entry *Entry) bool {
+	if entry.Time <= c.flushedBefore.Load() {
+		return true
+	}
+
+	pending := c.pendingFlush.Load()
+	return pending != 0 && entry.Time <= pending && pending <= time.Now().UnixNano()
+}
+
+// store writes entry to the underlying cache. The entry is visible to other commands,
+// including conditional stores like "add", before this returns. Depending on the backend,
+// the entry may still be rejected afterwards unless read-your-writes mode is enabled. A
+// negative TTL means the entry has already expired so any existing entry is removed
+// instead. Callers must hold the lock for the entry key.
+func (c *Cache) store(entry *Entry, ttl time.Duration) error {
+	if ttl < 0 {
+		c.delegate.Delete(entry.Key)
+		return nil
+	}
+
+	// An entry larger than the entire cache is always rejected by the backend, so the
+	// client gets an error regardless of read-your-writes mode. Any existing entry is
+	// removed rather than being left in place with its old value.
+	if entry.Cost() > c.delegate.MaxCost() {
+		c.delegate.Delete(entry.Key)
+		c.counters.SetsDropped.Add(1)
+		return core.ErrNoMemory
+	}
+
+	if !c.delegate.SetWithTTL(entry, ttl) {
+		return c.dropped()
+	}
+
+	if c.readYourWrites {
+		return c.visible(entry)
+	}
+
+	return nil
+}
+
+// visible waits until entry has been processed by the backend and checks that it was
+// stored rather than rejected. The stored entry must be the same one that was written,
+// not just any entry for the key or an entry for a different key with the same hash.
+func (c *Cache) visible(entry *Entry) error {
+	c.delegate.Wait()
+	if stored, ok := c.delegate.Get(entry.Key); !ok || stored != entry {
+		return c.dropped()
+	}
+
+	return nil
+}
+
+// dropped counts an entry that the backend dropped or rejected, returning an error
+// for the client only in read-your-writes mode. Otherwise, the write is silently lost
+// the same as if it had been evicted.
+func (c *Cache) dropped() error {
+	c.counters.SetsDropped.Add(1)
+	if c.readYourWrites {
+		return core.ErrNoMemory
+	}
+
+	return nil
+}
+
+// remaining returns the TTL left for an entry so that it can be preserved when
+// the entry is replaced by a modified copy. Zero means the entry never expires.
+func (c *Cache) remaining(key string) (time.Duration, bool) {
+	return c.delegate.GetTTL(key)
+}
+
+func (c *Cache) newEntry(key string, flags uint32, value []byte) *Entry {
+	return &Entry{
+		Key:    key,
+		Unique: c.unique(),
+		Flags:  flags,
+		Time:   time.Now().UnixNano(),
+		Value:  value,
+	}
+}
+
 func (c *Cache) unique() uint64 {
 	return c.cas.Add(1)
 }
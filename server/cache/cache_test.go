@@ -0,0 +1,653 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// collidingBackend is a Backend where every key has the same hash. It stores a single
+// entry and returns it for any key, like a backend that identifies entries only by a
+// hash of the key would. Methods not used by these tests are not implemented.
+type collidingBackend struct {
+	Backend
+
+	mtx   sync.Mutex
+	entry *Entry
+}
+
+func (b *collidingBackend) Get(string) (*Entry, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.entry, b.entry != nil
+}
+
+func (b *collidingBackend) GetTTL(string) (time.Duration, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return 0, b.entry != nil
+}
+
+func (b *collidingBackend) SetWithTTL(entry *Entry, _ time.Duration) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.entry = entry
+	return true
+}
+
+func (b *collidingBackend) Wait() {}
+
+func (b *collidingBackend) MaxCost() int64 {
+	return 1024 * 1024
+}
+
+func (b *collidingBackend) Delete(string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.entry = nil
+}
+
+func newCollidingCache() *Cache {
+	return NewFromBacking(&collidingBackend{}, 1024, false, log.NewNopLogger())
+}
+
+func TestCache_Collision(t *testing.T) {
+	c := newCollidingCache()
+	if _, err := c.Set(&proto.SetOp{Key: "a", Bytes: []byte("value-a")}); err != nil {
+		t.Fatalf("unexpected error setting key: %s", err)
+	}
+
+	entries, err := c.Get(&proto.GetOp{Keys: []string{"b"}})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected no entries for colliding key, got %v, %v", entries, err)
+	}
+
+	if err := c.Delete(&proto.DeleteOp{Key: "b"}); err == nil {
+		t.Errorf("expected error deleting colliding key")
+	}
+
+	entries, err = c.Get(&proto.GetOp{Keys: []string{"a"}})
+	if err != nil || len(entries) != 1 || !bytes.Equal(entries[0].Value, []byte("value-a")) {
+		t.Errorf("expected entry to survive delete of colliding key, got %v, %v", entries, err)
+	}
+
+	if collisions := c.Counters().Collisions.Load(); collisions != 2 {
+		t.Errorf("expected 2 collisions, got %d", collisions)
+	}
+}
+
+func TestCache_CollisionConcurrent(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 2000
+	)
+
+	c := newCollidingCache()
+	keys := []string{"a", "b", "c"}
+	value := func(key string, i int) []byte {
+		return []byte(fmt.Sprintf("%s-%d", key, i))
+	}
+
+	// check fails the test if any entry returned for key belongs to a different key
+	check := func(key string, entries []*Entry) {
+		for _, e := range entries {
+			if e.Key != key || !bytes.HasPrefix(e.Value, []byte(key+"-")) {
+				t.Errorf("expected entry for key %s, got entry for key %s with value %s", key, e.Key, e.Value)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < iterations; i++ {
+				key := keys[(w+i)%len(keys)]
+				switch i % 4 {
+				case 0:
+					entry, err := c.Set(&proto.SetOp{Key: key, Bytes: value(key, i)})
+					if err != nil {
+						t.Errorf("unexpected error setting key %s: %s", key, err)
+					} else {
+						check(key, []*Entry{entry})
+					}
+				case 1:
+					entries, err := c.Get(&proto.GetOp{Keys: []string{key}, Unique: true})
+					if err != nil {
+						t.Errorf("unexpected error getting key %s: %s", key, err)
+					}
+
+					check(key, entries)
+				case 2:
+					entries, _ := c.Get(&proto.GetOp{Keys: []string{key}, Unique: true})
+					check(key, entries)
+					if len(entries) == 0 {
+						continue
+					}
+
+					// Errors are expected here since other workers may have modified or
+					// replaced the entry, it only matters that the wrong entry isn't used.
+					entry, err := c.Cas(&proto.CasOp{Key: key, Unique: entries[0].Unique, Bytes: value(key, i)})
+					if err == nil {
+						check(key, []*Entry{entry})
+					}
+				case 3:
+					_ = c.Delete(&proto.DeleteOp{Key: key})
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	if c.Counters().Collisions.Load() == 0 {
+		t.Errorf("expected keys to collide")
+	}
+}
+
+func newTestCache() *Cache {
+	return NewFromBacking(NewLRUBackend(1024*1024), 1024, false, log.NewNopLogger())
+}
+
+// set stores value for key, failing the test if it can't be stored.
+func set(t *testing.T, c *Cache, key string, value string) *Entry {
+	t.Helper()
+
+	entry, err := c.Set(&proto.SetOp{Key: key, Bytes: []byte(value)})
+	if err != nil {
+		t.Fatalf("unexpected error setting key %s: %s", key, err)
+	}
+
+	return entry
+}
+
+// exists returns true if there's an entry for key, without counting as a get.
+func exists(c *Cache, key string) bool {
+	_, ok := c.lookup(key)
+	return ok
+}
+
+func TestCache_FlushAllDelayedAfterImmediate(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "before")
+
+	if err := c.FlushAll(&proto.FlushAllOp{}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	set(t, c, "b", "after")
+	if err := c.FlushAll(&proto.FlushAllOp{Delay: 60}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	// The delayed flush hasn't happened yet and must not undo the immediate one
+	if exists(c, "a") {
+		t.Errorf("expected entry stored before immediate flush to stay flushed")
+	}
+
+	if !exists(c, "b") {
+		t.Errorf("expected entry stored after immediate flush to exist until delayed flush")
+	}
+}
+
+func TestCache_FlushAllReplacesPassedDelayed(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "before")
+
+	// A delayed flush whose time has already passed
+	c.pendingFlush.Store(time.Now().UnixNano())
+	if exists(c, "a") {
+		t.Fatalf("expected entry to be flushed once delayed flush time passed")
+	}
+
+	set(t, c, "a", "before")
+	if err := c.FlushAll(&proto.FlushAllOp{Delay: 60}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	set(t, c, "b", "after")
+	if !exists(c, "a") {
+		t.Errorf("expected entry stored after passed delayed flush to exist")
+	}
+
+	if !exists(c, "b") {
+		t.Errorf("expected entry stored after passed delayed flush to exist")
+	}
+}
+
+func TestCache_FlushAllRemovesOnRead(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "value")
+	set(t, c, "b", "value")
+
+	if err := c.FlushAll(&proto.FlushAllOp{}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	if items := c.Usage().Items; items != 2 {
+		t.Fatalf("expected flushed entries to be stored until read, got %d items", items)
+	}
+
+	entries, err := c.Get(&proto.GetOp{Keys: []string{"a", "b"}})
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no entries after flush, got %v, %v", entries, err)
+	}
+
+	if items := c.Usage().Items; items != 0 {
+		t.Errorf("expected flushed entries to be removed when read, got %d items", items)
+	}
+
+	if flushed := c.Counters().GetFlushed.Load(); flushed != 2 {
+		t.Errorf("expected 2 gets of flushed entries, got %d", flushed)
+	}
+}
+
+func TestCache_SetLargerThanCache(t *testing.T) {
+	c := NewFromBacking(NewLRUBackend(100), 1024, false, log.NewNopLogger())
+	set(t, c, "a", "small")
+
+	_, err := c.Set(&proto.SetOp{Key: "a", Bytes: bytes.Repeat([]byte("x"), 200)})
+	if !errors.Is(err, core.ErrNoMemory) {
+		t.Errorf("expected out of memory error, got %v", err)
+	}
+
+	if exists(c, "a") {
+		t.Errorf("expected existing entry to be removed when replacement is rejected")
+	}
+
+	if dropped := c.Counters().SetsDropped.Load(); dropped != 1 {
+		t.Errorf("expected 1 dropped set, got %d", dropped)
+	}
+}
+
+func TestCache_SetsCounted(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "1")
+
+	// Storage commands count whether or not they store anything
+	_, _ = c.Add(&proto.AddOp{Key: "a", Bytes: []byte("2")})
+	_, _ = c.Append(&proto.AppendOp{Key: "a", Bytes: []byte("0")})
+	_, _ = c.MetaSet(&proto.MetaSetOp{Key: "b", Bytes: []byte("3")})
+
+	// Other commands that replace entries internally don't
+	_, _ = c.Incr(&proto.IncrOp{Key: "a", Delta: 1})
+	_ = c.Touch(&proto.TouchOp{Key: "a", Expire: 60})
+	_, _ = c.MetaArithmetic(&proto.MetaArithmeticOp{Key: "c", Delta: 1, AutoVivify: true})
+
+	if sets := c.Counters().Sets.Load(); sets != 4 {
+		t.Errorf("expected 4 sets, got %d", sets)
+	}
+}
+
+func TestCache_Cas(t *testing.T) {
+	c := newTestCache()
+	if _, err := c.Cas(&proto.CasOp{Key: "a", Unique: 1, Bytes: []byte("new")}); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("expected not found for missing entry, got %v", err)
+	}
+
+	entry := set(t, c, "a", "old")
+	if _, err := c.Cas(&proto.CasOp{Key: "a", Unique: entry.Unique + 1, Bytes: []byte("new")}); !errors.Is(err, core.ErrExists) {
+		t.Errorf("expected exists for CAS mismatch, got %v", err)
+	}
+
+	updated, err := c.Cas(&proto.CasOp{Key: "a", Unique: entry.Unique, Bytes: []byte("new")})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if updated.Unique == entry.Unique || string(updated.Value) != "new" {
+		t.Errorf("expected new value with a new CAS value, got %+v", updated)
+	}
+
+	// The old CAS value can't be used again
+	if _, err := c.Cas(&proto.CasOp{Key: "a", Unique: entry.Unique, Bytes: []byte("again")}); !errors.Is(err, core.ErrExists) {
+		t.Errorf("expected exists for stale CAS value, got %v", err)
+	}
+}
+
+func TestCache_AddReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		store    func(c *Cache) error
+		err      error
+		value    string
+	}{
+		{
+			name: "add missing",
+			store: func(c *Cache) error {
+				_, err := c.Add(&proto.AddOp{Key: "a", Bytes: []byte("new")})
+				return err
+			},
+			value: "new",
+		},
+		{
+			name:     "add existing",
+			existing: "old",
+			store: func(c *Cache) error {
+				_, err := c.Add(&proto.AddOp{Key: "a", Bytes: []byte("new")})
+				return err
+			},
+			err:   core.ErrNotStored,
+			value: "old",
+		},
+		{
+			name: "replace missing",
+			store: func(c *Cache) error {
+				_, err := c.Replace(&proto.ReplaceOp{Key: "a", Bytes: []byte("new")})
+				return err
+			},
+			err: core.ErrNotStored,
+		},
+		{
+			name:     "replace existing",
+			existing: "old",
+			store: func(c *Cache) error {
+				_, err := c.Replace(&proto.ReplaceOp{Key: "a", Bytes: []byte("new")})
+				return err
+			},
+			value: "new",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache()
+			if tc.existing != "" {
+				set(t, c, "a", tc.existing)
+			}
+
+			if err := tc.store(c); !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+
+			entry, ok := c.lookup("a")
+			if tc.value == "" && ok {
+				t.Errorf("expected no entry, got %q", entry.Value)
+			} else if tc.value != "" && (!ok || string(entry.Value) != tc.value) {
+				t.Errorf("expected value %q, got %v", tc.value, entry)
+			}
+		})
+	}
+}
+
+func TestCache_AddFlushed(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "old")
+	if err := c.FlushAll(&proto.FlushAllOp{}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	// Entries invalidated by a flush are missing as far as add is concerned
+	if _, err := c.Add(&proto.AddOp{Key: "a", Bytes: []byte("new")}); err != nil {
+		t.Errorf("expected add of flushed entry to succeed, got %s", err)
+	}
+}
+
+func TestCache_AppendPrepend(t *testing.T) {
+	c := newTestCache()
+	if _, err := c.Append(&proto.AppendOp{Key: "a", Bytes: []byte("new")}); !errors.Is(err, core.ErrNotStored) {
+		t.Errorf("expected not stored for append to missing entry, got %v", err)
+	}
+
+	if _, err := c.Prepend(&proto.PrependOp{Key: "a", Bytes: []byte("new")}); !errors.Is(err, core.ErrNotStored) {
+		t.Errorf("expected not stored for prepend to missing entry, got %v", err)
+	}
+
+	original, err := c.Set(&proto.SetOp{Key: "a", Flags: 5, Expire: 60, Bytes: []byte("b")})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := c.Append(&proto.AppendOp{Key: "a", Flags: 1, Bytes: []byte("c")}); err != nil {
+		t.Fatalf("unexpected error appending: %s", err)
+	}
+
+	entry, err := c.Prepend(&proto.PrependOp{Key: "a", Flags: 1, Bytes: []byte("a")})
+	if err != nil {
+		t.Fatalf("unexpected error prepending: %s", err)
+	}
+
+	// The flags and TTL of the original entry are kept, flags sent by the client are ignored
+	if string(entry.Value) != "abc" || entry.Flags != 5 || entry.Unique == original.Unique {
+		t.Errorf("expected value abc with original flags and a new CAS value, got %+v", entry)
+	}
+
+	if ttl, ok := c.remaining("a"); !ok || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected TTL of at most a minute, got %s", ttl)
+	}
+}
+
+func TestCache_AppendTooLarge(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", strings.Repeat("a", 1000))
+
+	if _, err := c.Append(&proto.AppendOp{Key: "a", Bytes: []byte(strings.Repeat("b", 100))}); !errors.Is(err, core.ErrObjectTooLarge) {
+		t.Errorf("expected object too large, got %v", err)
+	}
+
+	if entry, ok := c.lookup("a"); !ok || len(entry.Value) != 1000 {
+		t.Errorf("expected original entry to be kept, got %v", entry)
+	}
+}
+
+func TestCache_IncrDecr(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		delta    uint64
+		decr     bool
+		expected string
+		err      error
+	}{
+		{name: "incr", existing: "10", delta: 5, expected: "15"},
+		{name: "incr wraps", existing: "18446744073709551615", delta: 2, expected: "1"},
+		{name: "decr", existing: "10", delta: 5, decr: true, expected: "5"},
+		{name: "decr clamps at zero", existing: "10", delta: 11, decr: true, expected: "0"},
+		{name: "decr shrinks value", existing: "100", delta: 91, decr: true, expected: "9"},
+		{name: "non-numeric", existing: "abc", delta: 1, err: core.ErrNonNumeric},
+		{name: "negative", existing: "-1", delta: 1, decr: true, err: core.ErrNonNumeric},
+		{name: "missing", delta: 1, err: core.ErrNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache()
+			if tc.existing != "" {
+				set(t, c, "a", tc.existing)
+			}
+
+			var entry *Entry
+			var err error
+			if tc.decr {
+				entry, err = c.Decr(&proto.DecrOp{Key: "a", Delta: tc.delta})
+			} else {
+				entry, err = c.Incr(&proto.IncrOp{Key: "a", Delta: tc.delta})
+			}
+
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+
+			if err == nil && string(entry.Value) != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, entry.Value)
+			}
+		})
+	}
+}
+
+func TestCache_IncrKeepsTTL(t *testing.T) {
+	c := newTestCache()
+	if _, err := c.Set(&proto.SetOp{Key: "a", Flags: 5, Expire: 60, Bytes: []byte("1")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	entry, err := c.Incr(&proto.IncrOp{Key: "a", Delta: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if entry.Flags != 5 {
+		t.Errorf("expected flags to be kept, got %d", entry.Flags)
+	}
+
+	if ttl, ok := c.remaining("a"); !ok || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected TTL of at most a minute, got %s", ttl)
+	}
+}
+
+func TestCache_Touch(t *testing.T) {
+	c := newTestCache()
+	if err := c.Touch(&proto.TouchOp{Key: "a", Expire: 60}); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("expected not found for missing entry, got %v", err)
+	}
+
+	entry := set(t, c, "a", "value")
+	if err := c.Touch(&proto.TouchOp{Key: "a", Expire: 60}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if ttl, ok := c.remaining("a"); !ok || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected TTL of at most a minute, got %s", ttl)
+	}
+
+	// Touching doesn't change the entry so clients can still use the CAS value they have
+	if e, ok := c.lookup("a"); !ok || e.Unique != entry.Unique {
+		t.Errorf("expected unchanged entry after touch, got %v", e)
+	}
+
+	if err := c.Touch(&proto.TouchOp{Key: "a", Expire: -1}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if exists(c, "a") {
+		t.Errorf("expected entry touched with an expiration in the past to be removed")
+	}
+}
+
+func TestCache_Gat(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "1")
+	set(t, c, "b", "2")
+
+	entries, err := c.Gat(&proto.GatOp{Keys: []string{"a", "missing", "b", "a"}, Expire: 60})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var values []string
+	for _, e := range entries {
+		values = append(values, string(e.Value))
+	}
+
+	if strings.Join(values, ",") != "1,2,1" {
+		t.Errorf("expected entries for all existing keys in order, got %v", values)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if ttl, ok := c.remaining(key); !ok || ttl <= 0 || ttl > time.Minute {
+			t.Errorf("expected TTL of at most a minute for %s, got %s", key, ttl)
+		}
+	}
+}
+
+func TestCache_FlushAll(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "before")
+
+	if err := c.FlushAll(&proto.FlushAllOp{}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	// Entries stored after the flush are unaffected
+	set(t, c, "b", "after")
+	if exists(c, "a") || !exists(c, "b") {
+		t.Errorf("expected only the entry stored before the flush to be invalidated")
+	}
+
+	if flushes := c.Counters().Flushes.Load(); flushes != 1 {
+		t.Errorf("expected 1 flush, got %d", flushes)
+	}
+}
+
+func TestCache_FlushAllDelayed(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "value")
+
+	if err := c.FlushAll(&proto.FlushAllOp{Delay: 60}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	if !exists(c, "a") {
+		t.Fatalf("expected entry to exist until the delayed flush happens")
+	}
+
+	// Move the delayed flush into the past instead of waiting for it
+	c.pendingFlush.Store(time.Now().UnixNano())
+	if exists(c, "a") {
+		t.Errorf("expected entry to be invalidated once the delayed flush time passed")
+	}
+}
+
+// rejectingBackend is an LRU backend that drops every set.
+type rejectingBackend struct {
+	*LRUBackend
+}
+
+func (r *rejectingBackend) SetWithTTL(*Entry, time.Duration) bool {
+	return false
+}
+
+func TestCache_ReadYourWrites(t *testing.T) {
+	backend, err := NewRistrettoBackend(16 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %s", err)
+	}
+
+	c := NewFromBacking(backend, 1024, true, log.NewNopLogger())
+	defer c.Close()
+
+	// Every set is visible to the next get without waiting
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		set(t, c, key, key)
+
+		entries, err := c.Get(&proto.GetOp{Keys: []string{key}})
+		if err != nil || len(entries) != 1 || string(entries[0].Value) != key {
+			t.Fatalf("expected entry for %s right after set, got %v, %v", key, entries, err)
+		}
+	}
+}
+
+func TestCache_ReadYourWritesDropped(t *testing.T) {
+	for _, readYourWrites := range []bool{true, false} {
+		c := NewFromBacking(&rejectingBackend{NewLRUBackend(1024 * 1024)}, 1024, readYourWrites, log.NewNopLogger())
+
+		// Clients are only told about dropped writes in read-your-writes mode
+		_, err := c.Set(&proto.SetOp{Key: "a", Bytes: []byte("value")})
+		if readYourWrites && !errors.Is(err, core.ErrNoMemory) {
+			t.Errorf("expected out of memory error for dropped set, got %v", err)
+		} else if !readYourWrites && err != nil {
+			t.Errorf("expected dropped set to succeed without read-your-writes, got %s", err)
+		}
+
+		if dropped := c.Counters().SetsDropped.Load(); dropped != 1 {
+			t.Errorf("expected 1 dropped set, got %d", dropped)
+		}
+	}
+}
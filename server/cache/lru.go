@@ -0,0 +1,297 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type lruItem struct {
+	entry   *Entry
+	cost    int64
+	expires time.Time
+	index   int // position in the expiration heap, -1 if the item never expires
+}
+
+func (i *lruItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+// expirationHeap orders items with a TTL by expiration time, soonest first.
+type expirationHeap []*lruItem
+
+func (h expirationHeap) Len() int {
+	return len(h)
+}
+
+func (h expirationHeap) Less(i, j int) bool {
+	return h[i].expires.Before(h[j].expires)
+}
+
+func (h expirationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expirationHeap) Push(x any) {
+	item := x.(*lruItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expirationHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// LRUBackend is a Backend that always admits new entries and evicts the least recently
+// used entries to make room for them. Entries are stored synchronously so they are
+// visible to readers as soon as SetWithTTL returns. Expired entries are removed the
+// next time the backend is used.
+type LRUBackend struct {
+	mtx      sync.Mutex
+	items    map[string]*list.Element
+	order    *list.List
+	expiring expirationHeap
+	cost     int64
+	maxCost  int64
+	usage    usageCounter
+	metrics  lruMetrics
+}
+
+func NewLRUBackend(maxCost int64) *LRUBackend {
+	return &LRUBackend{
+		items:   make(map[string]*list.Element),
+		order:   list.New(),
+		maxCost: maxCost,
+	}
+}
+
+func (l *LRUBackend) Get(key string) (*Entry, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.expire(time.Now())
+
+	item, ok := l.live(key)
+	if !ok {
+		return nil, false
+	}
+
+	return item.entry, true
+}
+
+func (l *LRUBackend) GetTTL(key string) (time.Duration, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.expire(time.Now())
+
+	item, ok := l.live(key)
+	if !ok {
+		return 0, false
+	}
+
+	if item.expires.IsZero() {
+		return 0, true
+	}
+
+	return time.Until(item.expires), true
+}
+
+func (l *LRUBackend) SetWithTTL(entry *Entry, ttl time.Duration) bool {
+	// Same as ristretto, a negative TTL means the entry is already expired
+	if ttl < 0 {
+		return false
+	}
+
+	now := time.Now()
+	item := &lruItem{entry: entry, cost: entry.Cost(), index: -1}
+	if ttl > 0 {
+		item.expires = now.Add(ttl)
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.expire(now)
+	if item.cost > l.maxCost {
+		// The existing entry is removed so that a rejected write can't leave a stale
+		// value behind, the same as a write that's accepted and then evicted.
+		if elem, ok := l.items[entry.Key]; ok {
+			l.remove(elem)
+		}
+
+		l.metrics.setsRejected.Add(1)
+		return false
+	}
+
+	if elem, ok := l.items[entry.Key]; ok {
+		// The replaced entry no longer takes up any space but it's not an eviction
+		l.remove(elem)
+		l.metrics.keysUpdated.Add(1)
+	} else {
+		l.metrics.keysAdded.Add(1)
+	}
+
+	l.items[entry.Key] = l.order.PushFront(item)
+	if !item.expires.IsZero() {
+		heap.Push(&l.expiring, item)
+	}
+
+	l.cost += item.cost
+	l.usage.add(entry)
+	l.metrics.costAdded.Add(uint64(item.cost))
+	l.evict()
+	return true
+}
+
+func (l *LRUBackend) Wait() {
+	// Entries are stored synchronously, nothing to wait for
+}
+
+func (l *LRUBackend) Delete(key string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if elem, ok := l.items[key]; ok {
+		l.remove(elem)
+	}
+}
+
+func (l *LRUBackend) Metrics() Metrics {
+	return &l.metrics
+}
+
+func (l *LRUBackend) Usage() Usage {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.expire(time.Now())
+	return l.usage.usage()
+}
+
+func (l *LRUBackend) MaxCost() int64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.maxCost
+}
+
+func (l *LRUBackend) UpdateMaxCost(maxCost int64) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.maxCost = maxCost
+	l.evict()
+}
+
+func (l *LRUBackend) Close() {
+	// No background work to stop
+}
+
+// live returns the item for key if it exists and hasn't expired, marking it as the
+// most recently used. Expired items are removed. Callers must hold the lock.
+func (l *LRUBackend) live(key string) (*lruItem, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := elem.Value.(*lruItem)
+	if item.expired(time.Now()) {
+		l.remove(elem)
+		return nil, false
+	}
+
+	l.order.MoveToFront(elem)
+	return item, true
+}
+
+// expire removes all items that have expired as of now. Callers must hold the lock.
+func (l *LRUBackend) expire(now time.Time) {
+	for len(l.expiring) > 0 && l.expiring[0].expired(now) {
+		l.remove(l.items[l.expiring[0].entry.Key])
+	}
+}
+
+// evict removes the least recently used items until the total cost is at most the
+// max cost. Callers must hold the lock.
+func (l *LRUBackend) evict() {
+	for l.cost > l.maxCost && l.order.Len() > 0 {
+		l.evictElement(l.order.Back())
+	}
+}
+
+// evictElement removes an item to make room for others and counts it as evicted.
+// Callers must hold the lock.
+func (l *LRUBackend) evictElement(elem *list.Element) {
+	item := l.remove(elem)
+	l.metrics.keysEvicted.Add(1)
+	l.metrics.costEvicted.Add(uint64(item.cost))
+}
+
+// remove removes an item without counting it as evicted, used when the item is
+// replaced, deleted, or expired. Callers must hold the lock.
+func (l *LRUBackend) remove(elem *list.Element) *lruItem {
+	item := l.order.Remove(elem).(*lruItem)
+	delete(l.items, item.entry.Key)
+	if item.index >= 0 {
+		heap.Remove(&l.expiring, item.index)
+	}
+
+	l.cost -= item.cost
+	l.usage.remove(item.entry)
+	return item
+}
+
+type lruMetrics struct {
+	keysAdded    atomic.Uint64
+	keysUpdated  atomic.Uint64
+	keysEvicted  atomic.Uint64
+	costAdded    atomic.Uint64
+	costEvicted  atomic.Uint64
+	setsRejected atomic.Uint64
+}
+
+func (m *lruMetrics) GetsDropped() uint64 {
+	// Gets are never dropped, they're all counted
+	return 0
+}
+
+func (m *lruMetrics) KeysAdded() uint64 {
+	return m.keysAdded.Load()
+}
+
+func (m *lruMetrics) KeysUpdated() uint64 {
+	return m.keysUpdated.Load()
+}
+
+func (m *lruMetrics) KeysEvicted() uint64 {
+	return m.keysEvicted.Load()
+}
+
+func (m *lruMetrics) CostAdded() uint64 {
+	return m.costAdded.Load()
+}
+
+func (m *lruMetrics) CostEvicted() uint64 {
+	return m.costEvicted.Load()
+}
+
+func (m *lruMetrics) SetsDropped() uint64 {
+	// Sets are synchronous and never dropped
+	return 0
+}
+
+func (m *lruMetrics) SetsRejected() uint64 {
+	return m.setsRejected.Load()
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLRUBackend_SetLargerThanMaxCost(t *testing.T) {
+	l := NewLRUBackend(100)
+	if !l.SetWithTTL(&Entry{Key: "a", Value: []byte("small")}, 0) {
+		t.Fatalf("expected entry to be stored")
+	}
+
+	if l.SetWithTTL(&Entry{Key: "a", Value: bytes.Repeat([]byte("x"), 200)}, 0) {
+		t.Fatalf("expected entry larger than max cost to be rejected")
+	}
+
+	if _, ok := l.Get("a"); ok {
+		t.Errorf("expected existing entry to be removed")
+	}
+
+	if usage := l.Usage(); usage.Items != 0 || usage.Bytes != 0 {
+		t.Errorf("expected no usage, got %+v", usage)
+	}
+
+	if rejected := l.Metrics().SetsRejected(); rejected != 1 {
+		t.Errorf("expected 1 rejected set, got %d", rejected)
+	}
+}
+
+// lruEntry returns an entry with a cost of 30 for single character keys.
+func lruEntry(key string) *Entry {
+	return &Entry{Key: key, Value: []byte("123456789")}
+}
+
+func TestLRUBackend_EvictsLeastRecentlyUsed(t *testing.T) {
+	// Room for three entries
+	l := NewLRUBackend(100)
+	for _, key := range []string{"a", "b", "c"} {
+		if !l.SetWithTTL(lruEntry(key), 0) {
+			t.Fatalf("expected entry %s to be stored", key)
+		}
+	}
+
+	// Reading "a" makes "b" the least recently used
+	if _, ok := l.Get("a"); !ok {
+		t.Fatalf("expected entry a to exist")
+	}
+
+	l.SetWithTTL(lruEntry("d"), 0)
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := l.Get(key); ok != expected {
+			t.Errorf("expected entry %s to exist: %v", key, expected)
+		}
+	}
+
+	if evicted := l.Metrics().KeysEvicted(); evicted != 1 {
+		t.Errorf("expected 1 eviction, got %d", evicted)
+	}
+
+	if usage := l.Usage(); usage.Items != 3 {
+		t.Errorf("expected 3 items, got %+v", usage)
+	}
+}
+
+func TestLRUBackend_UpdateMaxCost(t *testing.T) {
+	l := NewLRUBackend(100)
+	for _, key := range []string{"a", "b", "c"} {
+		l.SetWithTTL(lruEntry(key), 0)
+	}
+
+	l.UpdateMaxCost(30)
+	if _, ok := l.Get("c"); !ok {
+		t.Errorf("expected most recently used entry to be kept")
+	}
+
+	if usage := l.Usage(); usage.Items != 1 {
+		t.Errorf("expected 1 item after shrinking, got %+v", usage)
+	}
+}
+
+func TestLRUBackend_Replace(t *testing.T) {
+	l := NewLRUBackend(100)
+	l.SetWithTTL(lruEntry("a"), 0)
+	l.SetWithTTL(&Entry{Key: "a", Value: []byte("new")}, 0)
+
+	if e, ok := l.Get("a"); !ok || string(e.Value) != "new" {
+		t.Errorf("expected replaced entry, got %v", e)
+	}
+
+	m := l.Metrics()
+	if m.KeysAdded() != 1 || m.KeysUpdated() != 1 || m.KeysEvicted() != 0 {
+		t.Errorf("expected 1 added and 1 updated key without evictions, got %d, %d, %d", m.KeysAdded(), m.KeysUpdated(), m.KeysEvicted())
+	}
+
+	if usage := l.Usage(); usage.Items != 1 || usage.Bytes != 24 {
+		t.Errorf("expected usage of only the new entry, got %+v", usage)
+	}
+}
+
+func TestLRUBackend_TTL(t *testing.T) {
+	l := NewLRUBackend(1000)
+	if l.SetWithTTL(lruEntry("expired"), -time.Second) {
+		t.Errorf("expected entry with negative TTL to be rejected")
+	}
+
+	l.SetWithTTL(lruEntry("forever"), 0)
+	l.SetWithTTL(lruEntry("short"), 20*time.Millisecond)
+	l.SetWithTTL(lruEntry("long"), time.Hour)
+
+	if ttl, ok := l.GetTTL("forever"); !ok || ttl != 0 {
+		t.Errorf("expected no TTL for entry that never expires, got %s, %v", ttl, ok)
+	}
+
+	if ttl, ok := l.GetTTL("long"); !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("expected TTL of about an hour, got %s, %v", ttl, ok)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := l.Get("short"); ok {
+		t.Errorf("expected entry to expire")
+	}
+
+	if _, ok := l.GetTTL("short"); ok {
+		t.Errorf("expected no TTL for expired entry")
+	}
+
+	// Expired entries don't count towards usage and aren't evictions
+	if usage := l.Usage(); usage.Items != 2 {
+		t.Errorf("expected 2 items, got %+v", usage)
+	}
+
+	if evicted := l.Metrics().KeysEvicted(); evicted != 0 {
+		t.Errorf("expected no evictions, got %d", evicted)
+	}
+}
@@ -0,0 +1,314 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// MetaResult is the outcome of a meta command, encoded based on the return flags
+// that the client requested as part of the command.
+type MetaResult struct {
+	Status proto.MetaStatus
+	Key    string
+	Entry  *Entry
+	TTL    int64
+	Flags  proto.MetaFlags
+	Quiet  bool
+
+	// Win is true if the client should populate the entry and Won is true if another
+	// client has already been told to.
+	Win bool
+	Won bool
+}
+
+func (r *MetaResult) MarshallMemcached(o *proto.Encoder) {
+	if r.Quiet {
+		return
+	}
+
+	flags := make([]string, 0, 8)
+	if r.Entry != nil {
+		if r.Flags.ReturnCas {
+			flags = append(flags, fmt.Sprintf("c%d", r.Entry.Unique))
+		}
+
+		if r.Flags.ReturnFlags {
+			flags = append(flags, fmt.Sprintf("f%d", r.Entry.Flags))
+		}
+
+		if r.Flags.ReturnSize {
+			flags = append(flags, fmt.Sprintf("s%d", len(r.Entry.Value)))
+		}
+
+		if r.Flags.ReturnTTL {
+			flags = append(flags, fmt.Sprintf("t%d", r.TTL))
+		}
+	}
+
+	if r.Flags.ReturnKey {
+		flags = append(flags, "k"+r.Flags.EncodeKey(r.Key))
+		if r.Flags.Base64 {
+			flags = append(flags, "b")
+		}
+	}
+
+	if r.Flags.Opaque != "" {
+		flags = append(flags, "O"+r.Flags.Opaque)
+	}
+
+	if r.Win {
+		flags = append(flags, "W")
+	} else if r.Won {
+		flags = append(flags, "Z")
+	}
+
+	if r.Status == proto.MetaStatusValue {
+		o.Meta(r.Status, append([]string{strconv.Itoa(len(r.Entry.Value))}, flags...)...)
+		o.Bytes(r.Entry.Value)
+	} else {
+		o.Meta(r.Status, flags...)
+	}
+}
+
+// MetaDebugEntry is the human-readable description of an entry emitted in
+// response to a meta debug command.
+type MetaDebugEntry struct {
+	*Entry
+	EncodedKey string
+	TTL        int64
+}
+
+func (e *MetaDebugEntry) MarshallMemcached(o *proto.Encoder) {
+	o.Meta(
+		proto.MetaStatusDebug,
+		e.EncodedKey,
+		fmt.Sprintf("exp=%d", e.TTL),
+		fmt.Sprintf("cas=%d", e.Unique),
+		fmt.Sprintf("size=%d", len(e.Value)),
+	)
+}
+
+func (c *Cache) MetaArithmetic(op *proto.MetaArithmeticOp) (*MetaResult, error) {
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	decr := op.Mode == proto.MetaArithmeticDecr
+	existing, ok := c.lookup(op.Key)
+	if ok && op.CompareCas != 0 && existing.Unique != op.CompareCas {
+		return &MetaResult{Status: proto.MetaStatusExists, Key: op.Key, Flags: op.MetaFlags}, nil
+	}
+
+	var ttl time.Duration
+	if ok && op.UpdateExpire {
+		ttl = c.ttl(op.Expire)
+	} else if ok {
+		// Entry may have expired between reading the value and reading the TTL
+		ttl, ok = c.remaining(op.Key)
+	}
+
+	if !ok {
+		c.counters.arithmetic(decr, false)
+		if !op.AutoVivify {
+			return &MetaResult{Status: proto.MetaStatusNotFound, Key: op.Key, Flags: op.MetaFlags, Quiet: op.Quiet}, nil
+		}
+
+		ttl = c.ttl(op.VivifyExpire)
+		entry := c.newEntry(op.Key, 0, []byte(strconv.FormatUint(op.Initial, 10)))
+		if err := c.store(entry, ttl); err != nil {
+			return nil, err
+		}
+
+		return c.metaArithmeticResult(op, entry, ttl), nil
+	}
+
+	entry, err := c.arithmetic(existing, op.Delta, decr, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.metaArithmeticResult(op, entry, ttl), nil
+}
+
+func (c *Cache) metaArithmeticResult(op *proto.MetaArithmeticOp, entry *Entry, ttl time.Duration) *MetaResult {
+	res := &MetaResult{
+		Status: proto.MetaStatusHeader,
+		Key:    op.Key,
+		Entry:  entry,
+		TTL:    ttlSeconds(ttl),
+		Flags:  op.MetaFlags,
+		Quiet:  op.Quiet,
+	}
+
+	if op.ReturnValue {
+		res.Status = proto.MetaStatusValue
+		res.Quiet = false
+	}
+
+	return res
+}
+
+func (c *Cache) MetaDebug(op *proto.MetaDebugOp) (*MetaDebugEntry, bool) {
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	entry, ok := c.lookup(op.Key)
+	if !ok {
+		return nil, false
+	}
+
+	ttl, _ := c.remaining(op.Key)
+	return &MetaDebugEntry{
+		Entry:      entry,
+		EncodedKey: op.EncodeKey(op.Key),
+		TTL:        ttlSeconds(ttl),
+	}, true
+}
+
+func (c *Cache) MetaDelete(op *proto.MetaDeleteOp) (*MetaResult, error) {
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if op.CompareCas != 0 {
+		if status, ok := c.metaCompare(op.Key, op.CompareCas); !ok {
+			return &MetaResult{Status: status, Key: op.Key, Flags: op.MetaFlags, Quiet: op.Quiet && status == proto.MetaStatusNotFound}, nil
+		}
+	} else if _, ok := c.lookup(op.Key); !ok {
+		return &MetaResult{Status: proto.MetaStatusNotFound, Key: op.Key, Flags: op.MetaFlags, Quiet: op.Quiet}, nil
+	}
+
+	c.delegate.Delete(op.Key)
+	return &MetaResult{Status: proto.MetaStatusHeader, Key: op.Key, Flags: op.MetaFlags, Quiet: op.Quiet}, nil
+}
+
+func (c *Cache) MetaGet(op *proto.MetaGetOp) (*MetaResult, error) {
+	// Plain gets don't need the lock for the key, only gets that may store an entry
+	var entry *Entry
+	var ok bool
+	if op.AutoVivify || op.UpdateExpire {
+		mtx := c.lockFor(op.Key)
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		entry, ok = c.getLocked(op.Key)
+	} else {
+		entry, ok = c.get(op.Key)
+	}
+
+	res := &MetaResult{
+		Status: proto.MetaStatusHeader,
+		Key:    op.Key,
+		Entry:  entry,
+		Flags:  op.MetaFlags,
+	}
+
+	if !ok && !op.AutoVivify {
+		return &MetaResult{Status: proto.MetaStatusMiss, Key: op.Key, Flags: op.MetaFlags, Quiet: op.Quiet}, nil
+	} else if !ok {
+		// The client that creates the empty entry is the only one told to populate it
+		entry = c.newEntry(op.Key, 0, []byte{})
+		entry.winSent.Store(true)
+		if err := c.store(entry, c.ttl(op.VivifyExpire)); err != nil {
+			return nil, err
+		}
+
+		res.Entry = entry
+		res.Win = true
+	} else if op.UpdateExpire {
+		c.counters.Touches.Add(1)
+		c.counters.TouchHits.Add(1)
+		if ttl := c.ttl(op.Expire); ttl < 0 {
+			c.delegate.Delete(op.Key)
+		} else {
+			// Same as touch, a dropped TTL update leaves the entry unchanged
+			_ = c.store(entry, ttl)
+		}
+	}
+
+	var ttl time.Duration
+	if op.ReturnTTL || op.Recache {
+		ttl, _ = c.remaining(op.Key)
+	}
+
+	if !res.Win {
+		// Only one client is told to populate an entry that's about to expire
+		expiring := op.Recache && ttl > 0 && ttl < time.Duration(op.RecacheTTL)*time.Second
+		res.Win = expiring && entry.winSent.CompareAndSwap(false, true)
+		res.Won = !res.Win && entry.winSent.Load()
+	}
+
+	if op.ReturnValue {
+		res.Status = proto.MetaStatusValue
+	}
+
+	if op.ReturnTTL {
+		res.TTL = ttlSeconds(ttl)
+	}
+
+	return res, nil
+}
+
+func (c *Cache) MetaSet(op *proto.MetaSetOp) (*MetaResult, error) {
+	c.counters.Sets.Add(1)
+	mtx := c.lockFor(op.Key)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if op.CompareCas != 0 {
+		if status, ok := c.metaCompare(op.Key, op.CompareCas); !ok {
+			return &MetaResult{Status: status, Key: op.Key, Flags: op.MetaFlags}, nil
+		}
+	}
+
+	if op.Mode == proto.MetaSetModeAppend || op.Mode == proto.MetaSetModePrepend {
+		entry, err := c.concat(op.Key, op.Bytes, op.Mode == proto.MetaSetModePrepend)
+		if errors.Is(err, core.ErrNotStored) {
+			return &MetaResult{Status: proto.MetaStatusNotStored, Key: op.Key, Flags: op.MetaFlags}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &MetaResult{Status: proto.MetaStatusHeader, Key: op.Key, Entry: entry, Flags: op.MetaFlags, Quiet: op.Quiet}, nil
+	}
+
+	_, exists := c.lookup(op.Key)
+	if (op.Mode == proto.MetaSetModeAdd && exists) || (op.Mode == proto.MetaSetModeReplace && !exists) {
+		return &MetaResult{Status: proto.MetaStatusNotStored, Key: op.Key, Flags: op.MetaFlags}, nil
+	}
+
+	entry := c.newEntry(op.Key, op.Flags, op.Bytes)
+	if err := c.store(entry, c.ttl(op.Expire)); err != nil {
+		return nil, err
+	}
+
+	return &MetaResult{Status: proto.MetaStatusHeader, Key: op.Key, Entry: entry, Flags: op.MetaFlags, Quiet: op.Quiet}, nil
+}
+
+// metaCompare is like compare but returns the meta status for a failed comparison.
+func (c *Cache) metaCompare(key string, unique uint64) (proto.MetaStatus, bool) {
+	err := c.compare(key, unique)
+	if errors.Is(err, core.ErrNotFound) {
+		return proto.MetaStatusNotFound, false
+	} else if errors.Is(err, core.ErrExists) {
+		return proto.MetaStatusExists, false
+	}
+
+	return proto.MetaStatusHeader, true
+}
+
+// ttlSeconds converts a TTL to the number of seconds reported to meta clients
+// where -1 means the entry never expires.
+func ttlSeconds(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return -1
+	}
+
+	return int64((ttl + time.Second - 1) / time.Second)
+}
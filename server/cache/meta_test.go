@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// encode returns a meta result as it's sent to clients.
+func encode(res *MetaResult) string {
+	var buf bytes.Buffer
+	proto.NewEncoder(&buf).Encode(res)
+	return buf.String()
+}
+
+func TestCache_MetaGetTouch(t *testing.T) {
+	c := newTestCache()
+	set(t, c, "a", "value")
+
+	res, err := c.MetaGet(&proto.MetaGetOp{Key: "a", UpdateExpire: true, Expire: 60, MetaFlags: proto.MetaFlags{ReturnTTL: true}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "HD t60\r\n" {
+		t.Errorf("expected touched entry, got %q", out)
+	}
+
+	if ttl, ok := c.remaining("a"); !ok || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected TTL of at most a minute, got %s", ttl)
+	}
+}
+
+func TestCache_MetaGetAutoVivify(t *testing.T) {
+	c := newTestCache()
+	op := &proto.MetaGetOp{Key: "a", AutoVivify: true, VivifyExpire: 30, MetaFlags: proto.MetaFlags{ReturnValue: true}}
+
+	// The first client to miss creates the entry and is told to populate it
+	res, err := c.MetaGet(op)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "VA 0 W\r\n\r\n" {
+		t.Errorf("expected empty entry with win flag, got %q", out)
+	}
+
+	// Everyone else is told that another client is populating it
+	res, err = c.MetaGet(op)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "VA 0 Z\r\n\r\n" {
+		t.Errorf("expected empty entry with already won flag, got %q", out)
+	}
+
+	// Until it's populated
+	set(t, c, "a", "value")
+	res, err = c.MetaGet(op)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "VA 5\r\nvalue\r\n" {
+		t.Errorf("expected populated entry, got %q", out)
+	}
+}
+
+func TestCache_MetaGetRecache(t *testing.T) {
+	c := newTestCache()
+	if _, err := c.Set(&proto.SetOp{Key: "a", Expire: 5, Bytes: []byte("value")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The TTL isn't below the recache threshold
+	res, err := c.MetaGet(&proto.MetaGetOp{Key: "a", Recache: true, RecacheTTL: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "HD\r\n" {
+		t.Errorf("expected no win flag, got %q", out)
+	}
+
+	op := &proto.MetaGetOp{Key: "a", Recache: true, RecacheTTL: 30}
+	for i, expected := range []string{"HD W\r\n", "HD Z\r\n", "HD Z\r\n"} {
+		res, err := c.MetaGet(op)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if out := encode(res); out != expected {
+			t.Errorf("expected %q for get %d, got %q", expected, i, out)
+		}
+	}
+}
+
+func TestCache_MetaGetQuietMiss(t *testing.T) {
+	c := newTestCache()
+	res, err := c.MetaGet(&proto.MetaGetOp{Key: "missing", MetaFlags: proto.MetaFlags{Quiet: true, ReturnValue: true}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "" {
+		t.Errorf("expected no output for quiet miss, got %q", out)
+	}
+}
+
+func TestCache_MetaArithmeticQuiet(t *testing.T) {
+	c := newTestCache()
+	quiet := proto.MetaFlags{Quiet: true}
+
+	res, err := c.MetaArithmetic(&proto.MetaArithmeticOp{Key: "a", Delta: 1, MetaFlags: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "" {
+		t.Errorf("expected no output for quiet not found, got %q", out)
+	}
+
+	set(t, c, "a", "1")
+	res, err = c.MetaArithmetic(&proto.MetaArithmeticOp{Key: "a", Delta: 1, MetaFlags: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "" {
+		t.Errorf("expected no output for quiet success, got %q", out)
+	}
+
+	// Values are always returned
+	quiet.ReturnValue = true
+	res, err = c.MetaArithmetic(&proto.MetaArithmeticOp{Key: "a", Delta: 1, MetaFlags: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "VA 1\r\n3\r\n" {
+		t.Errorf("expected value, got %q", out)
+	}
+}
+
+func TestCache_MetaSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		op       *proto.MetaSetOp
+		expected string
+		value    string
+	}{
+		{
+			name:     "set",
+			op:       &proto.MetaSetOp{Key: "a", Bytes: []byte("new")},
+			expected: "HD\r\n",
+			value:    "new",
+		},
+		{
+			name:     "add existing",
+			existing: "old",
+			op:       &proto.MetaSetOp{Key: "a", Mode: proto.MetaSetModeAdd, Bytes: []byte("new")},
+			expected: "NS\r\n",
+			value:    "old",
+		},
+		{
+			name:     "replace missing",
+			op:       &proto.MetaSetOp{Key: "a", Mode: proto.MetaSetModeReplace, Bytes: []byte("new")},
+			expected: "NS\r\n",
+		},
+		{
+			name:     "append missing",
+			op:       &proto.MetaSetOp{Key: "a", Mode: proto.MetaSetModeAppend, Bytes: []byte("new")},
+			expected: "NS\r\n",
+		},
+		{
+			name:     "prepend existing",
+			existing: "old",
+			op:       &proto.MetaSetOp{Key: "a", Mode: proto.MetaSetModePrepend, Bytes: []byte("new")},
+			expected: "HD\r\n",
+			value:    "newold",
+		},
+		{
+			name:     "compare cas mismatch",
+			existing: "old",
+			op:       &proto.MetaSetOp{Key: "a", CompareCas: 1000, Bytes: []byte("new")},
+			expected: "EX\r\n",
+			value:    "old",
+		},
+		{
+			name:     "compare cas missing",
+			op:       &proto.MetaSetOp{Key: "a", CompareCas: 1000, Bytes: []byte("new")},
+			expected: "NF\r\n",
+		},
+		{
+			name:     "quiet success",
+			op:       &proto.MetaSetOp{Key: "a", Bytes: []byte("new"), MetaFlags: proto.MetaFlags{Quiet: true}},
+			expected: "",
+			value:    "new",
+		},
+		{
+			name:     "quiet failure",
+			existing: "old",
+			op:       &proto.MetaSetOp{Key: "a", Mode: proto.MetaSetModeAdd, Bytes: []byte("new"), MetaFlags: proto.MetaFlags{Quiet: true}},
+			expected: "NS\r\n",
+			value:    "old",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache()
+			if tc.existing != "" {
+				set(t, c, "a", tc.existing)
+			}
+
+			res, err := c.MetaSet(tc.op)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if out := encode(res); out != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, out)
+			}
+
+			entry, ok := c.lookup("a")
+			if tc.value == "" && ok {
+				t.Errorf("expected no entry, got %q", entry.Value)
+			} else if tc.value != "" && (!ok || string(entry.Value) != tc.value) {
+				t.Errorf("expected value %q, got %v", tc.value, entry)
+			}
+		})
+	}
+}
+
+func TestCache_MetaSetCompareCas(t *testing.T) {
+	c := newTestCache()
+	entry := set(t, c, "a", "old")
+
+	res, err := c.MetaSet(&proto.MetaSetOp{Key: "a", CompareCas: entry.Unique, Bytes: []byte("new"), MetaFlags: proto.MetaFlags{ReturnCas: true}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := fmt.Sprintf("HD c%d\r\n", res.Entry.Unique)
+	if out := encode(res); out != expected || res.Entry.Unique == entry.Unique {
+		t.Errorf("expected %q with a new CAS value, got %q", expected, out)
+	}
+}
+
+func TestCache_MetaDelete(t *testing.T) {
+	c := newTestCache()
+	res, err := c.MetaDelete(&proto.MetaDeleteOp{Key: "a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "NF\r\n" {
+		t.Errorf("expected not found, got %q", out)
+	}
+
+	entry := set(t, c, "a", "value")
+	res, err = c.MetaDelete(&proto.MetaDeleteOp{Key: "a", CompareCas: entry.Unique + 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "EX\r\n" || !exists(c, "a") {
+		t.Errorf("expected exists and entry to be kept, got %q", out)
+	}
+
+	res, err = c.MetaDelete(&proto.MetaDeleteOp{Key: "a", CompareCas: entry.Unique, MetaFlags: proto.MetaFlags{ReturnKey: true}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "HD ka\r\n" || exists(c, "a") {
+		t.Errorf("expected entry to be deleted, got %q", out)
+	}
+}
+
+func TestCache_MetaArithmetic(t *testing.T) {
+	c := newTestCache()
+	ret := proto.MetaFlags{ReturnValue: true}
+
+	res, err := c.MetaArithmetic(&proto.MetaArithmeticOp{Key: "a", Delta: 1, AutoVivify: true, Initial: 10, MetaFlags: ret})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "VA 2\r\n10\r\n" {
+		t.Errorf("expected initial value, got %q", out)
+	}
+
+	res, err = c.MetaArithmetic(&proto.MetaArithmeticOp{Key: "a", Delta: 15, Mode: proto.MetaArithmeticDecr, MetaFlags: ret})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "VA 1\r\n0\r\n" {
+		t.Errorf("expected decrement clamped at zero, got %q", out)
+	}
+
+	res, err = c.MetaArithmetic(&proto.MetaArithmeticOp{Key: "a", Delta: 1, CompareCas: res.Entry.Unique + 1, MetaFlags: ret})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out := encode(res); out != "EX\r\n" {
+		t.Errorf("expected exists for CAS mismatch, got %q", out)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/56quarters/jankcache/server/core"
+)
+
+// connState is what a client connection is currently doing.
+type connState int32
+
+const (
+	connStateReading   connState = iota // waiting for the next command
+	connStateParsing                    // reading and parsing a command
+	connStateExecuting                  // running a command
+	connStateWriting                    // writing the response to a command
+	connStateHandshake                  // performing the TLS handshake
+)
+
+func (s connState) String() string {
+	switch s {
+	case connStateReading:
+		return "reading"
+	case connStateParsing:
+		return "parsing"
+	case connStateExecuting:
+		return "executing"
+	case connStateWriting:
+		return "writing"
+	case connStateHandshake:
+		return "handshake"
+	}
+
+	return fmt.Sprintf("connState(%d)", int32(s))
+}
+
+// Connections is a registry of open client connections.
+type Connections struct {
+	mtx   sync.Mutex
+	next  uint64
+	conns map[uint64]*bufferedConnection
+}
+
+func NewConnections() *Connections {
+	return &Connections{
+		conns: make(map[uint64]*bufferedConnection),
+	}
+}
+
+// add registers a connection, assigning it an ID.
+func (c *Connections) add(conn *bufferedConnection) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.next++
+	conn.id = c.next
+	c.conns[conn.id] = conn
+}
+
+// remove unregisters a connection once it has been closed.
+func (c *Connections) remove(conn *bufferedConnection) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	delete(c.conns, conn.id)
+}
+
+// Close closes the connection with the given ID. The command being run by the connection,
+// if any, is interrupted. core.ErrNotFound is returned if there is no open connection with
+// the ID.
+func (c *Connections) Close(id uint64) error {
+	c.mtx.Lock()
+	conn, ok := c.conns[id]
+	c.mtx.Unlock()
+
+	if !ok || conn.conn == nil {
+		return core.ErrNotFound
+	}
+
+	return conn.conn.Close()
+}
+
+// all returns every open connection ordered by ID.
+func (c *Connections) all() []*bufferedConnection {
+	c.mtx.Lock()
+	conns := make([]*bufferedConnection, 0, len(c.conns))
+	for _, conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.mtx.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].id < conns[j].id
+	})
+
+	return conns
+}
+
+// ConnectionInfo is the current state of a single open connection.
+type ConnectionInfo struct {
+	ID           uint64            `json:"id"`
+	Remote       string            `json:"remote"`
+	Connected    time.Time         `json:"connected"`
+	LastCommand  *time.Time        `json:"last_command,omitempty"`
+	State        string            `json:"state"`
+	BytesRead    uint64            `json:"bytes_read"`
+	BytesWritten uint64            `json:"bytes_written"`
+	Commands     map[string]uint64 `json:"commands"`
+}
+
+// Info returns the current state of each open connection ordered by ID.
+func (c *Connections) Info() []ConnectionInfo {
+	conns := c.all()
+	infos := make([]ConnectionInfo, 0, len(conns))
+
+	for _, conn := range conns {
+		info := ConnectionInfo{
+			ID:           conn.id,
+			Remote:       "unknown",
+			Connected:    conn.connected,
+			State:        connState(conn.state.Load()).String(),
+			BytesRead:    conn.bytesRead.Load(),
+			BytesWritten: conn.bytesWritten.Load(),
+			Commands:     make(map[string]uint64),
+		}
+
+		if conn.remote != nil {
+			info.Remote = conn.remote.Network() + ":" + conn.remote.String()
+		}
+
+		if last := conn.lastCommand.Load(); last != 0 {
+			t := time.Unix(0, last)
+			info.LastCommand = &t
+		}
+
+		for t, n := range conn.commandCounts() {
+			info.Commands[t.String()] = n
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// Values returns the state of each open connection as of now, emitted as part of a
+// Memcached `stats conns` command.
+func (c *Connections) Values(now time.Time) []StatValue {
+	var values []StatValue
+	for _, info := range c.Info() {
+		prefix := fmt.Sprintf("%d:", info.ID)
+
+		// Same as memcached, connections that haven't run any commands yet have been
+		// idle since they connected.
+		last := info.Connected
+		if info.LastCommand != nil {
+			last = *info.LastCommand
+		}
+
+		values = append(values,
+			StatValue{Name: prefix + "addr", Value: info.Remote},
+			StatValue{Name: prefix + "state", Value: info.State},
+			StatValue{Name: prefix + "secs_since_connect", Value: fmt.Sprint(uint64(now.Sub(info.Connected).Seconds()))},
+			StatValue{Name: prefix + "secs_since_last_cmd", Value: fmt.Sprint(uint64(now.Sub(last).Seconds()))},
+			StatValue{Name: prefix + "bytes_read", Value: fmt.Sprint(info.BytesRead)},
+			StatValue{Name: prefix + "bytes_written", Value: fmt.Sprint(info.BytesWritten)},
+		)
+
+		commands := make([]string, 0, len(info.Commands))
+		for name := range info.Commands {
+			commands = append(commands, name)
+		}
+
+		sort.Strings(commands)
+		for _, name := range commands {
+			values = append(values, StatValue{Name: prefix + "cmd_" + name, Value: fmt.Sprint(info.Commands[name])})
+		}
+	}
+
+	return values
+}
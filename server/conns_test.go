@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// newTestConnection returns a connection to register with Connections along with
+// the client end of it.
+func newTestConnection(t *testing.T) (*bufferedConnection, net.Conn) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	buffered := newBufferedConnection(serverConn, NewMetrics())
+	t.Cleanup(func() { _ = buffered.Close() })
+	return buffered, clientConn
+}
+
+// handleTestConnection handles commands from a new client connection to s until the
+// server closes it, the same way as connections accepted by the server. The returned
+// channel is closed once it has been.
+func handleTestConnection(t *testing.T, s *TCPServer) (net.Conn, <-chan struct{}) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { _ = clientConn.Close() })
+
+	done := make(chan struct{})
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+		s.handle(serverConn)
+		close(done)
+	}()
+
+	return clientConn, done
+}
+
+func TestConnections_Info(t *testing.T) {
+	conns := NewConnections()
+	first, _ := newTestConnection(t)
+	second, _ := newTestConnection(t)
+	conns.add(first)
+	conns.add(second)
+
+	second.setState(connStateExecuting)
+	second.countCommand(proto.OpTypeGet)
+	second.countCommand(proto.OpTypeGet)
+	second.countCommand(proto.OpTypeSet)
+	second.lastCommand.Store(time.Now().UnixNano())
+
+	infos := conns.Info()
+	if len(infos) != 2 || infos[0].ID != 1 || infos[1].ID != 2 {
+		t.Fatalf("expected connections ordered by ID, got %+v", infos)
+	}
+
+	if infos[0].State != "reading" || infos[0].LastCommand != nil || len(infos[0].Commands) != 0 {
+		t.Errorf("expected idle connection without commands, got %+v", infos[0])
+	}
+
+	if infos[1].Remote != "pipe:pipe" || infos[1].State != "executing" || infos[1].LastCommand == nil {
+		t.Errorf("expected executing connection, got %+v", infos[1])
+	}
+
+	if infos[1].Commands["get"] != 2 || infos[1].Commands["set"] != 1 {
+		t.Errorf("expected command counts by command, got %v", infos[1].Commands)
+	}
+
+	conns.remove(first)
+	if infos := conns.Info(); len(infos) != 1 || infos[0].ID != 2 {
+		t.Errorf("expected removed connection not to be included, got %+v", infos)
+	}
+}
+
+func TestConnections_Values(t *testing.T) {
+	conns := NewConnections()
+	conn, _ := newTestConnection(t)
+	conns.add(conn)
+	conn.countCommand(proto.OpTypeGet)
+
+	// Connections that haven't run a command have been idle since they connected
+	values := statValues(conns.Values(conn.connected.Add(90 * time.Second)))
+	expected := map[string]string{
+		"1:addr":                "pipe:pipe",
+		"1:state":               "reading",
+		"1:secs_since_connect":  "90",
+		"1:secs_since_last_cmd": "90",
+		"1:cmd_get":             "1",
+	}
+
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, values[name])
+		}
+	}
+
+	conn.lastCommand.Store(conn.connected.Add(60 * time.Second).UnixNano())
+	values = statValues(conns.Values(conn.connected.Add(90 * time.Second)))
+	if idle := values["1:secs_since_last_cmd"]; idle != "30" {
+		t.Errorf("expected 30 seconds since the last command, got %q", idle)
+	}
+}
+
+func TestConnections_Close(t *testing.T) {
+	s := newTestTCPServer(TCPConfig{MaxLineSize: 2048})
+	client, done := handleTestConnection(t, s)
+	waitActive(t, s, 1)
+
+	if err := s.conns.Close(2); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("expected not found closing unknown connection, got %v", err)
+	}
+
+	if err := s.conns.Close(1); err != nil {
+		t.Fatalf("unexpected error closing connection: %s", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection wasn't closed")
+	}
+
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected client to see the connection closed, got %v", err)
+	}
+}
+
+func TestHandler_CloseConn(t *testing.T) {
+	s := newTestTCPServer(TCPConfig{MaxLineSize: 2048})
+	s.handler.settings.ShutdownCommand = true
+	_, done := handleTestConnection(t, s)
+	waitActive(t, s, 1)
+	client, _ := handleTestConnection(t, s)
+	waitActive(t, s, 2)
+
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{line: "close_conn 99\r\n", expected: "NOT_FOUND\r\n"},
+		{line: "close_conn 1\r\n", expected: "OK\r\n"},
+	}
+
+	for _, tc := range tests {
+		go func(line string) {
+			_, _ = client.Write([]byte(line))
+		}(tc.line)
+
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != tc.expected {
+			t.Errorf("expected %q for %q, got %q, %v", tc.expected, tc.line, buf[:n], err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection wasn't closed by close_conn")
+	}
+}
+
+func TestHandler_CloseConnDisabled(t *testing.T) {
+	h := newTestHandler()
+	out := serve(t, h, &chunkedConn{chunks: []string{"close_conn 1\r\n"}})
+	if out != "CLIENT_ERROR close_conn not enabled\r\n" {
+		t.Errorf("expected close_conn to be rejected, got %q", out)
+	}
+}
+
+func TestDebugServer_Connections(t *testing.T) {
+	conns := NewConnections()
+	conn, _ := newTestConnection(t)
+	conns.add(conn)
+	conn.countCommand(proto.OpTypeGet)
+
+	s := NewDebugServer(DebugConfig{}, nil, conns, log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/conns", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+
+	var infos []ConnectionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&infos); err != nil {
+		t.Fatalf("unexpected error decoding connections: %s", err)
+	}
+
+	if len(infos) != 1 || infos[0].ID != 1 || infos[0].Remote != "pipe:pipe" || infos[0].Commands["get"] != 1 {
+		t.Errorf("expected the open connection, got %+v", infos)
+	}
+}
@@ -8,11 +8,20 @@ import (
 var (
 	ErrBadCommand = errors.New("ERROR")
 	ErrClient     = errors.New("CLIENT_ERROR")
+	ErrExists     = errors.New("EXISTS")
 	ErrNotFound   = errors.New("NOT_FOUND")
+	ErrNotStored  = errors.New("NOT_STORED")
 	ErrServer     = errors.New("SERVER_ERROR")
 	ErrQuit       = errors.New("quit")
 
 	ErrObjectTooLarge = ServerError("object too large for cache")
+	ErrNoMemory       = ServerError("out of memory storing object")
+	ErrLineTooLong    = ClientError("line too long")
+	ErrNonNumeric     = ClientError("cannot increment or decrement non-numeric value")
+
+	ErrAuthFailed       = ClientError("authentication failure")
+	ErrPermissionDenied = ClientError("permission denied")
+	ErrUnauthenticated  = ClientError("unauthenticated")
 )
 
 func ClientError(msg string, args ...any) error {
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,6 +13,8 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type DebugConfig struct {
@@ -20,7 +23,7 @@ type DebugConfig struct {
 }
 
 func (c *DebugConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
-	fs.BoolVar(&c.Enabled, prefix+"enabled", false, "Enable debug HTTP server for profiling information")
+	fs.BoolVar(&c.Enabled, prefix+"enabled", false, "Enable debug HTTP server for profiling information, Prometheus metrics, and open connections")
 	fs.StringVar(&c.Address, prefix+"address", "localhost:8080", "Address and port for the debug HTTP server to bind to")
 }
 
@@ -32,16 +35,28 @@ type DebugServer struct {
 	services.Service
 
 	config   DebugConfig
+	conns    *Connections
+	handler  http.Handler
 	listener net.Listener
 	logger   log.Logger
 }
 
-func NewDebugServer(config DebugConfig, logger log.Logger) *DebugServer {
+// NewDebugServer creates a server for profiling information, from the default HTTP
+// handler, Prometheus metrics from gatherer at /metrics, and the state of each open
+// connection as JSON at /debug/conns.
+func NewDebugServer(config DebugConfig, gatherer prometheus.Gatherer, conns *Connections, logger log.Logger) *DebugServer {
 	s := &DebugServer{
 		config: config,
+		conns:  conns,
 		logger: logger,
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/conns", s.connections)
+	mux.Handle("/", http.DefaultServeMux)
+	s.handler = mux
+
 	s.Service = services.NewBasicService(s.start, s.loop, s.stop)
 	return s
 }
@@ -64,7 +79,7 @@ func (s *DebugServer) start(ctx context.Context) error {
 }
 
 func (s *DebugServer) loop(_ context.Context) error {
-	err := http.Serve(s.listener, nil)
+	err := http.Serve(s.listener, s.handler)
 	if !errors.Is(err, net.ErrClosed) {
 		return err
 	}
@@ -80,6 +95,13 @@ func (s *DebugServer) stop(err error) error {
 	return nil
 }
 
+func (s *DebugServer) connections(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.conns.Info()); err != nil {
+		level.Warn(s.logger).Log("msg", "unable to write connections", "err", err)
+	}
+}
+
 func (s *DebugServer) shutdown(ctx context.Context) {
 	<-ctx.Done()
 	level.Debug(s.logger).Log("msg", "shutting down debug server")
@@ -2,12 +2,13 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"net/textproto"
+	"net"
 	"sync"
-
-	"github.com/grafana/dskit/multierror"
+	"sync/atomic"
+	"time"
 
 	"github.com/56quarters/jankcache/server/cache"
 	"github.com/56quarters/jankcache/server/core"
@@ -29,89 +30,307 @@ var (
 	}
 )
 
+// countingConnection counts bytes read and written for the entire server as well
+// as for a single connection.
 type countingConnection struct {
 	delegate io.ReadWriter
 	metrics  *Metrics
-	read     uint64
-	written  uint64
+	read     *atomic.Uint64
+	written  *atomic.Uint64
 }
 
 func (c *countingConnection) Read(p []byte) (int, error) {
 	n, err := c.delegate.Read(p)
-	c.read += uint64(n)
+	c.metrics.BytesRead.Add(uint64(n))
+	c.read.Add(uint64(n))
 	return n, err
 }
 
 func (c *countingConnection) Write(p []byte) (int, error) {
 	n, err := c.delegate.Write(p)
-	c.written += uint64(n)
+	c.metrics.BytesWritten.Add(uint64(n))
+	c.written.Add(uint64(n))
 	return n, err
 }
 
-func (c *countingConnection) Close() error {
-	c.metrics.BytesRead.Add(c.read)
-	c.metrics.BytesWritten.Add(c.written)
-	return nil
-}
-
+// newBufferedConnection wraps a client connection with buffered readers and writers
+// that must be used for the entire lifetime of the connection. Clients may pipeline
+// commands and any bytes read ahead of the current command belong to the next one.
 func newBufferedConnection(conn io.ReadWriter, metrics *Metrics) *bufferedConnection {
+	buffered := &bufferedConnection{
+		Reader:    readers.Get().(*bufio.Reader),
+		Writer:    writers.Get().(*bufio.Writer),
+		connected: time.Now(),
+		commands:  make(map[proto.OpType]uint64),
+	}
+
 	counting := &countingConnection{
 		delegate: conn,
 		metrics:  metrics,
+		read:     &buffered.bytesRead,
+		written:  &buffered.bytesWritten,
 	}
 
-	reader := readers.Get().(*bufio.Reader)
-	writer := writers.Get().(*bufio.Writer)
-	reader.Reset(counting)
-	writer.Reset(counting)
-
-	buffered := &bufferedConnection{
-		delegate: counting,
-		Reader:   reader,
-		Writer:   writer,
+	buffered.Reader.Reset(counting)
+	buffered.Writer.Reset(counting)
+	if c, ok := conn.(net.Conn); ok {
+		buffered.conn = c
+		buffered.remote = c.RemoteAddr()
 	}
 
 	return buffered
 }
 
+// command is the command currently being run by a connection. Running a command
+// is split into phases: parsing until the command and any payload have been read,
+// executing until the first bytes of the response are written, and encoding until
+// the response has been flushed to the client.
+type command struct {
+	op       proto.Op
+	start    time.Time
+	parsed   time.Time
+	executed time.Time
+}
+
+// phases returns the time spent in each phase of running the command if it ended at end.
+func (c *command) phases(end time.Time) (parse time.Duration, execute time.Duration, encode time.Duration) {
+	executed := c.executed
+	if executed.IsZero() {
+		// Commands with no response, like those using noreply, are done executing
+		// once they've finished.
+		executed = end
+	}
+
+	return c.parsed.Sub(c.start), executed.Sub(c.parsed), end.Sub(executed)
+}
+
 type bufferedConnection struct {
-	delegate *countingConnection
-	Reader   *bufio.Reader
-	Writer   *bufio.Writer
+	Reader *bufio.Reader
+	Writer *bufio.Writer
+
+	// user is the authenticated user of the connection, nil if the client hasn't
+	// authenticated or authentication is disabled.
+	user *User
+
+	// conn is the underlying client connection, nil if it isn't a network connection.
+	// remote is the address of the client, nil if unknown.
+	conn   net.Conn
+	remote net.Addr
+
+	// cmd is the command currently being run, its op is nil until it has been parsed.
+	cmd command
+
+	// Everything below is used to inspect open connections. id is zero for connections
+	// that aren't tracked by Connections. lastCommand is when the most recent command
+	// started as UNIX nanoseconds, zero if no commands have been run.
+	id           uint64
+	connected    time.Time
+	state        atomic.Int32
+	lastCommand  atomic.Int64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+
+	// mtx guards the command counts and changes to the state that decide whether the
+	// connection can be interrupted while the server drains. deadline is the most recent
+	// deadline set for a network connection and interrupted is true if its reads were
+	// interrupted by moving the deadline to the past.
+	mtx         sync.Mutex
+	commands    map[proto.OpType]uint64
+	deadline    time.Time
+	interrupted bool
 }
 
 func (b *bufferedConnection) Read(p []byte) (int, error) {
 	return b.Reader.Read(p)
 }
 func (b *bufferedConnection) Write(p []byte) (int, error) {
+	if b.cmd.op != nil && b.cmd.executed.IsZero() {
+		b.cmd.executed = time.Now()
+		b.setState(connStateWriting)
+	}
+
 	return b.Writer.Write(p)
 }
 
-func (b *bufferedConnection) Close() error {
-	var errs multierror.MultiError
+// parsed marks the end of parsing the command currently being run.
+func (b *bufferedConnection) parsed(op proto.Op) {
+	b.cmd.op = op
+	b.cmd.parsed = time.Now()
+	b.setState(connStateExecuting)
+}
+
+func (b *bufferedConnection) setState(s connState) {
+	b.state.Store(int32(s))
+}
+
+// busy marks the connection as running a command once the first bytes of it have been
+// read. If reads were interrupted at the same time because the connection looked idle,
+// the deadline is restored so the rest of the command can be read.
+func (b *bufferedConnection) busy() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.setState(connStateParsing)
+	if b.interrupted {
+		b.interrupted = false
+		_ = b.conn.SetReadDeadline(b.deadline)
+	}
+}
+
+// interruptIfIdle stops a network connection that isn't running a command: reads
+// of the next command are interrupted and connections in the middle of the TLS
+// handshake are closed. Returns false if the connection is busy running a command.
+func (b *bufferedConnection) interruptIfIdle() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch connState(b.state.Load()) {
+	case connStateReading:
+		b.interrupted = true
+		_ = b.conn.SetReadDeadline(time.Now())
+		return true
+	case connStateHandshake:
+		_ = b.conn.Close()
+		return true
+	}
+
+	return false
+}
+
+// setDeadline sets the read and write deadline of a network connection, remembering
+// it so that it can be restored if reads are interrupted.
+func (b *bufferedConnection) setDeadline(t time.Time) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.deadline = t
+	b.interrupted = false
+	return b.conn.SetDeadline(t)
+}
+
+// countCommand increments the number of commands of type t run by the connection.
+func (b *bufferedConnection) countCommand(t proto.OpType) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.commands[t]++
+}
+
+// commandCounts returns the number of commands of each type run by the connection.
+func (b *bufferedConnection) commandCounts() map[proto.OpType]uint64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	counts := make(map[proto.OpType]uint64, len(b.commands))
+	for t, n := range b.commands {
+		counts[t] = n
+	}
+
+	return counts
+}
+
+// ReadLine reads a single line terminated by \n or \r\n, returning it without the
+// line ending. Lines may be longer than the read buffer. core.ErrLineTooLong is returned
+// if the line is longer than max bytes, in which case the rest of the line is discarded
+// so that the next read starts at the beginning of the next line.
+func (b *bufferedConnection) ReadLine(max int) (string, error) {
+	line, err := b.Reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		line, err = b.readLongLine(line, max)
+	}
+
+	if err != nil {
+		return "", err
+	} else if len(line) > max {
+		return "", core.ErrLineTooLong
+	}
 
-	errs.Add(b.Writer.Flush())
-	errs.Add(b.delegate.Close())
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return string(line), nil
+}
+
+// Flush writes any buffered output to the client unless there is more buffered
+// input, meaning the client has pipelined more commands. The responses for all
+// pipelined commands are written together once they've all been handled.
+func (b *bufferedConnection) Flush() error {
+	if b.Reader.Buffered() > 0 {
+		return nil
+	}
+
+	return b.Writer.Flush()
+}
+
+// readLongLine continues reading a line that didn't fit in the read buffer, starting
+// with the part that has already been read. Parts of the line past max bytes are read
+// and discarded rather than kept, core.ErrLineTooLong is returned once the end of the
+// line is found.
+func (b *bufferedConnection) readLongLine(start []byte, max int) ([]byte, error) {
+	line := append([]byte(nil), start...)
+	tooLong := len(line) > max
+
+	for {
+		part, err := b.Reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(part) <= max {
+			line = append(line, part...)
+		} else {
+			tooLong = true
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if tooLong {
+			return nil, core.ErrLineTooLong
+		}
+
+		return line, nil
+	}
+}
 
+func (b *bufferedConnection) Close() error {
+	err := b.Writer.Flush()
+
+	// Reset to avoid holding references to the connection while pooled
+	b.Reader.Reset(nil)
+	b.Writer.Reset(nil)
 	readers.Put(b.Reader)
 	writers.Put(b.Writer)
 
-	return errs.Err()
+	return err
 }
 
 type Handler struct {
-	cache   *cache.Cache
-	parser  *proto.Parser
-	metrics *Metrics
-	rtCtx   *RuntimeContext
+	tenants     *Tenants
+	parser      *proto.Parser
+	credentials *Credentials
+	metrics     *Metrics
+	commands    *CommandMetrics
+	slowLog     *SlowLog
+	conns       *Connections
+	settings    Settings
+	shutdown    *Shutdown
+	rtCtx       *RuntimeContext
 }
 
-func NewHandler(cache *cache.Cache, parser *proto.Parser, metrics *Metrics, rtCtx *RuntimeContext) *Handler {
+// NewHandler creates a Handler that runs commands against the cache of each tenant. Clients
+// must authenticate using credentials before running commands unless credentials is nil.
+func NewHandler(tenants *Tenants, parser *proto.Parser, credentials *Credentials, metrics *Metrics, commands *CommandMetrics, slowLog *SlowLog, conns *Connections, settings Settings, shutdown *Shutdown, rtCtx *RuntimeContext) *Handler {
 	return &Handler{
-		cache:   cache,
-		parser:  parser,
-		metrics: metrics,
-		rtCtx:   rtCtx,
+		tenants:     tenants,
+		parser:      parser,
+		credentials: credentials,
+		metrics:     metrics,
+		commands:    commands,
+		slowLog:     slowLog,
+		conns:       conns,
+		settings:    settings,
+		shutdown:    shutdown,
+		rtCtx:       rtCtx,
 	}
 }
 
@@ -125,77 +344,299 @@ func (h *Handler) Reject(conn io.ReadWriter, msg string, args ...any) {
 	output.Error(core.ServerError(msg, args...))
 }
 
-func (h *Handler) Handle(conn io.ReadWriter) error {
-	wrapped := newBufferedConnection(conn, h.metrics)
-	defer func() {
-		_ = wrapped.Close()
-	}()
+// cacheFor returns the cache of the tenant that a command for key on conn belongs to.
+func (h *Handler) cacheFor(conn *bufferedConnection, key string) *cache.Cache {
+	return h.tenants.For(conn.user, key)
+}
 
-	output := proto.NewEncoder(wrapped)
+// detect returns the method used to handle commands for a connection based on the
+// first byte sent by the client: binary protocol requests always start with a magic
+// byte that can't start a text protocol command.
+func (h *Handler) detect(conn *bufferedConnection) func(*bufferedConnection) error {
+	b, err := conn.Reader.Peek(1)
+	if err == nil && b[0] == proto.BinaryMagicRequest {
+		return h.serveBinary
+	}
 
-	text := textproto.NewReader(wrapped.Reader)
-	line, err := text.ReadLine()
-	if err != nil {
+	// If there was an error peeking, the text handler will encounter it as well and
+	// return it so there's no need to handle it here.
+	return h.serveText
+}
+
+// serveText reads, executes, and writes the response for a single command from a
+// client connection. Output is only flushed once there are no more pipelined
+// commands buffered.
+func (h *Handler) serveText(conn *bufferedConnection) error {
+	if err := h.begin(conn); err != nil {
+		return err
+	}
+	defer h.finish(conn)
+
+	if err := h.handle(conn); err != nil {
+		return err
+	}
+
+	return conn.Flush()
+}
+
+// begin waits for the client to send the next command and marks when it started so
+// that time spent idle between commands isn't counted as part of running it. The
+// connection is busy as soon as any of the command has been read, including pipelined
+// commands that were read along with an earlier one.
+func (h *Handler) begin(conn *bufferedConnection) error {
+	if conn.Reader.Buffered() == 0 {
+		conn.setState(connStateReading)
+		if _, err := conn.Reader.Peek(1); err != nil {
+			return err
+		}
+	}
+
+	conn.busy()
+	now := time.Now()
+	conn.cmd = command{start: now}
+	conn.lastCommand.Store(now.UnixNano())
+	return nil
+}
+
+// finish records how long the current command took if it could be parsed.
+func (h *Handler) finish(conn *bufferedConnection) {
+	cmd := conn.cmd
+	conn.cmd = command{}
+	conn.setState(connStateReading)
+	if cmd.op == nil {
+		return
+	}
+
+	end := time.Now()
+	conn.countCommand(cmd.op.Type())
+	h.commands.Observe(&cmd, end)
+	h.slowLog.Observe(conn.remote, &cmd, end)
+}
+
+// stats returns the values of a group of statistics. Resetting statistics doesn't
+// return any values and must be handled separately.
+func (h *Handler) stats(op proto.StatsOp) []StatValue {
+	switch op.Group {
+	case proto.StatsConns:
+		return h.conns.Values(time.Now())
+	case proto.StatsItems:
+		return newItemStats(h.tenants)
+	case proto.StatsLatency:
+		return h.commands.Latencies()
+	case proto.StatsSettings:
+		settings := h.settings
+		settings.MaxBytes = h.tenants.Default().MaxBytes()
+		return settings.Values()
+	case proto.StatsSizes:
+		return newSizeStats(h.tenants)
+	}
+
+	stats := NewStats(h.tenants, h.metrics, h.rtCtx.Read())
+	return stats.Values()
+}
+
+func (h *Handler) handle(conn *bufferedConnection) error {
+	output := proto.NewEncoder(conn)
+
+	line, err := conn.ReadLine(h.settings.MaxLineSize)
+	if errors.Is(err, core.ErrLineTooLong) {
+		// The rest of the line has been discarded so the client can keep sending
+		// commands, the same as any other invalid command.
+		output.Error(err)
+		return nil
+	} else if err != nil {
 		return err
 	}
 
 	// Pass the line we read to the parser as well as the buffered reader since
 	// we'll need to read a payload of bytes (not line delimited) in the case of
 	// a "set" command.
-	op, err := h.parser.ParseLine(line, wrapped.Reader)
+	op, err := h.parser.ParseLine(line, conn.Reader)
 	if err != nil {
+		h.countError(err)
+		output.Error(err)
+		return nil
+	}
+
+	conn.parsed(op)
+
+	// Text protocol clients authenticate with a "set" command that has the username
+	// and password as its payload instead of a value.
+	if h.credentials != nil && conn.user == nil && op.Type() == proto.OpTypeSet {
+		op, err = proto.TextAuth(op.(*proto.SetOp))
+		if err != nil {
+			h.metrics.AuthCommands.Add(1)
+			h.metrics.AuthErrors.Add(1)
+			output.Error(err)
+			return nil
+		}
+
+		conn.cmd.op = op
+	}
+
+	if err := h.authorize(conn, op); err != nil {
 		output.Error(err)
 		return nil
 	}
 
 	switch op.Type() {
+	case proto.OpTypeAdd:
+		addOp := op.(*proto.AddOp)
+		_, err := h.cacheFor(conn, addOp.Key).Add(addOp)
+		h.storeResult(output, err, addOp.NoReply)
+	case proto.OpTypeAppend:
+		appendOp := op.(*proto.AppendOp)
+		_, err := h.cacheFor(conn, appendOp.Key).Append(appendOp)
+		h.storeResult(output, err, appendOp.NoReply)
 	case proto.OpTypeCacheMemLimit:
 		limitOp := op.(*proto.CacheMemLimitOp)
-		err := h.cache.CacheMemLimit(limitOp)
+		err := h.tenants.CacheMemLimit(limitOp)
 		if err != nil {
 			output.Error(err)
 		} else if !limitOp.NoReply {
 			output.Ok()
 		}
+	case proto.OpTypeCas:
+		casOp := op.(*proto.CasOp)
+		_, err := h.cacheFor(conn, casOp.Key).Cas(casOp)
+		h.storeResult(output, err, casOp.NoReply)
+	case proto.OpTypeCloseConn:
+		closeOp := op.(*proto.CloseConnOp)
+		err := h.conns.Close(closeOp.ID)
+		if err != nil {
+			if !closeOp.NoReply || !isStoreOutcome(err) {
+				output.Error(err)
+			}
+		} else if !closeOp.NoReply {
+			output.Ok()
+		}
+	case proto.OpTypeDecr:
+		decrOp := op.(*proto.DecrOp)
+		res, err := h.cacheFor(conn, decrOp.Key).Decr(decrOp)
+		arithmeticResult(output, res, err, decrOp.NoReply)
 	case proto.OpTypeDelete:
 		delOp := op.(*proto.DeleteOp)
-		err := h.cache.Delete(delOp)
+		err := h.cacheFor(conn, delOp.Key).Delete(delOp)
 		if err != nil {
-			output.Error(err)
+			if !delOp.NoReply || !isStoreOutcome(err) {
+				output.Error(err)
+			}
 		} else if !delOp.NoReply {
 			output.Deleted()
 		}
+	case proto.OpTypeFlushAll:
+		flushOp := op.(*proto.FlushAllOp)
+		err := h.tenants.FlushAll(flushOp)
+		if err != nil {
+			output.Error(err)
+		} else if !flushOp.NoReply {
+			output.Ok()
+		}
+	case proto.OpTypeGat:
+		gatOp := op.(*proto.GatOp)
+		res, err := h.tenants.Gat(conn.user, gatOp)
+		retrievalResult(output, res, err, gatOp.Unique)
 	case proto.OpTypeGet:
 		getOp := op.(*proto.GetOp)
-		res, err := h.cache.Get(getOp)
+		res, err := h.tenants.Get(conn.user, getOp)
+		retrievalResult(output, res, err, getOp.Unique)
+	case proto.OpTypeIncr:
+		incrOp := op.(*proto.IncrOp)
+		res, err := h.cacheFor(conn, incrOp.Key).Incr(incrOp)
+		arithmeticResult(output, res, err, incrOp.NoReply)
+	case proto.OpTypeMetaArithmetic:
+		h.metrics.MetaCommands.Add(1)
+		maOp := op.(*proto.MetaArithmeticOp)
+		res, err := h.cacheFor(conn, maOp.Key).MetaArithmetic(maOp)
 		if err != nil {
 			output.Error(err)
 		} else {
-			if !getOp.Unique {
-				for _, v := range res {
-					output.Encode(&cache.NoCasEntry{Entry: v})
-				}
-			} else {
-				for _, v := range res {
-					output.Encode(v)
-				}
-			}
-
-			output.End()
+			output.Encode(res)
+		}
+	case proto.OpTypeMetaDebug:
+		h.metrics.MetaCommands.Add(1)
+		meOp := op.(*proto.MetaDebugOp)
+		res, ok := h.cacheFor(conn, meOp.Key).MetaDebug(meOp)
+		if ok {
+			output.Encode(res)
+		} else {
+			output.Meta(proto.MetaStatusMiss)
+		}
+	case proto.OpTypeMetaDelete:
+		h.metrics.MetaCommands.Add(1)
+		mdOp := op.(*proto.MetaDeleteOp)
+		res, err := h.cacheFor(conn, mdOp.Key).MetaDelete(mdOp)
+		if err != nil {
+			output.Error(err)
+		} else {
+			output.Encode(res)
+		}
+	case proto.OpTypeMetaGet:
+		h.metrics.MetaCommands.Add(1)
+		mgOp := op.(*proto.MetaGetOp)
+		res, err := h.cacheFor(conn, mgOp.Key).MetaGet(mgOp)
+		if err != nil {
+			output.Error(err)
+		} else {
+			output.Encode(res)
+		}
+	case proto.OpTypeMetaNoOp:
+		h.metrics.MetaCommands.Add(1)
+		output.Meta(proto.MetaStatusNoOp)
+	case proto.OpTypeMetaSet:
+		h.metrics.MetaCommands.Add(1)
+		msOp := op.(*proto.MetaSetOp)
+		res, err := h.cacheFor(conn, msOp.Key).MetaSet(msOp)
+		if err != nil {
+			output.Error(err)
+		} else {
+			output.Encode(res)
 		}
+	case proto.OpTypePrepend:
+		prependOp := op.(*proto.PrependOp)
+		_, err := h.cacheFor(conn, prependOp.Key).Prepend(prependOp)
+		h.storeResult(output, err, prependOp.NoReply)
 	case proto.OpTypeQuit:
 		return core.ErrQuit
-	case proto.OpTypeSet:
-		setOp := op.(*proto.SetOp)
-		err := h.cache.Set(setOp)
-		if err != nil {
+	case proto.OpTypeShutdown:
+		// Same as memcached, there's no response to the command and the connection
+		// is closed. The server drains all other connections before stopping.
+		h.shutdown.Request()
+		return core.ErrQuit
+	case proto.OpTypeReplace:
+		replaceOp := op.(*proto.ReplaceOp)
+		_, err := h.cacheFor(conn, replaceOp.Key).Replace(replaceOp)
+		h.storeResult(output, err, replaceOp.NoReply)
+	case proto.OpTypeSaslAuth:
+		if err := h.authenticate(conn, op.(*proto.SaslAuthOp)); err != nil {
 			output.Error(err)
-		} else if !setOp.NoReply {
+		} else {
 			output.Stored()
 		}
+	case proto.OpTypeSet:
+		setOp := op.(*proto.SetOp)
+		_, err := h.cacheFor(conn, setOp.Key).Set(setOp)
+		h.storeResult(output, err, setOp.NoReply)
 	case proto.OpTypeStats:
-		stats := NewStats(h.cache, h.metrics, h.rtCtx.Read())
-		output.Encode(&stats)
+		statsOp := op.(proto.StatsOp)
+		if statsOp.Group == proto.StatsReset {
+			h.metrics.Reset()
+			h.tenants.ResetStats()
+			output.Reset()
+		} else {
+			values := StatValues(h.stats(statsOp))
+			output.Encode(&values)
+		}
+	case proto.OpTypeTouch:
+		touchOp := op.(*proto.TouchOp)
+		err := h.cacheFor(conn, touchOp.Key).Touch(touchOp)
+		if err != nil {
+			if !touchOp.NoReply || !isStoreOutcome(err) {
+				output.Error(err)
+			}
+		} else if !touchOp.NoReply {
+			output.Touched()
+		}
 	case proto.OpTypeVersion:
 		output.Version(version)
 	default:
@@ -204,3 +645,63 @@ func (h *Handler) Handle(conn io.ReadWriter) error {
 
 	return nil
 }
+
+// arithmeticResult writes the response to an "incr" or "decr" command: the new value
+// of the entry, or NOT_FOUND when there was no entry to modify.
+func arithmeticResult(output *proto.Encoder, res *cache.Entry, err error, noreply bool) {
+	if err == nil {
+		if !noreply {
+			output.Bytes(res.Value)
+		}
+	} else if !noreply || !isStoreOutcome(err) {
+		output.Error(err)
+	}
+}
+
+// retrievalResult writes the response to a "get" style command: each of the entries
+// found, including their unique value if requested, followed by END.
+func retrievalResult(output *proto.Encoder, res []*cache.Entry, err error, unique bool) {
+	if err != nil {
+		output.Error(err)
+		return
+	}
+
+	if !unique {
+		for _, v := range res {
+			output.Encode(&cache.NoCasEntry{Entry: v})
+		}
+	} else {
+		for _, v := range res {
+			output.Encode(v)
+		}
+	}
+
+	output.End()
+}
+
+// countError updates metrics for errors that have a corresponding stat.
+func (h *Handler) countError(err error) {
+	if errors.Is(err, core.ErrObjectTooLarge) {
+		h.metrics.StoreTooLarge.Add(1)
+	} else if errors.Is(err, core.ErrNoMemory) {
+		h.metrics.StoreNoMemory.Add(1)
+	}
+}
+
+// storeResult writes the response to a storage command. Results that indicate the
+// item wasn't stored but aren't errors (e.g. EXISTS for a "cas") are omitted when
+// the client asked for no reply, the same as a successful store.
+func (h *Handler) storeResult(output *proto.Encoder, err error, noreply bool) {
+	h.countError(err)
+	if err == nil {
+		if !noreply {
+			output.Stored()
+		}
+	} else if !noreply || !isStoreOutcome(err) {
+		output.Error(err)
+	}
+}
+
+func isStoreOutcome(err error) bool {
+	return errors.Is(err, core.ErrExists) || errors.Is(err, core.ErrNotFound) || errors.Is(err, core.ErrNotStored)
+}
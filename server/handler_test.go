@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/56quarters/jankcache/server/cache"
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// chunkedConn is a client connection that returns each chunk from a separate call to
+// Read, like a client whose commands arrive in multiple packets. Each call to Write
+// is recorded separately.
+type chunkedConn struct {
+	chunks []string
+	writes []string
+}
+
+func (c *chunkedConn) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.chunks[0])
+	c.chunks[0] = c.chunks[0][n:]
+	if c.chunks[0] == "" {
+		c.chunks = c.chunks[1:]
+	}
+
+	return n, nil
+}
+
+func (c *chunkedConn) Write(p []byte) (int, error) {
+	c.writes = append(c.writes, string(p))
+	return len(p), nil
+}
+
+func newTestHandler() *Handler {
+	logger := log.NewNopLogger()
+	cacheCfg := cache.Config{Backend: cache.BackendLRU, MaxSizeMb: 16, MaxItemSize: 1024 * 1024}
+
+	return NewHandler(
+		NewTenants(TenantConfig{}, cacheCfg, logger),
+		proto.NewParser(cacheCfg.MaxItemSize),
+		nil,
+		NewMetrics(),
+		NewCommandMetrics(prometheus.NewRegistry()),
+		NewSlowLog(SlowLogConfig{}, logger),
+		NewConnections(),
+		Settings{MaxLineSize: 2048},
+		NewShutdown(),
+		NewRuntimeContext(),
+	)
+}
+
+// serve handles commands from conn until the client has nothing more to send or the
+// connection is closed by a command, and returns everything written to the client.
+func serve(t *testing.T, h *Handler, conn *chunkedConn) string {
+	t.Helper()
+
+	buffered := newBufferedConnection(conn, h.metrics)
+	handle := h.detect(buffered)
+	for {
+		err := handle(buffered)
+		if errors.Is(err, io.EOF) || errors.Is(err, core.ErrQuit) {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error handling command: %s", err)
+		}
+	}
+
+	if err := buffered.Close(); err != nil {
+		t.Fatalf("unexpected error closing connection: %s", err)
+	}
+
+	return strings.Join(conn.writes, "")
+}
+
+// unique returns the CAS value of the entry for key in the default tenant.
+func unique(t *testing.T, h *Handler, key string) uint64 {
+	t.Helper()
+
+	entries, err := h.tenants.Default().Get(&proto.GetOp{Keys: []string{key}})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected entry for key %s, got %v, %v", key, entries, err)
+	}
+
+	return entries[0].Unique
+}
+
+const (
+	pipelinedCommands = "set a 0 0 5\r\nhello\r\n" +
+		"set b 0 0 3 noreply\r\nfoo\r\n" +
+		"get a b\r\n" +
+		"delete a noreply\r\n" +
+		"get a\r\n" +
+		"set c 5 0 2\r\nhi\r\n" +
+		"delete missing\r\n" +
+		"gets c\r\n"
+	pipelinedResponses = "STORED\r\n" +
+		"VALUE a 0 5\r\nhello\r\nVALUE b 0 3\r\nfoo\r\nEND\r\n" +
+		"END\r\n" +
+		"STORED\r\n" +
+		"NOT_FOUND\r\n" +
+		"VALUE c 5 2 %d\r\nhi\r\nEND\r\n"
+)
+
+func TestHandler_PipelinedSingleWrite(t *testing.T) {
+	h := newTestHandler()
+	conn := &chunkedConn{chunks: []string{pipelinedCommands}}
+	out := serve(t, h, conn)
+
+	expected := fmt.Sprintf(pipelinedResponses, unique(t, h, "c"))
+	if out != expected {
+		t.Errorf("expected responses %q, got %q", expected, out)
+	}
+
+	// Responses to commands that were all sent together are written together
+	if len(conn.writes) != 1 {
+		t.Errorf("expected responses in 1 write, got %d writes", len(conn.writes))
+	}
+}
+
+func TestHandler_PipelinedSplitAcrossReads(t *testing.T) {
+	// Split the commands in the middle of a command line, in the middle of the "hello"
+	// payload, and between the payload and its line ending.
+	split := []string{
+		pipelinedCommands[:5],
+		pipelinedCommands[5:15],
+		pipelinedCommands[15:18],
+		pipelinedCommands[18:30],
+		pipelinedCommands[30:],
+	}
+
+	h := newTestHandler()
+	conn := &chunkedConn{chunks: split}
+	out := serve(t, h, conn)
+
+	expected := fmt.Sprintf(pipelinedResponses, unique(t, h, "c"))
+	if out != expected {
+		t.Errorf("expected responses %q, got %q", expected, out)
+	}
+}
+
+func TestHandler_PipelinedLargerThanReadBuffer(t *testing.T) {
+	var in bytes.Buffer
+	var expected bytes.Buffer
+	for i := 0; in.Len() < 4*readBufSize; i++ {
+		fmt.Fprintf(&in, "set key%d 0 0 %d noreply\r\nvalue%d\r\n", i, len(fmt.Sprint(i))+5, i)
+		fmt.Fprintf(&in, "get key%d\r\n", i)
+		fmt.Fprintf(&expected, "VALUE key%d 0 %d\r\nvalue%d\r\nEND\r\n", i, len(fmt.Sprint(i))+5, i)
+	}
+
+	// Send everything in chunks that don't line up with commands or the read buffer
+	var chunks []string
+	for s := in.String(); s != ""; {
+		n := 1000
+		if n > len(s) {
+			n = len(s)
+		}
+
+		chunks = append(chunks, s[:n])
+		s = s[n:]
+	}
+
+	h := newTestHandler()
+	out := serve(t, h, &chunkedConn{chunks: chunks})
+	if out != expected.String() {
+		t.Errorf("expected %d bytes of responses in order, got %d bytes", expected.Len(), len(out))
+	}
+}
+
+func TestHandler_StatsReset(t *testing.T) {
+	h := newTestHandler()
+	out := serve(t, h, &chunkedConn{chunks: []string{"get missing\r\nstats reset\r\n"}})
+	if out != "END\r\nRESET\r\n" {
+		t.Errorf("expected responses to get and reset, got %q", out)
+	}
+
+	if misses := h.tenants.Default().Counters().GetMisses.Load(); misses != 0 {
+		t.Errorf("expected get misses to be reset, got %d", misses)
+	}
+}
+
+func TestHandler_StatsGroups(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected []string
+	}{
+		{name: "settings", line: "stats settings", expected: []string{"STAT maxbytes 16777216\r\n", "STAT max_line_size 2048\r\n"}},
+		{name: "items", line: "stats items", expected: []string{"STAT items:1:number 1\r\n", "STAT items:1:bytes 22\r\n"}},
+		{name: "sizes", line: "stats sizes", expected: []string{"STAT 32 1\r\n"}},
+		{name: "unsupported", line: "stats slabs", expected: []string{"CLIENT_ERROR "}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler()
+			out := serve(t, h, &chunkedConn{chunks: []string{"set a 0 0 1\r\n1\r\n" + tc.line + "\r\n"}})
+			for _, expected := range tc.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("expected response to include %q, got %q", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_Cas(t *testing.T) {
+	h := newTestHandler()
+	out := serve(t, h, &chunkedConn{chunks: []string{"cas a 0 0 3 1\r\nnew\r\nset a 0 0 3\r\nold\r\n"}})
+	if out != "NOT_FOUND\r\nSTORED\r\n" {
+		t.Fatalf("expected not found then stored, got %q", out)
+	}
+
+	cas := unique(t, h, "a")
+	in := fmt.Sprintf("cas a 0 0 3 %d\r\nbad\r\ncas a 0 0 3 %d\r\nnew\r\ngets a\r\n", cas+1, cas)
+	out = serve(t, h, &chunkedConn{chunks: []string{in}})
+
+	expected := fmt.Sprintf("EXISTS\r\nSTORED\r\nVALUE a 0 3 %d\r\nnew\r\nEND\r\n", unique(t, h, "a"))
+	if out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestHandler_AppendPrepend(t *testing.T) {
+	h := newTestHandler()
+	in := "append a 0 0 1\r\nb\r\nset a 0 0 1\r\nb\r\nappend a 0 0 1\r\nc\r\nprepend a 0 0 1 noreply\r\na\r\nget a\r\n"
+	out := serve(t, h, &chunkedConn{chunks: []string{in}})
+
+	expected := "NOT_STORED\r\nSTORED\r\nSTORED\r\nVALUE a 0 3\r\nabc\r\nEND\r\n"
+	if out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestHandler_TouchGat(t *testing.T) {
+	h := newTestHandler()
+	in := "touch a 60\r\nset a 0 0 1\r\n1\r\ntouch a 60\r\ngat 60 a missing\r\ngats 60 a\r\n"
+	out := serve(t, h, &chunkedConn{chunks: []string{in}})
+
+	expected := fmt.Sprintf("NOT_FOUND\r\nSTORED\r\nTOUCHED\r\nVALUE a 0 1\r\n1\r\nEND\r\nVALUE a 0 1 %d\r\n1\r\nEND\r\n", unique(t, h, "a"))
+	if out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestHandler_FlushAll(t *testing.T) {
+	h := newTestHandler()
+	in := "set a 0 0 1\r\n1\r\nflush_all\r\nget a\r\nflush_all 60 noreply\r\nflush_all abc\r\n"
+	out := serve(t, h, &chunkedConn{chunks: []string{in}})
+
+	expected := "STORED\r\nOK\r\nEND\r\nCLIENT_ERROR bad flush_all delay 'flush_all abc'\r\n"
+	if out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestHandler_SwallowsRejectedPayload(t *testing.T) {
+	h := newTestHandler()
+	in := "set a abc 0 3\r\nget\r\nset b 0 0 1\r\n1\r\nget a b\r\n"
+	out := serve(t, h, &chunkedConn{chunks: []string{in}})
+
+	// The rejected payload looks like a command but must not be run as one
+	expected := "CLIENT_ERROR bad flags 'set a abc 0 3': strconv.ParseUint: parsing \"abc\": invalid syntax\r\n" +
+		"STORED\r\nVALUE b 0 1\r\n1\r\nEND\r\n"
+	if out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -106,23 +107,50 @@ func timevalToFloat(v syscall.Timeval) float64 {
 
 // Metrics is a bundle of server-centric metrics updated by TCPServer and Handler.
 type Metrics struct {
-	CurrentConnections  atomic.Int64
-	MaxConnections      atomic.Uint64
-	TotalConnections    atomic.Uint64
-	RejectedConnections atomic.Uint64
-	BytesWritten        atomic.Uint64
-	BytesRead           atomic.Uint64
+	CurrentConnections    atomic.Int64
+	MaxConnections        atomic.Uint64
+	TotalConnections      atomic.Uint64
+	RejectedConnections   atomic.Uint64
+	CurrentTLSConnections atomic.Int64
+	TotalTLSConnections   atomic.Uint64
+	TLSHandshakeErrors    atomic.Uint64
+	BytesWritten          atomic.Uint64
+	BytesRead             atomic.Uint64
+	MetaCommands          atomic.Uint64
+	AuthCommands          atomic.Uint64
+	AuthErrors            atomic.Uint64
+	StoreTooLarge         atomic.Uint64
+	StoreNoMemory         atomic.Uint64
+	UDPDropped            atomic.Uint64
 }
 
 func NewMetrics() *Metrics {
 	return &Metrics{}
 }
 
-// NewStats creates a new Stats object for use as a response to a Memcached `stats` command.
-func NewStats(c *cache.Cache, m *Metrics, r RuntimeSnapshot) Stats {
-	cacheMetrics := c.Metrics()
+// Reset zeroes the counters that are reset by a Memcached `stats reset` command. Values
+// that reflect the current state of the server, like the number of open connections,
+// are not changed.
+func (m *Metrics) Reset() {
+	m.TotalConnections.Store(0)
+	m.RejectedConnections.Store(0)
+	m.UDPDropped.Store(0)
+	m.TotalTLSConnections.Store(0)
+	m.TLSHandshakeErrors.Store(0)
+	m.BytesWritten.Store(0)
+	m.BytesRead.Store(0)
+	m.MetaCommands.Store(0)
+	m.AuthCommands.Store(0)
+	m.AuthErrors.Store(0)
+	m.StoreTooLarge.Store(0)
+	m.StoreNoMemory.Store(0)
+}
 
-	return Stats{
+// NewStats creates a new Stats object for use as a response to a Memcached `stats` command.
+// Cache statistics are the totals for all tenants along with a breakdown for each tenant
+// other than the default.
+func NewStats(t *Tenants, m *Metrics, r RuntimeSnapshot) Stats {
+	s := Stats{
 		Pid:        r.Pid,
 		Uptime:     r.Uptime,
 		ServerTime: r.Time,
@@ -136,41 +164,111 @@ func NewStats(c *cache.Cache, m *Metrics, r RuntimeSnapshot) Stats {
 		CurrentConnections:  uint64(m.CurrentConnections.Load()),
 		TotalConnections:    m.TotalConnections.Load(),
 		RejectedConnections: m.RejectedConnections.Load(),
+		UDPDropped:          m.UDPDropped.Load(),
+
+		CurrentTLSConnections: uint64(m.CurrentTLSConnections.Load()),
+		TotalTLSConnections:   m.TotalTLSConnections.Load(),
+		TLSHandshakeErrors:    m.TLSHandshakeErrors.Load(),
 
-		Gets:    cacheMetrics.GetsKept(),
-		Sets:    cacheMetrics.KeysAdded() + cacheMetrics.KeysUpdated(),
-		Flushes: 0,
-		Touches: 0,
-		Meta:    0,
+		// Every flush_all is applied to all tenants so only count them once
+		Flushes: t.Default().Counters().Flushes.Load(),
+		Meta:    m.MetaCommands.Load(),
+
+		AuthCommands: m.AuthCommands.Load(),
+		AuthErrors:   m.AuthErrors.Load(),
+
+		StoreTooLarge: m.StoreTooLarge.Load(),
+		StoreNoMemory: m.StoreNoMemory.Load(),
+
+		BytesRead:    m.BytesRead.Load(),
+		BytesWritten: m.BytesWritten.Load(),
+	}
 
-		GetHits:    cacheMetrics.Hits(),
-		GetMisses:  cacheMetrics.Misses(),
-		GetExpired: 0,
-		GetFlushed: 0,
+	for _, tenant := range t.All() {
+		s.addCache(tenant.Cache)
+		if tenant.Name != "" {
+			s.Tenants = append(s.Tenants, newTenantStats(tenant))
+		}
+	}
 
-		StoreTooLarge: 0,
-		StoreNoMemory: 0,
+	// Same as the ratio reported for each tenant but across the caches of all tenants
+	if lookups := s.GetHits + s.GetMisses; lookups > 0 {
+		s.HitRatio = float64(s.GetHits) / float64(lookups)
+	}
 
-		DeleteHits:   0,
-		DeleteMisses: 0,
+	return s
+}
 
-		IncrHits:   0,
-		IncrMisses: 0,
+// addCache adds the statistics of a single tenant's cache to the totals.
+func (s *Stats) addCache(c *cache.Cache) {
+	cacheMetrics := c.Metrics()
+	cacheCounters := c.Counters()
 
-		DecrHits:   0,
-		DecrMisses: 0,
+	s.Gets += cacheCounters.GetHits.Load() + cacheCounters.GetMisses.Load()
+	s.Sets += cacheCounters.Sets.Load()
+	s.Touches += cacheCounters.Touches.Load()
 
-		TouchHits:   0,
-		TouchMisses: 0,
+	s.GetHits += cacheCounters.GetHits.Load()
+	s.GetMisses += cacheCounters.GetMisses.Load()
+	s.GetFlushed += cacheCounters.GetFlushed.Load()
 
-		BytesRead:    m.BytesRead.Load(),
-		BytesWritten: m.BytesWritten.Load(),
-		Bytes:        cacheMetrics.CostAdded() - cacheMetrics.CostEvicted(),
-		MaxBytes:     c.MaxBytes(),
+	s.DeleteHits += cacheCounters.DeleteHits.Load()
+	s.DeleteMisses += cacheCounters.DeleteMisses.Load()
 
-		CurrentItems: cacheMetrics.KeysAdded() - cacheMetrics.KeysEvicted(),
-		TotalItems:   cacheMetrics.KeysAdded(),
+	s.IncrHits += cacheCounters.IncrHits.Load()
+	s.IncrMisses += cacheCounters.IncrMisses.Load()
+
+	s.DecrHits += cacheCounters.DecrHits.Load()
+	s.DecrMisses += cacheCounters.DecrMisses.Load()
+
+	s.TouchHits += cacheCounters.TouchHits.Load()
+	s.TouchMisses += cacheCounters.TouchMisses.Load()
+
+	// Includes entries invalidated by flush_all until they're read, evicted, or replaced
+	usage := c.Usage()
+	s.Bytes += usage.Bytes
+	s.MaxBytes += c.MaxBytes()
+
+	s.CurrentItems += usage.Items
+	s.TotalItems += cacheMetrics.KeysAdded()
+	s.Evictions += cacheMetrics.KeysEvicted()
+	s.Collisions += cacheCounters.Collisions.Load()
+	s.SetsDropped += cacheCounters.SetsDropped.Load()
+
+	s.BackendSetsDropped += cacheMetrics.SetsDropped()
+	s.BackendSetsRejected += cacheMetrics.SetsRejected()
+	s.BackendGetsDropped += cacheMetrics.GetsDropped()
+	s.BackendCostEvicted += cacheMetrics.CostEvicted()
+}
+
+// TenantStats are the statistics for the cache of a single tenant.
+type TenantStats struct {
+	Name         string
+	GetHits      uint64
+	GetMisses    uint64
+	Sets         uint64
+	Bytes        uint64
+	MaxBytes     uint64
+	CurrentItems uint64
+	Evictions    uint64
+	HitRatio     float64
+}
+
+func newTenantStats(t Tenant) TenantStats {
+	cacheMetrics := t.Cache.Metrics()
+	cacheCounters := t.Cache.Counters()
+	usage := t.Cache.Usage()
+
+	return TenantStats{
+		Name:         t.Name,
+		GetHits:      cacheCounters.GetHits.Load(),
+		GetMisses:    cacheCounters.GetMisses.Load(),
+		Sets:         cacheCounters.Sets.Load(),
+		Bytes:        usage.Bytes,
+		MaxBytes:     t.Cache.MaxBytes(),
+		CurrentItems: usage.Items,
 		Evictions:    cacheMetrics.KeysEvicted(),
+		HitRatio:     cacheCounters.HitRatio(),
 	}
 }
 
@@ -189,6 +287,11 @@ type Stats struct {
 	CurrentConnections  uint64
 	TotalConnections    uint64
 	RejectedConnections uint64
+	UDPDropped          uint64
+
+	CurrentTLSConnections uint64
+	TotalTLSConnections   uint64
+	TLSHandshakeErrors    uint64
 
 	Gets    uint64
 	Sets    uint64
@@ -196,6 +299,9 @@ type Stats struct {
 	Touches uint64
 	Meta    uint64
 
+	AuthCommands uint64
+	AuthErrors   uint64
+
 	GetHits    uint64
 	GetMisses  uint64
 	GetExpired uint64
@@ -224,57 +330,262 @@ type Stats struct {
 	CurrentItems uint64
 	TotalItems   uint64
 	Evictions    uint64
+	Collisions   uint64
+	SetsDropped  uint64
+
+	BackendSetsDropped  uint64
+	BackendSetsRejected uint64
+	BackendGetsDropped  uint64
+	BackendCostEvicted  uint64
+	HitRatio            float64
+
+	Tenants []TenantStats
+}
+
+// StatValue is a single named value emitted as part of a Memcached `stats` command.
+type StatValue struct {
+	Name  string
+	Value string
+}
+
+// Values returns each of the statistics as a name and formatted value in the order
+// they are emitted by a Memcached `stats` command.
+func (s *Stats) Values() []StatValue {
+	values := []StatValue{
+		{Name: "pid", Value: fmt.Sprint(s.Pid)},
+		{Name: "uptime", Value: fmt.Sprint(s.Uptime)},
+		{Name: "time", Value: fmt.Sprint(s.ServerTime)},
+		{Name: "version", Value: s.Version},
+		{Name: "threads", Value: fmt.Sprint(s.Threads)},
+
+		{Name: "rusage_user", Value: fmt.Sprintf("%f", s.UserCPU)},
+		{Name: "rusage_system", Value: fmt.Sprintf("%f", s.SystemCPU)},
+
+		{Name: "max_connections", Value: fmt.Sprint(s.MaxConnections)},
+		{Name: "curr_connections", Value: fmt.Sprint(s.CurrentConnections)},
+		{Name: "total_connections", Value: fmt.Sprint(s.TotalConnections)},
+		{Name: "rejected_connections", Value: fmt.Sprint(s.RejectedConnections)},
+		{Name: "udp_datagrams_dropped", Value: fmt.Sprint(s.UDPDropped)},
+
+		{Name: "curr_ssl_connections", Value: fmt.Sprint(s.CurrentTLSConnections)},
+		{Name: "total_ssl_connections", Value: fmt.Sprint(s.TotalTLSConnections)},
+		{Name: "ssl_handshake_errors", Value: fmt.Sprint(s.TLSHandshakeErrors)},
+
+		{Name: "cmd_get", Value: fmt.Sprint(s.Gets)},
+		{Name: "cmd_set", Value: fmt.Sprint(s.Sets)},
+		{Name: "cmd_flush", Value: fmt.Sprint(s.Flushes)},
+		{Name: "cmd_touch", Value: fmt.Sprint(s.Touches)},
+		{Name: "cmd_meta", Value: fmt.Sprint(s.Meta)},
+
+		{Name: "auth_cmds", Value: fmt.Sprint(s.AuthCommands)},
+		{Name: "auth_errors", Value: fmt.Sprint(s.AuthErrors)},
+
+		{Name: "get_hits", Value: fmt.Sprint(s.GetHits)},
+		{Name: "get_misses", Value: fmt.Sprint(s.GetMisses)},
+		{Name: "get_expired", Value: fmt.Sprint(s.GetExpired)},
+		{Name: "get_flushed", Value: fmt.Sprint(s.GetFlushed)},
+
+		{Name: "store_too_large", Value: fmt.Sprint(s.StoreTooLarge)},
+		{Name: "store_no_memory", Value: fmt.Sprint(s.StoreNoMemory)},
+
+		{Name: "delete_hits", Value: fmt.Sprint(s.DeleteHits)},
+		{Name: "delete_misses", Value: fmt.Sprint(s.DeleteMisses)},
+
+		{Name: "incr_hits", Value: fmt.Sprint(s.IncrHits)},
+		{Name: "incr_misses", Value: fmt.Sprint(s.IncrMisses)},
+
+		{Name: "decr_hits", Value: fmt.Sprint(s.DecrHits)},
+		{Name: "decr_misses", Value: fmt.Sprint(s.DecrMisses)},
+
+		{Name: "touch_hits", Value: fmt.Sprint(s.TouchHits)},
+		{Name: "touch_misses", Value: fmt.Sprint(s.TouchMisses)},
+
+		{Name: "bytes_read", Value: fmt.Sprint(s.BytesRead)},
+		{Name: "bytes_written", Value: fmt.Sprint(s.BytesWritten)},
+		{Name: "bytes", Value: fmt.Sprint(s.Bytes)},
+		{Name: "limit_maxbytes", Value: fmt.Sprint(s.MaxBytes)},
+
+		{Name: "curr_items", Value: fmt.Sprint(s.CurrentItems)},
+		{Name: "total_items", Value: fmt.Sprint(s.TotalItems)},
+		{Name: "evictions", Value: fmt.Sprint(s.Evictions)},
+		{Name: "hash_collisions", Value: fmt.Sprint(s.Collisions)},
+		{Name: "sets_dropped", Value: fmt.Sprint(s.SetsDropped)},
+
+		{Name: "backend_sets_dropped", Value: fmt.Sprint(s.BackendSetsDropped)},
+		{Name: "backend_sets_rejected", Value: fmt.Sprint(s.BackendSetsRejected)},
+		{Name: "backend_gets_dropped", Value: fmt.Sprint(s.BackendGetsDropped)},
+		{Name: "backend_cost_evicted", Value: fmt.Sprint(s.BackendCostEvicted)},
+		{Name: "get_hit_ratio", Value: fmt.Sprintf("%f", s.HitRatio)},
+	}
+
+	for _, t := range s.Tenants {
+		prefix := "tenant:" + t.Name + ":"
+		values = append(values,
+			StatValue{Name: prefix + "get_hits", Value: fmt.Sprint(t.GetHits)},
+			StatValue{Name: prefix + "get_misses", Value: fmt.Sprint(t.GetMisses)},
+			StatValue{Name: prefix + "cmd_set", Value: fmt.Sprint(t.Sets)},
+			StatValue{Name: prefix + "bytes", Value: fmt.Sprint(t.Bytes)},
+			StatValue{Name: prefix + "limit_maxbytes", Value: fmt.Sprint(t.MaxBytes)},
+			StatValue{Name: prefix + "curr_items", Value: fmt.Sprint(t.CurrentItems)},
+			StatValue{Name: prefix + "evictions", Value: fmt.Sprint(t.Evictions)},
+			StatValue{Name: prefix + "hit_ratio", Value: fmt.Sprintf("%f", t.HitRatio)},
+		)
+	}
+
+	return values
 }
 
 func (s *Stats) MarshallMemcached(o *proto.Encoder) {
-	o.Line(fmt.Sprintf("STAT %s %d", "pid", s.Pid))
-	o.Line(fmt.Sprintf("STAT %s %d", "uptime", s.Uptime))
-	o.Line(fmt.Sprintf("STAT %s %d", "time", s.ServerTime))
-	o.Line(fmt.Sprintf("STAT %s %s", "version", s.Version))
-	o.Line(fmt.Sprintf("STAT %s %d", "threads", s.Threads))
+	values := StatValues(s.Values())
+	values.MarshallMemcached(o)
+}
+
+// StatValues are the statistics emitted as part of a Memcached `stats` command.
+type StatValues []StatValue
+
+func (v *StatValues) MarshallMemcached(o *proto.Encoder) {
+	for _, s := range *v {
+		o.Line(fmt.Sprintf("STAT %s %s", s.Name, s.Value))
+	}
+
+	o.End()
+}
+
+// newItemStats returns the statistics emitted as part of a Memcached `stats items`
+// command. There are no slab classes so each tenant is reported as a separate class,
+// numbered from one starting with the default tenant.
+func newItemStats(t *Tenants) []StatValue {
+	var values []StatValue
+	for i, tenant := range t.All() {
+		prefix := fmt.Sprintf("items:%d:", i+1)
+		usage := tenant.Cache.Usage()
+		values = append(values,
+			StatValue{Name: prefix + "number", Value: fmt.Sprint(usage.Items)},
+			StatValue{Name: prefix + "bytes", Value: fmt.Sprint(usage.Bytes)},
+			StatValue{Name: prefix + "evicted", Value: fmt.Sprint(tenant.Cache.Metrics().KeysEvicted())},
+			StatValue{Name: prefix + "outofmemory", Value: fmt.Sprint(tenant.Cache.Counters().SetsDropped.Load())},
+		)
+	}
+
+	return values
+}
 
-	o.Line(fmt.Sprintf("STAT %s %f", "rusage_user", s.UserCPU))
-	o.Line(fmt.Sprintf("STAT %s %f", "rusage_system", s.SystemCPU))
+// newSizeStats returns the statistics emitted as part of a Memcached `stats sizes`
+// command: the number of entries in all tenants by size. Each size counts entries
+// larger than half of it, up to and including it.
+func newSizeStats(t *Tenants) []StatValue {
+	counts := make(map[uint64]uint64)
+	for _, tenant := range t.All() {
+		for _, s := range tenant.Cache.Usage().Sizes {
+			counts[s.Size] += s.Count
+		}
+	}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "max_connections", s.MaxConnections))
-	o.Line(fmt.Sprintf("STAT %s %d", "curr_connections", s.CurrentConnections))
-	o.Line(fmt.Sprintf("STAT %s %d", "total_connections", s.TotalConnections))
-	o.Line(fmt.Sprintf("STAT %s %d", "rejected_connections", s.RejectedConnections))
+	sizes := make([]uint64, 0, len(counts))
+	for size := range counts {
+		sizes = append(sizes, size)
+	}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "cmd_get", s.Gets))
-	o.Line(fmt.Sprintf("STAT %s %d", "cmd_set", s.Sets))
-	o.Line(fmt.Sprintf("STAT %s %d", "cmd_flush", s.Flushes))
-	o.Line(fmt.Sprintf("STAT %s %d", "cmd_touch", s.Touches))
-	o.Line(fmt.Sprintf("STAT %s %d", "cmd_meta", s.Meta))
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i] < sizes[j]
+	})
+
+	values := make([]StatValue, 0, len(sizes))
+	for _, size := range sizes {
+		values = append(values, StatValue{Name: fmt.Sprint(size), Value: fmt.Sprint(counts[size])})
+	}
+
+	return values
+}
+
+// Settings are the effective configuration of the server emitted as part of a Memcached
+// `stats settings` command.
+type Settings struct {
+	MaxBytes        uint64
+	MaxConnections  uint64
+	ItemSizeMax     uint64
+	IdleTimeout     time.Duration
+	TCPAddress      string
+	UDPAddress      string
+	UnixPath        string
+	TLS             bool
+	Auth            bool
+	Backend         string
+	ReadYourWrites  bool
+	TenantMode      string
+	SlowThreshold   time.Duration
+	ReadBufferSize  int
+	WriteBufferSize int
+	MaxLineSize     int
+	ShutdownCommand bool
+}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "get_hits", s.GetHits))
-	o.Line(fmt.Sprintf("STAT %s %d", "get_misses", s.GetMisses))
-	o.Line(fmt.Sprintf("STAT %s %d", "get_expired", s.GetExpired))
-	o.Line(fmt.Sprintf("STAT %s %d", "get_flushed", s.GetFlushed))
+func NewSettings(cfg Config) Settings {
+	return Settings{
+		MaxBytes:        cfg.Cache.MaxSizeMb * 1024 * 1024,
+		MaxConnections:  cfg.Server.MaxConnections,
+		ItemSizeMax:     cfg.Cache.MaxItemSize,
+		IdleTimeout:     cfg.Server.IdleTimeout,
+		TCPAddress:      cfg.Server.Address,
+		UDPAddress:      cfg.UDP.Address,
+		UnixPath:        cfg.Unix.Path,
+		TLS:             cfg.Server.TLS.Enabled(),
+		Auth:            cfg.Auth.CredentialsFile != "",
+		Backend:         cfg.Cache.Backend,
+		ReadYourWrites:  cfg.Cache.ReadYourWrites,
+		TenantMode:      cfg.Tenant.Mode,
+		SlowThreshold:   cfg.SlowLog.Threshold,
+		ReadBufferSize:  readBufSize,
+		WriteBufferSize: writeBufSize,
+		MaxLineSize:     cfg.Server.MaxLineSize,
+		ShutdownCommand: cfg.Server.EnableShutdown,
+	}
+}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "store_too_large", s.StoreTooLarge))
-	o.Line(fmt.Sprintf("STAT %s %d", "store_no_memory", s.StoreNoMemory))
+// Values returns each of the settings as a name and formatted value in the order they
+// are emitted by a Memcached `stats settings` command. Listeners that aren't enabled and
+// the tenant mode when tenants aren't enabled are omitted instead of having empty values.
+func (s *Settings) Values() []StatValue {
+	values := []StatValue{
+		{Name: "maxbytes", Value: fmt.Sprint(s.MaxBytes)},
+		{Name: "maxconns", Value: fmt.Sprint(s.MaxConnections)},
+		{Name: "item_size_max", Value: fmt.Sprint(s.ItemSizeMax)},
+		{Name: "idle_timeout", Value: fmt.Sprint(uint64(s.IdleTimeout.Seconds()))},
+		{Name: "tcp_address", Value: s.TCPAddress},
+	}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "delete_hits", s.DeleteHits))
-	o.Line(fmt.Sprintf("STAT %s %d", "delete_misses", s.DeleteMisses))
+	if s.UDPAddress != "" {
+		values = append(values, StatValue{Name: "udp_address", Value: s.UDPAddress})
+	}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "incr_hits", s.IncrHits))
-	o.Line(fmt.Sprintf("STAT %s %d", "incr_misses", s.IncrMisses))
+	if s.UnixPath != "" {
+		values = append(values, StatValue{Name: "unix_path", Value: s.UnixPath})
+	}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "decr_hits", s.DecrHits))
-	o.Line(fmt.Sprintf("STAT %s %d", "decr_misses", s.DecrMisses))
+	values = append(values,
+		StatValue{Name: "ssl_enabled", Value: yesNo(s.TLS)},
+		StatValue{Name: "auth_enabled_sasl", Value: yesNo(s.Auth)},
+		StatValue{Name: "cache_backend", Value: s.Backend},
+		StatValue{Name: "read_your_writes", Value: yesNo(s.ReadYourWrites)},
+	)
 
-	o.Line(fmt.Sprintf("STAT %s %d", "touch_hits", s.TouchHits))
-	o.Line(fmt.Sprintf("STAT %s %d", "touch_misses", s.TouchMisses))
+	if s.TenantMode != TenantModeNone {
+		values = append(values, StatValue{Name: "tenant_mode", Value: s.TenantMode})
+	}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "bytes_read", s.BytesRead))
-	o.Line(fmt.Sprintf("STAT %s %d", "bytes_written", s.BytesWritten))
-	o.Line(fmt.Sprintf("STAT %s %d", "bytes", s.Bytes))
-	o.Line(fmt.Sprintf("STAT %s %d", "limit_maxbytes", s.MaxBytes))
+	return append(values,
+		StatValue{Name: "slow_command_threshold_us", Value: fmt.Sprint(s.SlowThreshold.Microseconds())},
+		StatValue{Name: "read_buf_size", Value: fmt.Sprint(s.ReadBufferSize)},
+		StatValue{Name: "write_buf_size", Value: fmt.Sprint(s.WriteBufferSize)},
+		StatValue{Name: "max_line_size", Value: fmt.Sprint(s.MaxLineSize)},
+		StatValue{Name: "shutdown_command", Value: yesNo(s.ShutdownCommand)},
+	)
+}
 
-	o.Line(fmt.Sprintf("STAT %s %d", "curr_items", s.CurrentItems))
-	o.Line(fmt.Sprintf("STAT %s %d", "total_items", s.TotalItems))
-	o.Line(fmt.Sprintf("STAT %s %d", "evictions", s.Evictions))
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
 
-	o.End()
+	return "no"
 }
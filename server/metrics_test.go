@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// statValues returns stats by name.
+func statValues(values []StatValue) map[string]string {
+	out := make(map[string]string, len(values))
+	for _, v := range values {
+		out[v.Name] = v.Value
+	}
+
+	return out
+}
+
+func TestNewStats_Accounting(t *testing.T) {
+	tenants := newTestTenants(TenantModePrefix)
+	for _, key := range []string{"a:1", "a:2", "b:3", "4"} {
+		if _, err := tenants.For(nil, key).Set(&proto.SetOp{Key: key, Bytes: []byte("value")}); err != nil {
+			t.Fatalf("unexpected error setting %s: %s", key, err)
+		}
+	}
+
+	// Replacing an entry is a set but doesn't add an item
+	if _, err := tenants.For(nil, "4").Set(&proto.SetOp{Key: "4", Bytes: []byte("value")}); err != nil {
+		t.Fatalf("unexpected error setting: %s", err)
+	}
+
+	if _, err := tenants.Get(nil, &proto.GetOp{Keys: []string{"a:1", "a:missing", "4"}}); err != nil {
+		t.Fatalf("unexpected error getting: %s", err)
+	}
+
+	stats := NewStats(tenants, NewMetrics(), RuntimeSnapshot{})
+	values := statValues(stats.Values())
+
+	expected := map[string]string{
+		"cmd_get":     "3",
+		"cmd_set":     "5",
+		"get_hits":    "2",
+		"get_misses":  "1",
+		"curr_items":  "4",
+		"total_items": "4",
+		// Bytes include the overhead of each entry that counts towards the max size
+		"bytes":                   "110",
+		"evictions":               "0",
+		"limit_maxbytes":          "19922944",
+		"get_hit_ratio":           "0.666667",
+		"tenant:a:cmd_set":        "2",
+		"tenant:a:curr_items":     "2",
+		"tenant:a:get_hits":       "1",
+		"tenant:a:get_misses":     "1",
+		"tenant:a:hit_ratio":      "0.500000",
+		"tenant:b:cmd_set":        "1",
+		"tenant:b:curr_items":     "1",
+		"tenant:b:limit_maxbytes": "2097152",
+	}
+
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, values[name])
+		}
+	}
+}
+
+func TestNewStats_Evictions(t *testing.T) {
+	tenants := newTestTenants(TenantModePrefix)
+
+	// Tenant "a" only has room for one of these
+	value := bytes.Repeat([]byte("x"), 600*1024)
+	for _, key := range []string{"a:1", "a:2"} {
+		if _, err := tenants.For(nil, key).Set(&proto.SetOp{Key: key, Bytes: value}); err != nil {
+			t.Fatalf("unexpected error setting %s: %s", key, err)
+		}
+	}
+
+	stats := NewStats(tenants, NewMetrics(), RuntimeSnapshot{})
+	values := statValues(stats.Values())
+	for name, value := range map[string]string{
+		"evictions":           "1",
+		"curr_items":          "1",
+		"total_items":         "2",
+		"tenant:a:evictions":  "1",
+		"tenant:a:curr_items": "1",
+	} {
+		if values[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, values[name])
+		}
+	}
+}
+
+func TestNewItemStats(t *testing.T) {
+	tenants := newTestTenants(TenantModePrefix)
+	for _, key := range []string{"a:1", "a:2", "4"} {
+		if _, err := tenants.For(nil, key).Set(&proto.SetOp{Key: key, Bytes: []byte("value")}); err != nil {
+			t.Fatalf("unexpected error setting %s: %s", key, err)
+		}
+	}
+
+	values := statValues(newItemStats(tenants))
+	expected := map[string]string{
+		"items:1:number":  "1",
+		"items:1:bytes":   "26",
+		"items:2:number":  "2",
+		"items:2:bytes":   "56",
+		"items:2:evicted": "0",
+		"items:3:number":  "0",
+	}
+
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, values[name])
+		}
+	}
+}
+
+func TestNewSizeStats(t *testing.T) {
+	tenants := newTestTenants(TenantModePrefix)
+	for key, size := range map[string]int{"a:1": 5, "b:2": 5, "3": 100} {
+		if _, err := tenants.For(nil, key).Set(&proto.SetOp{Key: key, Bytes: bytes.Repeat([]byte("x"), size)}); err != nil {
+			t.Fatalf("unexpected error setting %s: %s", key, err)
+		}
+	}
+
+	// Sizes are combined across tenants and sorted, smallest first
+	expected := []StatValue{{Name: "32", Value: "2"}, {Name: "128", Value: "1"}}
+	if values := newSizeStats(tenants); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected sizes %v, got %v", expected, values)
+	}
+}
+
+func TestSettings_Values(t *testing.T) {
+	settings := Settings{
+		MaxBytes:       1024,
+		MaxConnections: 10,
+		ItemSizeMax:    512,
+		IdleTimeout:    time.Minute,
+		TCPAddress:     "localhost:11211",
+		Backend:        "lru",
+		SlowThreshold:  time.Millisecond,
+	}
+
+	values := statValues(settings.Values())
+	expected := map[string]string{
+		"maxbytes":                  "1024",
+		"maxconns":                  "10",
+		"item_size_max":             "512",
+		"idle_timeout":              "60",
+		"tcp_address":               "localhost:11211",
+		"ssl_enabled":               "no",
+		"cache_backend":             "lru",
+		"slow_command_threshold_us": "1000",
+	}
+
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, values[name])
+		}
+	}
+
+	// Listeners and tenants that aren't enabled aren't included
+	for _, name := range []string{"udp_address", "unix_path", "tenant_mode"} {
+		if _, ok := values[name]; ok {
+			t.Errorf("expected %s not to be included", name)
+		}
+	}
+}
+
+func TestMetrics_Reset(t *testing.T) {
+	m := NewMetrics()
+	m.CurrentConnections.Store(2)
+	m.TotalConnections.Store(5)
+	m.BytesRead.Store(100)
+	m.StoreTooLarge.Store(1)
+
+	m.Reset()
+
+	if current := m.CurrentConnections.Load(); current != 2 {
+		t.Errorf("expected current connections not to be reset, got %d", current)
+	}
+
+	if total, read, tooLarge := m.TotalConnections.Load(), m.BytesRead.Load(), m.StoreTooLarge.Load(); total != 0 || read != 0 || tooLarge != 0 {
+		t.Errorf("expected counters to be reset, got %d, %d, %d", total, read, tooLarge)
+	}
+}
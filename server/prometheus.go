@@ -0,0 +1,368 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/56quarters/jankcache/server/cache"
+)
+
+const namespace = "jankcache"
+
+// Phases of running a command, in the order they happen.
+const (
+	phaseParse   = "parse"
+	phaseExecute = "execute"
+	phaseEncode  = "encode"
+)
+
+var (
+	phases = []string{phaseParse, phaseExecute, phaseEncode}
+
+	// commandBuckets are histogram buckets from 10µs to about 1.3s.
+	commandBuckets = prometheus.ExponentialBuckets(0.00001, 2, 18)
+
+	// latencyQuantiles are the quantiles of each phase of each command included in
+	// the latency statistics.
+	latencyQuantiles = []float64{0.5, 0.9, 0.99}
+)
+
+// CommandMetrics are Prometheus metrics for each command run by Handler.
+type CommandMetrics struct {
+	commands *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	phases   *prometheus.HistogramVec
+}
+
+func NewCommandMetrics(reg prometheus.Registerer) *CommandMetrics {
+	m := &CommandMetrics{
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Total number of commands run, by command.",
+		}, []string{"command"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_duration_seconds",
+			Help:      "Time spent running commands, from being read until the response is written, by command.",
+			Buckets:   commandBuckets,
+		}, []string{"command"}),
+		phases: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_phase_duration_seconds",
+			Help:      "Time spent parsing, executing, and encoding the response to commands, by command and phase.",
+			Buckets:   commandBuckets,
+		}, []string{"command", "phase"}),
+	}
+
+	reg.MustRegister(m.commands, m.duration, m.phases)
+	return m
+}
+
+// Observe records how long each phase of running a command took if it ended at end.
+func (m *CommandMetrics) Observe(cmd *command, end time.Time) {
+	name := cmd.op.Type().String()
+	parse, execute, encode := cmd.phases(end)
+
+	m.commands.WithLabelValues(name).Inc()
+	m.duration.WithLabelValues(name).Observe(end.Sub(cmd.start).Seconds())
+	m.phases.WithLabelValues(name, phaseParse).Observe(parse.Seconds())
+	m.phases.WithLabelValues(name, phaseExecute).Observe(execute.Seconds())
+	m.phases.WithLabelValues(name, phaseEncode).Observe(encode.Seconds())
+}
+
+// Latencies returns the number of times each command has been run along with the
+// average and estimated quantiles, in microseconds, of the time spent in each phase.
+func (m *CommandMetrics) Latencies() []StatValue {
+	type latency struct {
+		command string
+		phase   int
+		hist    *dto.Histogram
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		m.phases.Collect(ch)
+		close(ch)
+	}()
+
+	var latencies []latency
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+
+		l := latency{hist: pb.GetHistogram()}
+		for _, pair := range pb.GetLabel() {
+			switch pair.GetName() {
+			case "command":
+				l.command = pair.GetValue()
+			case "phase":
+				for i, p := range phases {
+					if p == pair.GetValue() {
+						l.phase = i
+					}
+				}
+			}
+		}
+
+		latencies = append(latencies, l)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		if latencies[i].command != latencies[j].command {
+			return latencies[i].command < latencies[j].command
+		}
+
+		return latencies[i].phase < latencies[j].phase
+	})
+
+	var values []StatValue
+	for _, l := range latencies {
+		prefix := l.command + ":" + phases[l.phase] + ":"
+		count := l.hist.GetSampleCount()
+
+		var avg float64
+		if count > 0 {
+			avg = l.hist.GetSampleSum() / float64(count)
+		}
+
+		values = append(values,
+			StatValue{Name: prefix + "count", Value: fmt.Sprint(count)},
+			StatValue{Name: prefix + "avg_us", Value: fmt.Sprintf("%.1f", avg*1e6)},
+		)
+
+		for _, q := range latencyQuantiles {
+			values = append(values, StatValue{
+				Name:  fmt.Sprintf("%sp%g_us", prefix, q*100),
+				Value: fmt.Sprintf("%.1f", quantile(q, l.hist)*1e6),
+			})
+		}
+	}
+
+	return values
+}
+
+// quantile estimates the q-quantile of a histogram by interpolating linearly within the
+// bucket it falls in, the same way as PromQL histogram_quantile. Observations larger than
+// the largest bucket are estimated as the upper bound of the largest bucket.
+func quantile(q float64, h *dto.Histogram) float64 {
+	rank := q * float64(h.GetSampleCount())
+	if rank == 0 {
+		return 0
+	}
+
+	var lower, prev float64
+	for _, b := range h.GetBucket() {
+		upper, count := b.GetUpperBound(), float64(b.GetCumulativeCount())
+		if count >= rank {
+			return lower + (upper-lower)*(rank-prev)/(count-prev)
+		}
+
+		lower, prev = upper, count
+	}
+
+	return lower
+}
+
+// serverMetric is a Prometheus metric whose value is read from Metrics.
+type serverMetric struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(m *Metrics) float64
+}
+
+func newServerMetric(name string, help string, valueType prometheus.ValueType, value func(m *Metrics) float64) serverMetric {
+	return serverMetric{
+		desc:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, nil, nil),
+		valueType: valueType,
+		value:     value,
+	}
+}
+
+// cacheMetric is a Prometheus metric whose value is read from the cache of each tenant.
+type cacheMetric struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(c *cache.Cache) float64
+}
+
+func newCacheMetric(name string, help string, valueType prometheus.ValueType, value func(c *cache.Cache) float64) cacheMetric {
+	return cacheMetric{
+		desc:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, []string{"tenant"}, nil),
+		valueType: valueType,
+		value:     value,
+	}
+}
+
+// Collector exports Metrics, the metrics of the cache of each tenant, and runtime
+// information as Prometheus metrics. Values are read each time metrics are collected.
+type Collector struct {
+	tenants *Tenants
+	metrics *Metrics
+	rtCtx   *RuntimeContext
+
+	info      *prometheus.Desc
+	uptime    *prometheus.Desc
+	time      *prometheus.Desc
+	userCPU   *prometheus.Desc
+	systemCPU *prometheus.Desc
+	threads   *prometheus.Desc
+
+	server []serverMetric
+	caches []cacheMetric
+}
+
+func NewCollector(tenants *Tenants, metrics *Metrics, rtCtx *RuntimeContext) *Collector {
+	return &Collector{
+		tenants: tenants,
+		metrics: metrics,
+		rtCtx:   rtCtx,
+
+		info:      prometheus.NewDesc(namespace+"_info", "Version and process ID of the server.", []string{"version", "pid"}, nil),
+		uptime:    prometheus.NewDesc(namespace+"_uptime_seconds", "Number of seconds since the server started.", nil, nil),
+		time:      prometheus.NewDesc(namespace+"_time_seconds", "Current time according to the server as a UNIX timestamp.", nil, nil),
+		userCPU:   prometheus.NewDesc(namespace+"_rusage_user_seconds_total", "Total user CPU time used by the server.", nil, nil),
+		systemCPU: prometheus.NewDesc(namespace+"_rusage_system_seconds_total", "Total system CPU time used by the server.", nil, nil),
+		threads:   prometheus.NewDesc(namespace+"_threads", "Number of threads used to run commands.", nil, nil),
+
+		server: []serverMetric{
+			newServerMetric("connections_current", "Number of open client connections.", prometheus.GaugeValue, func(m *Metrics) float64 {
+				return float64(m.CurrentConnections.Load())
+			}),
+			newServerMetric("connections_max", "Max number of open client connections.", prometheus.GaugeValue, func(m *Metrics) float64 {
+				return float64(m.MaxConnections.Load())
+			}),
+			newServerMetric("connections_total", "Total number of client connections accepted.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.TotalConnections.Load())
+			}),
+			newServerMetric("connections_rejected_total", "Total number of client connections rejected for exceeding the max.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.RejectedConnections.Load())
+			}),
+			newServerMetric("udp_datagrams_dropped_total", "Total number of UDP datagrams dropped for exceeding the max number of requests.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.UDPDropped.Load())
+			}),
+			newServerMetric("tls_connections_current", "Number of open client connections using TLS.", prometheus.GaugeValue, func(m *Metrics) float64 {
+				return float64(m.CurrentTLSConnections.Load())
+			}),
+			newServerMetric("tls_connections_total", "Total number of client connections using TLS.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.TotalTLSConnections.Load())
+			}),
+			newServerMetric("tls_handshake_errors_total", "Total number of failed TLS handshakes.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.TLSHandshakeErrors.Load())
+			}),
+			newServerMetric("read_bytes_total", "Total number of bytes read from clients.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.BytesRead.Load())
+			}),
+			newServerMetric("written_bytes_total", "Total number of bytes written to clients.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.BytesWritten.Load())
+			}),
+			newServerMetric("meta_commands_total", "Total number of meta commands run.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.MetaCommands.Load())
+			}),
+			newServerMetric("auth_commands_total", "Total number of authentication attempts.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.AuthCommands.Load())
+			}),
+			newServerMetric("auth_errors_total", "Total number of failed authentication attempts.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.AuthErrors.Load())
+			}),
+			newServerMetric("store_too_large_total", "Total number of items rejected for exceeding the max item size.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.StoreTooLarge.Load())
+			}),
+			newServerMetric("store_no_memory_total", "Total number of items that could not be stored.", prometheus.CounterValue, func(m *Metrics) float64 {
+				return float64(m.StoreNoMemory.Load())
+			}),
+		},
+
+		caches: []cacheMetric{
+			newCacheMetric("hits_total", "Total number of gets for entries that exist.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Counters().GetHits.Load())
+			}),
+			newCacheMetric("misses_total", "Total number of gets for entries that don't exist.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Counters().GetMisses.Load())
+			}),
+			newCacheMetric("hit_ratio", "Ratio of hits to all gets.", prometheus.GaugeValue, func(c *cache.Cache) float64 {
+				return c.Counters().HitRatio()
+			}),
+			newCacheMetric("sets_total", "Total number of storage commands run, whether or not they stored an entry.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Counters().Sets.Load())
+			}),
+			newCacheMetric("gets_dropped_total", "Total number of gets not counted by the backend.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().GetsDropped())
+			}),
+			newCacheMetric("keys_added_total", "Total number of new entries stored.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().KeysAdded())
+			}),
+			newCacheMetric("keys_updated_total", "Total number of existing entries replaced.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().KeysUpdated())
+			}),
+			newCacheMetric("keys_evicted_total", "Total number of entries evicted to make room for others. Includes entries deleted or expired with the ristretto backend.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().KeysEvicted())
+			}),
+			newCacheMetric("cost_added_bytes_total", "Total cost of entries stored.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().CostAdded())
+			}),
+			newCacheMetric("cost_evicted_bytes_total", "Total cost of entries evicted to make room for others. Includes entries deleted, expired, or replaced with the ristretto backend.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().CostEvicted())
+			}),
+			newCacheMetric("sets_dropped_total", "Total number of sets dropped by the backend before being stored.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().SetsDropped())
+			}),
+			newCacheMetric("sets_rejected_total", "Total number of sets rejected by the backend admission policy.", prometheus.CounterValue, func(c *cache.Cache) float64 {
+				return float64(c.Metrics().SetsRejected())
+			}),
+			newCacheMetric("items", "Number of entries stored, including entries invalidated by flush_all that haven't been removed yet.", prometheus.GaugeValue, func(c *cache.Cache) float64 {
+				return float64(c.Usage().Items)
+			}),
+			newCacheMetric("bytes", "Total cost of entries stored.", prometheus.GaugeValue, func(c *cache.Cache) float64 {
+				return float64(c.Usage().Bytes)
+			}),
+			newCacheMetric("max_bytes", "Max total cost of entries stored.", prometheus.GaugeValue, func(c *cache.Cache) float64 {
+				return float64(c.MaxBytes())
+			}),
+		},
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.uptime
+	ch <- c.time
+	ch <- c.userCPU
+	ch <- c.systemCPU
+	ch <- c.threads
+
+	for _, m := range c.server {
+		ch <- m.desc
+	}
+
+	for _, m := range c.caches {
+		ch <- m.desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	snapshot := c.rtCtx.Read()
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, version, strconv.Itoa(snapshot.Pid))
+	ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, float64(snapshot.Uptime))
+	ch <- prometheus.MustNewConstMetric(c.time, prometheus.GaugeValue, float64(snapshot.Time))
+	ch <- prometheus.MustNewConstMetric(c.userCPU, prometheus.CounterValue, snapshot.UserCPU)
+	ch <- prometheus.MustNewConstMetric(c.systemCPU, prometheus.CounterValue, snapshot.SystemCPU)
+	ch <- prometheus.MustNewConstMetric(c.threads, prometheus.GaugeValue, float64(snapshot.Threads))
+
+	for _, m := range c.server {
+		ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, m.value(c.metrics))
+	}
+
+	for _, t := range c.tenants.All() {
+		for _, m := range c.caches {
+			ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, m.value(t.Cache), t.Name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// scrape returns the metrics exposed by a debug server for the registry.
+func scrape(t *testing.T, reg *prometheus.Registry) string {
+	t.Helper()
+
+	s := NewDebugServer(DebugConfig{}, reg, NewConnections(), log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading metrics: %s", err)
+	}
+
+	return string(body)
+}
+
+func TestDebugServer_Metrics(t *testing.T) {
+	h := newTestHandler()
+	reg := prometheus.NewRegistry()
+	h.commands = NewCommandMetrics(reg)
+	reg.MustRegister(NewCollector(h.tenants, h.metrics, h.rtCtx))
+
+	serve(t, h, &chunkedConn{chunks: []string{"set a 0 0 1\r\n1\r\nget a\r\nget b\r\nmn\r\n"}})
+	out := scrape(t, reg)
+
+	for _, expected := range []string{
+		`jankcache_cache_hits_total{tenant=""} 1`,
+		`jankcache_cache_misses_total{tenant=""} 1`,
+		`jankcache_cache_sets_total{tenant=""} 1`,
+		`jankcache_cache_items{tenant=""} 1`,
+		`jankcache_cache_max_bytes{tenant=""} 1.6777216e+07`,
+		`jankcache_meta_commands_total 1`,
+		`jankcache_commands_total{command="get"} 2`,
+		`jankcache_commands_total{command="set"} 1`,
+		`jankcache_command_duration_seconds_count{command="get"} 2`,
+		`jankcache_command_phase_duration_seconds_count{command="get",phase="execute"} 2`,
+		`jankcache_uptime_seconds `,
+		`jankcache_info{pid="`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected metrics to include %q", expected)
+		}
+	}
+}
+
+func TestCollector_Tenants(t *testing.T) {
+	tenants := newTestTenants(TenantModePrefix)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(tenants, NewMetrics(), NewRuntimeContext()))
+
+	out := scrape(t, reg)
+	for _, expected := range []string{
+		`jankcache_cache_max_bytes{tenant=""} 1.6777216e+07`,
+		`jankcache_cache_max_bytes{tenant="a"} 1.048576e+06`,
+		`jankcache_cache_max_bytes{tenant="b"} 2.097152e+06`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected metrics to include %q", expected)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test", Buckets: []float64{1, 2, 4}})
+	var pb dto.Metric
+	if err := hist.Write(&pb); err != nil {
+		t.Fatalf("unexpected error writing histogram: %s", err)
+	}
+
+	if q := quantile(0.5, pb.GetHistogram()); q != 0 {
+		t.Errorf("expected 0 for an empty histogram, got %g", q)
+	}
+
+	for _, v := range []float64{0.5, 1.5, 1.5, 3, 10} {
+		hist.Observe(v)
+	}
+
+	if err := hist.Write(&pb); err != nil {
+		t.Fatalf("unexpected error writing histogram: %s", err)
+	}
+
+	tests := []struct {
+		q        float64
+		expected float64
+	}{
+		{q: 0.2, expected: 1},
+		{q: 0.5, expected: 1.75},
+		{q: 0.7, expected: 3},
+		{q: 0.99, expected: 4},
+	}
+
+	for _, tc := range tests {
+		if q := quantile(tc.q, pb.GetHistogram()); q != tc.expected {
+			t.Errorf("expected %g for quantile %g, got %g", tc.expected, tc.q, q)
+		}
+	}
+}
+
+func TestCommandMetrics_Latencies(t *testing.T) {
+	m := NewCommandMetrics(prometheus.NewRegistry())
+	start := time.Now()
+
+	m.Observe(slowCommand(&proto.SetOp{}, start, 0, time.Millisecond, 0))
+	m.Observe(slowCommand(&proto.GetOp{}, start, 0, time.Millisecond, 0))
+	m.Observe(slowCommand(&proto.GetOp{}, start, 0, 3*time.Millisecond, 0))
+
+	var names []string
+	values := make(map[string]string)
+	for _, v := range m.Latencies() {
+		names = append(names, v.Name)
+		values[v.Name] = v.Value
+	}
+
+	if len(names) != 2*3*5 || names[0] != "get:parse:count" || names[len(names)-1] != "set:encode:p99_us" {
+		t.Errorf("expected latencies sorted by command and phase, got %v", names)
+	}
+
+	expected := map[string]string{
+		"get:execute:count":  "2",
+		"get:execute:avg_us": "2000.0",
+		"get:execute:p50_us": "1280.0",
+		"get:parse:count":    "2",
+		"get:parse:avg_us":   "0.0",
+		"set:execute:count":  "1",
+		"set:execute:p50_us": "960.0",
+	}
+
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, values[name])
+		}
+	}
+}
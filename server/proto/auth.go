@@ -0,0 +1,50 @@
+package proto
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/56quarters/jankcache/server/core"
+)
+
+// SaslMechPlain is the only SASL mechanism supported for authentication.
+const SaslMechPlain = "PLAIN"
+
+type SaslAuthOp struct {
+	Username string
+	Password string
+}
+
+func (SaslAuthOp) Type() OpType {
+	return OpTypeSaslAuth
+}
+
+type SaslListMechsOp struct{}
+
+func (SaslListMechsOp) Type() OpType {
+	return OpTypeSaslListMechs
+}
+
+// TextAuth converts a text protocol "set" command into an authentication request
+// following the memcached convention that the first "set" of an unauthenticated
+// connection carries "username password" as its payload. The key, flags, and
+// expiration are ignored.
+func TextAuth(op *SetOp) (*SaslAuthOp, error) {
+	parts := strings.Fields(string(op.Bytes))
+	if len(parts) != 2 {
+		return nil, core.ErrAuthFailed
+	}
+
+	return &SaslAuthOp{Username: parts[0], Password: parts[1]}, nil
+}
+
+// parseSaslPlain parses the data of a SASL PLAIN request, made up of an optional
+// authorization identity, username, and password separated by NUL bytes.
+func parseSaslPlain(data []byte) (*SaslAuthOp, error) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return nil, core.ClientError("bad SASL PLAIN data")
+	}
+
+	return &SaslAuthOp{Username: string(parts[1]), Password: string(parts[2])}, nil
+}
@@ -0,0 +1,415 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/56quarters/jankcache/server/core"
+)
+
+const (
+	BinaryMagicRequest  = 0x80
+	BinaryMagicResponse = 0x81
+
+	binaryHeaderSize = 24
+	binaryNoVivify   = math.MaxUint32
+)
+
+// BinaryOpcode is the command of a binary protocol request.
+type BinaryOpcode uint8
+
+const (
+	BinaryOpGet        BinaryOpcode = 0x00
+	BinaryOpSet        BinaryOpcode = 0x01
+	BinaryOpAdd        BinaryOpcode = 0x02
+	BinaryOpReplace    BinaryOpcode = 0x03
+	BinaryOpDelete     BinaryOpcode = 0x04
+	BinaryOpIncrement  BinaryOpcode = 0x05
+	BinaryOpDecrement  BinaryOpcode = 0x06
+	BinaryOpQuit       BinaryOpcode = 0x07
+	BinaryOpFlush      BinaryOpcode = 0x08
+	BinaryOpGetQ       BinaryOpcode = 0x09
+	BinaryOpNoOp       BinaryOpcode = 0x0a
+	BinaryOpVersion    BinaryOpcode = 0x0b
+	BinaryOpGetK       BinaryOpcode = 0x0c
+	BinaryOpGetKQ      BinaryOpcode = 0x0d
+	BinaryOpAppend     BinaryOpcode = 0x0e
+	BinaryOpPrepend    BinaryOpcode = 0x0f
+	BinaryOpStat       BinaryOpcode = 0x10
+	BinaryOpSetQ       BinaryOpcode = 0x11
+	BinaryOpAddQ       BinaryOpcode = 0x12
+	BinaryOpReplaceQ   BinaryOpcode = 0x13
+	BinaryOpDeleteQ    BinaryOpcode = 0x14
+	BinaryOpIncrementQ BinaryOpcode = 0x15
+	BinaryOpDecrementQ BinaryOpcode = 0x16
+	BinaryOpQuitQ      BinaryOpcode = 0x17
+	BinaryOpFlushQ     BinaryOpcode = 0x18
+	BinaryOpAppendQ    BinaryOpcode = 0x19
+	BinaryOpPrependQ   BinaryOpcode = 0x1a
+	BinaryOpTouch      BinaryOpcode = 0x1c
+	BinaryOpGat        BinaryOpcode = 0x1d
+	BinaryOpGatQ       BinaryOpcode = 0x1e
+	BinaryOpSaslList   BinaryOpcode = 0x20
+	BinaryOpSaslAuth   BinaryOpcode = 0x21
+	BinaryOpSaslStep   BinaryOpcode = 0x22
+	BinaryOpGatK       BinaryOpcode = 0x23
+	BinaryOpGatKQ      BinaryOpcode = 0x24
+)
+
+// Quiet returns true if responses for this opcode should only be sent when there is
+// an error (or a miss, for the get variants).
+func (o BinaryOpcode) Quiet() bool {
+	switch o {
+	case BinaryOpGetQ, BinaryOpGetKQ, BinaryOpSetQ, BinaryOpAddQ, BinaryOpReplaceQ, BinaryOpDeleteQ,
+		BinaryOpIncrementQ, BinaryOpDecrementQ, BinaryOpQuitQ, BinaryOpFlushQ, BinaryOpAppendQ,
+		BinaryOpPrependQ, BinaryOpGatQ, BinaryOpGatKQ:
+		return true
+	}
+
+	return false
+}
+
+// ReturnKey returns true if the key should be included in responses for this opcode.
+func (o BinaryOpcode) ReturnKey() bool {
+	return o == BinaryOpGetK || o == BinaryOpGetKQ || o == BinaryOpGatK || o == BinaryOpGatKQ
+}
+
+// BinaryStatus is the result of a binary protocol request.
+type BinaryStatus uint16
+
+const (
+	BinaryStatusOk             BinaryStatus = 0x0000
+	BinaryStatusNotFound       BinaryStatus = 0x0001
+	BinaryStatusExists         BinaryStatus = 0x0002
+	BinaryStatusTooLarge       BinaryStatus = 0x0003
+	BinaryStatusInvalid        BinaryStatus = 0x0004
+	BinaryStatusNotStored      BinaryStatus = 0x0005
+	BinaryStatusNonNumeric     BinaryStatus = 0x0006
+	BinaryStatusAuthError      BinaryStatus = 0x0020
+	BinaryStatusUnknownCommand BinaryStatus = 0x0081
+	BinaryStatusNoMemory       BinaryStatus = 0x0082
+	BinaryStatusInternalError  BinaryStatus = 0x0084
+)
+
+// BinaryHeader is the fixed size header at the start of every binary protocol
+// request or response. The VBucket field of requests is used for the status of
+// responses.
+type BinaryHeader struct {
+	Magic        uint8
+	Opcode       BinaryOpcode
+	KeyLength    uint16
+	ExtrasLength uint8
+	DataType     uint8
+	VBucket      uint16
+	BodyLength   uint32
+	Opaque       uint32
+	Cas          uint64
+}
+
+// BinaryRequest is a binary protocol request header along with its body, split
+// into extras, key, and value.
+type BinaryRequest struct {
+	Header BinaryHeader
+	Extras []byte
+	Key    []byte
+	Value  []byte
+}
+
+// ParseBinary reads a single binary protocol request and converts it into an
+// equivalent Op. If an error is returned with a nil request, the request could
+// not be read and the connection is not usable. If an error is returned with a
+// non-nil request, the request was invalid and an error should be sent to the
+// client in response.
+func (p *Parser) ParseBinary(payload io.Reader) (*BinaryRequest, Op, error) {
+	header, err := readBinaryHeader(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := &BinaryRequest{Header: header}
+	bodyLength := uint64(header.BodyLength)
+	if bodyLength < uint64(header.KeyLength)+uint64(header.ExtrasLength) {
+		return nil, nil, fmt.Errorf("invalid body length %d for key length %d and extras length %d",
+			header.BodyLength, header.KeyLength, header.ExtrasLength)
+	}
+
+	valueLength := bodyLength - uint64(header.KeyLength) - uint64(header.ExtrasLength)
+	if valueLength > p.maxItemSize {
+		return req, nil, swallowBinary(payload, bodyLength, core.ErrObjectTooLarge)
+	}
+
+	body := make([]byte, bodyLength)
+	if n, err := io.ReadFull(payload, body); err != nil {
+		return nil, nil, fmt.Errorf("unable to read %d body bytes, only read %d: %w", bodyLength, n, err)
+	}
+
+	req.Extras = body[:header.ExtrasLength]
+	req.Key = body[header.ExtrasLength : uint32(header.ExtrasLength)+uint32(header.KeyLength)]
+	req.Value = body[uint32(header.ExtrasLength)+uint32(header.KeyLength):]
+
+	op, err := p.binaryOp(req)
+	return req, op, err
+}
+
+func (p *Parser) binaryOp(req *BinaryRequest) (Op, error) {
+	switch req.Header.Opcode {
+	case BinaryOpGet, BinaryOpGetQ, BinaryOpGetK, BinaryOpGetKQ:
+		key, err := req.validate(0, true, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return &GetOp{Keys: []string{key}, Unique: true}, nil
+	case BinaryOpSet, BinaryOpSetQ, BinaryOpAdd, BinaryOpAddQ, BinaryOpReplace, BinaryOpReplaceQ:
+		key, err := req.validate(8, true, true)
+		if err != nil {
+			return nil, err
+		}
+
+		flags := binary.BigEndian.Uint32(req.Extras[0:4])
+		expire := int64(binary.BigEndian.Uint32(req.Extras[4:8]))
+
+		switch {
+		case req.Header.Cas != 0 && req.Header.Opcode != BinaryOpAdd && req.Header.Opcode != BinaryOpAddQ:
+			// Set or replace with a CAS value are both "cas" since the key must exist
+			return &CasOp{Key: key, Flags: flags, Expire: expire, Unique: req.Header.Cas, Bytes: req.Value}, nil
+		case req.Header.Opcode == BinaryOpAdd || req.Header.Opcode == BinaryOpAddQ:
+			return &AddOp{Key: key, Flags: flags, Expire: expire, Bytes: req.Value}, nil
+		case req.Header.Opcode == BinaryOpReplace || req.Header.Opcode == BinaryOpReplaceQ:
+			return &ReplaceOp{Key: key, Flags: flags, Expire: expire, Bytes: req.Value}, nil
+		default:
+			return &SetOp{Key: key, Flags: flags, Expire: expire, Bytes: req.Value}, nil
+		}
+	case BinaryOpAppend, BinaryOpAppendQ, BinaryOpPrepend, BinaryOpPrependQ:
+		key, err := req.validate(0, true, true)
+		if err != nil {
+			return nil, err
+		}
+
+		prepend := req.Header.Opcode == BinaryOpPrepend || req.Header.Opcode == BinaryOpPrependQ
+		if req.Header.Cas != 0 {
+			// Only meta commands can compare CAS values when appending or prepending
+			op := &MetaSetOp{Key: key, CompareCas: req.Header.Cas, Mode: MetaSetModeAppend, Bytes: req.Value}
+			if prepend {
+				op.Mode = MetaSetModePrepend
+			}
+
+			return op, nil
+		}
+
+		if prepend {
+			return &PrependOp{Key: key, Bytes: req.Value}, nil
+		}
+
+		return &AppendOp{Key: key, Bytes: req.Value}, nil
+	case BinaryOpDelete, BinaryOpDeleteQ:
+		key, err := req.validate(0, true, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Header.Cas != 0 {
+			return &MetaDeleteOp{Key: key, CompareCas: req.Header.Cas}, nil
+		}
+
+		return &DeleteOp{Key: key}, nil
+	case BinaryOpIncrement, BinaryOpIncrementQ, BinaryOpDecrement, BinaryOpDecrementQ:
+		key, err := req.validate(20, true, false)
+		if err != nil {
+			return nil, err
+		}
+
+		expire := binary.BigEndian.Uint32(req.Extras[16:20])
+		op := &MetaArithmeticOp{
+			Key:          key,
+			CompareCas:   req.Header.Cas,
+			Delta:        binary.BigEndian.Uint64(req.Extras[0:8]),
+			Initial:      binary.BigEndian.Uint64(req.Extras[8:16]),
+			AutoVivify:   expire != binaryNoVivify,
+			VivifyExpire: int64(expire),
+		}
+
+		if req.Header.Opcode == BinaryOpDecrement || req.Header.Opcode == BinaryOpDecrementQ {
+			op.Mode = MetaArithmeticDecr
+		}
+
+		return op, nil
+	case BinaryOpTouch:
+		key, err := req.validate(4, true, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return &TouchOp{Key: key, Expire: int64(binary.BigEndian.Uint32(req.Extras))}, nil
+	case BinaryOpGat, BinaryOpGatQ, BinaryOpGatK, BinaryOpGatKQ:
+		key, err := req.validate(4, true, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return &GatOp{Keys: []string{key}, Expire: int64(binary.BigEndian.Uint32(req.Extras)), Unique: true}, nil
+	case BinaryOpFlush, BinaryOpFlushQ:
+		if len(req.Extras) != 0 && len(req.Extras) != 4 {
+			return nil, core.ClientError("invalid extras length %d", len(req.Extras))
+		}
+
+		op := &FlushAllOp{}
+		if len(req.Extras) == 4 {
+			op.Delay = int64(binary.BigEndian.Uint32(req.Extras))
+		}
+
+		return op, nil
+	case BinaryOpNoOp:
+		return MetaNoOpOp{}, nil
+	case BinaryOpQuit, BinaryOpQuitQ:
+		return QuitOp{}, nil
+	case BinaryOpSaslList:
+		return SaslListMechsOp{}, nil
+	case BinaryOpSaslAuth, BinaryOpSaslStep:
+		// PLAIN is the only supported mechanism and it never needs more than a
+		// single step so both are treated the same way.
+		if _, err := req.validate(0, true, true); err != nil {
+			return nil, err
+		}
+
+		if string(req.Key) != SaslMechPlain {
+			return nil, core.ClientError("unsupported SASL mechanism '%s'", req.Key)
+		}
+
+		return parseSaslPlain(req.Value)
+	case BinaryOpStat:
+		return newStatsOp(string(req.Key))
+	case BinaryOpVersion:
+		return VersionOp{}, nil
+	}
+
+	return nil, core.ErrBadCommand
+}
+
+// validate checks that the request has the expected extras, a key if required, and
+// a value only if allowed, returning the key.
+func (r *BinaryRequest) validate(extras int, key bool, value bool) (string, error) {
+	if len(r.Extras) != extras {
+		return "", core.ClientError("invalid extras length %d, expected %d", len(r.Extras), extras)
+	}
+
+	if key {
+		if _, err := validateKeyLength(string(r.Key)); err != nil {
+			return "", core.ClientError("bad key: %s", err)
+		}
+	} else if len(r.Key) != 0 {
+		return "", core.ClientError("unexpected key")
+	}
+
+	if !value && len(r.Value) != 0 {
+		return "", core.ClientError("unexpected value")
+	}
+
+	return string(r.Key), nil
+}
+
+func readBinaryHeader(payload io.Reader) (BinaryHeader, error) {
+	var buf [binaryHeaderSize]byte
+	if _, err := io.ReadFull(payload, buf[:]); err != nil {
+		return BinaryHeader{}, err
+	}
+
+	if buf[0] != BinaryMagicRequest {
+		return BinaryHeader{}, fmt.Errorf("invalid magic byte 0x%02x", buf[0])
+	}
+
+	return BinaryHeader{
+		Magic:        buf[0],
+		Opcode:       BinaryOpcode(buf[1]),
+		KeyLength:    binary.BigEndian.Uint16(buf[2:4]),
+		ExtrasLength: buf[4],
+		DataType:     buf[5],
+		VBucket:      binary.BigEndian.Uint16(buf[6:8]),
+		BodyLength:   binary.BigEndian.Uint32(buf[8:12]),
+		Opaque:       binary.BigEndian.Uint32(buf[12:16]),
+		Cas:          binary.BigEndian.Uint64(buf[16:24]),
+	}, nil
+}
+
+// swallowBinary discards the body of a binary request that has been rejected
+// so that the next request can be read.
+func swallowBinary(payload io.Reader, length uint64, err error) error {
+	if n, cErr := io.CopyN(io.Discard, payload, int64(length)); cErr != nil {
+		return core.ServerError("unable to discard %d body bytes, only discarded %d: %s", length, n, cErr)
+	}
+
+	return err
+}
+
+// BinaryEncoder writes binary protocol responses.
+type BinaryEncoder struct {
+	writer io.Writer
+}
+
+func NewBinaryEncoder(writer io.Writer) *BinaryEncoder {
+	return &BinaryEncoder{
+		writer: writer,
+	}
+}
+
+// Response writes a response to req with the given status and body.
+func (e *BinaryEncoder) Response(req *BinaryHeader, status BinaryStatus, cas uint64, extras []byte, key []byte, value []byte) *BinaryEncoder {
+	var buf [binaryHeaderSize]byte
+	buf[0] = BinaryMagicResponse
+	buf[1] = byte(req.Opcode)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(buf[6:8], uint16(status))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], req.Opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+
+	_, _ = e.writer.Write(buf[:])
+	_, _ = e.writer.Write(extras)
+	_, _ = e.writer.Write(key)
+	_, _ = e.writer.Write(value)
+	return e
+}
+
+// Ok writes an empty successful response to req, with a CAS value if non-zero.
+func (e *BinaryEncoder) Ok(req *BinaryHeader, cas uint64) *BinaryEncoder {
+	return e.Response(req, BinaryStatusOk, cas, nil, nil, nil)
+}
+
+// Error writes a response to req with a status based on err and the error message
+// as the body.
+func (e *BinaryEncoder) Error(req *BinaryHeader, err error) *BinaryEncoder {
+	return e.Response(req, BinaryStatusFor(err), 0, nil, nil, []byte(err.Error()))
+}
+
+// BinaryStatusFor returns the binary protocol status for an error returned while
+// parsing or executing a command.
+func BinaryStatusFor(err error) BinaryStatus {
+	switch {
+	case err == nil:
+		return BinaryStatusOk
+	case errors.Is(err, core.ErrNotFound):
+		return BinaryStatusNotFound
+	case errors.Is(err, core.ErrExists):
+		return BinaryStatusExists
+	case errors.Is(err, core.ErrObjectTooLarge):
+		return BinaryStatusTooLarge
+	case errors.Is(err, core.ErrNoMemory):
+		return BinaryStatusNoMemory
+	case errors.Is(err, core.ErrNotStored):
+		return BinaryStatusNotStored
+	case errors.Is(err, core.ErrNonNumeric):
+		return BinaryStatusNonNumeric
+	case errors.Is(err, core.ErrAuthFailed), errors.Is(err, core.ErrPermissionDenied), errors.Is(err, core.ErrUnauthenticated):
+		return BinaryStatusAuthError
+	case errors.Is(err, core.ErrClient):
+		return BinaryStatusInvalid
+	case errors.Is(err, core.ErrBadCommand):
+		return BinaryStatusUnknownCommand
+	}
+
+	return BinaryStatusInternalError
+}
@@ -0,0 +1,347 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/56quarters/jankcache/server/core"
+)
+
+// binaryRequest encodes a binary protocol request with the given body.
+func binaryRequest(opcode BinaryOpcode, cas uint64, extras []byte, key string, value string) []byte {
+	var buf [binaryHeaderSize]byte
+	buf[0] = BinaryMagicRequest
+	buf[1] = byte(opcode)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+
+	out := append(buf[:], extras...)
+	out = append(out, key...)
+	return append(out, value...)
+}
+
+func TestParser_ParseBinaryCompareCas(t *testing.T) {
+	arithmetic := make([]byte, 20)
+	binary.BigEndian.PutUint64(arithmetic[0:8], 1)
+	binary.BigEndian.PutUint32(arithmetic[16:20], binaryNoVivify)
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		expected Op
+	}{
+		{
+			name:     "delete",
+			payload:  binaryRequest(BinaryOpDelete, 0, nil, "foo", ""),
+			expected: &DeleteOp{Key: "foo"},
+		},
+		{
+			name:     "delete with cas",
+			payload:  binaryRequest(BinaryOpDeleteQ, 5, nil, "foo", ""),
+			expected: &MetaDeleteOp{Key: "foo", CompareCas: 5},
+		},
+		{
+			name:     "append",
+			payload:  binaryRequest(BinaryOpAppend, 0, nil, "foo", "bar"),
+			expected: &AppendOp{Key: "foo", Bytes: []byte("bar")},
+		},
+		{
+			name:     "append with cas",
+			payload:  binaryRequest(BinaryOpAppendQ, 5, nil, "foo", "bar"),
+			expected: &MetaSetOp{Key: "foo", CompareCas: 5, Mode: MetaSetModeAppend, Bytes: []byte("bar")},
+		},
+		{
+			name:     "prepend with cas",
+			payload:  binaryRequest(BinaryOpPrepend, 5, nil, "foo", "bar"),
+			expected: &MetaSetOp{Key: "foo", CompareCas: 5, Mode: MetaSetModePrepend, Bytes: []byte("bar")},
+		},
+		{
+			name:     "increment with cas",
+			payload:  binaryRequest(BinaryOpIncrement, 5, arithmetic, "foo", ""),
+			expected: &MetaArithmeticOp{Key: "foo", CompareCas: 5, Delta: 1, VivifyExpire: binaryNoVivify},
+		},
+		{
+			name:     "decrement with cas",
+			payload:  binaryRequest(BinaryOpDecrementQ, 5, arithmetic, "foo", ""),
+			expected: &MetaArithmeticOp{Key: "foo", CompareCas: 5, Delta: 1, VivifyExpire: binaryNoVivify, Mode: MetaArithmeticDecr},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, op, err := NewParser(1024).ParseBinary(bytes.NewReader(tc.payload))
+			if err != nil {
+				t.Fatalf("unexpected error parsing request: %s", err)
+			}
+
+			if !reflect.DeepEqual(op, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, op)
+			}
+		})
+	}
+}
+
+func TestParser_ParseBinarySwallowsTooLarge(t *testing.T) {
+	extras := make([]byte, 8)
+	payload := bytes.NewReader(append(
+		binaryRequest(BinaryOpSet, 0, extras, "foo", string(make([]byte, 2048))),
+		binaryRequest(BinaryOpGet, 0, nil, "foo", "")...,
+	))
+
+	p := NewParser(1024)
+	req, _, err := p.ParseBinary(payload)
+	if req == nil || !errors.Is(err, core.ErrObjectTooLarge) {
+		t.Fatalf("expected object too large with a request to respond to, got %v, %v", req, err)
+	}
+
+	// The next request must be read from the start of its header
+	_, op, err := p.ParseBinary(payload)
+	if err != nil {
+		t.Fatalf("unexpected error parsing next request: %s", err)
+	}
+
+	if expected := (&GetOp{Keys: []string{"foo"}, Unique: true}); !reflect.DeepEqual(op, expected) {
+		t.Errorf("expected %+v, got %+v", expected, op)
+	}
+}
+
+func TestParser_ParseBinary(t *testing.T) {
+	storage := func(flags uint32, expire uint32) []byte {
+		extras := binary.BigEndian.AppendUint32(nil, flags)
+		return binary.BigEndian.AppendUint32(extras, expire)
+	}
+
+	arithmetic := make([]byte, 20)
+	binary.BigEndian.PutUint64(arithmetic[0:8], 5)
+	binary.BigEndian.PutUint64(arithmetic[8:16], 10)
+	binary.BigEndian.PutUint32(arithmetic[16:20], 60)
+
+	expire := binary.BigEndian.AppendUint32(nil, 60)
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		expected Op
+		err      error
+	}{
+		{
+			name:     "get",
+			payload:  binaryRequest(BinaryOpGetK, 0, nil, "foo", ""),
+			expected: &GetOp{Keys: []string{"foo"}, Unique: true},
+		},
+		{
+			name:     "set",
+			payload:  binaryRequest(BinaryOpSet, 0, storage(5, 60), "foo", "bar"),
+			expected: &SetOp{Key: "foo", Flags: 5, Expire: 60, Bytes: []byte("bar")},
+		},
+		{
+			name:     "set with cas",
+			payload:  binaryRequest(BinaryOpSetQ, 3, storage(5, 60), "foo", "bar"),
+			expected: &CasOp{Key: "foo", Flags: 5, Expire: 60, Unique: 3, Bytes: []byte("bar")},
+		},
+		{
+			name:     "add ignores cas",
+			payload:  binaryRequest(BinaryOpAdd, 3, storage(0, 0), "foo", "bar"),
+			expected: &AddOp{Key: "foo", Bytes: []byte("bar")},
+		},
+		{
+			name:     "replace",
+			payload:  binaryRequest(BinaryOpReplaceQ, 0, storage(0, 0), "foo", "bar"),
+			expected: &ReplaceOp{Key: "foo", Bytes: []byte("bar")},
+		},
+		{
+			name:     "increment",
+			payload:  binaryRequest(BinaryOpIncrement, 0, arithmetic, "foo", ""),
+			expected: &MetaArithmeticOp{Key: "foo", Delta: 5, Initial: 10, AutoVivify: true, VivifyExpire: 60},
+		},
+		{
+			name:     "touch",
+			payload:  binaryRequest(BinaryOpTouch, 0, expire, "foo", ""),
+			expected: &TouchOp{Key: "foo", Expire: 60},
+		},
+		{
+			name:     "gat",
+			payload:  binaryRequest(BinaryOpGatKQ, 0, expire, "foo", ""),
+			expected: &GatOp{Keys: []string{"foo"}, Expire: 60, Unique: true},
+		},
+		{
+			name:     "flush",
+			payload:  binaryRequest(BinaryOpFlush, 0, nil, "", ""),
+			expected: &FlushAllOp{},
+		},
+		{
+			name:     "flush delayed",
+			payload:  binaryRequest(BinaryOpFlushQ, 0, expire, "", ""),
+			expected: &FlushAllOp{Delay: 60},
+		},
+		{
+			name:     "no-op",
+			payload:  binaryRequest(BinaryOpNoOp, 0, nil, "", ""),
+			expected: MetaNoOpOp{},
+		},
+		{
+			name:     "version",
+			payload:  binaryRequest(BinaryOpVersion, 0, nil, "", ""),
+			expected: VersionOp{},
+		},
+		{
+			name:     "stats group",
+			payload:  binaryRequest(BinaryOpStat, 0, nil, "settings", ""),
+			expected: StatsOp{Group: StatsSettings},
+		},
+		{
+			name:     "sasl auth",
+			payload:  binaryRequest(BinaryOpSaslAuth, 0, nil, SaslMechPlain, "\x00user\x00pass"),
+			expected: &SaslAuthOp{Username: "user", Password: "pass"},
+		},
+		{
+			name:    "sasl unsupported mechanism",
+			payload: binaryRequest(BinaryOpSaslAuth, 0, nil, "CRAM-MD5", "user"),
+			err:     core.ErrClient,
+		},
+		{
+			name:    "get with value",
+			payload: binaryRequest(BinaryOpGet, 0, nil, "foo", "bar"),
+			err:     core.ErrClient,
+		},
+		{
+			name:    "set missing extras",
+			payload: binaryRequest(BinaryOpSet, 0, nil, "foo", "bar"),
+			err:     core.ErrClient,
+		},
+		{
+			name:    "delete missing key",
+			payload: binaryRequest(BinaryOpDelete, 0, nil, "", ""),
+			err:     core.ErrClient,
+		},
+		{
+			name:    "unknown opcode",
+			payload: binaryRequest(0x7f, 0, nil, "", ""),
+			err:     core.ErrBadCommand,
+		},
+	}
+
+	p := NewParser(1024)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, op, err := p.ParseBinary(bytes.NewReader(tc.payload))
+			if req == nil {
+				t.Fatalf("expected request to be read, got error %v", err)
+			}
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("expected error %v, got %v", tc.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error parsing request: %s", err)
+			}
+
+			if !reflect.DeepEqual(op, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, op)
+			}
+		})
+	}
+}
+
+func TestParser_ParseBinaryInvalidHeader(t *testing.T) {
+	invalidMagic := binaryRequest(BinaryOpGet, 0, nil, "foo", "")
+	invalidMagic[0] = BinaryMagicResponse
+
+	invalidLength := binaryRequest(BinaryOpGet, 0, nil, "foo", "")
+	binary.BigEndian.PutUint32(invalidLength[8:12], 2)
+
+	truncated := binaryRequest(BinaryOpGet, 0, nil, "foo", "")
+
+	for name, payload := range map[string][]byte{
+		"invalid magic":  invalidMagic,
+		"invalid length": invalidLength,
+		"truncated body": truncated[:len(truncated)-1],
+		"short header":   truncated[:10],
+	} {
+		// None of these leave the connection in a usable state
+		if req, _, err := NewParser(1024).ParseBinary(bytes.NewReader(payload)); req != nil || err == nil {
+			t.Errorf("%s: expected error without a request, got %v, %v", name, req, err)
+		}
+	}
+}
+
+func TestBinaryEncoder_Response(t *testing.T) {
+	header, _, err := NewParser(1024).ParseBinary(bytes.NewReader(binaryRequest(BinaryOpGetK, 0, nil, "foo", "")))
+	if err != nil {
+		t.Fatalf("unexpected error parsing request: %s", err)
+	}
+
+	header.Header.Opaque = 0xdeadbeef
+
+	var buf bytes.Buffer
+	NewBinaryEncoder(&buf).Response(&header.Header, BinaryStatusOk, 42, []byte{0, 0, 0, 5}, []byte("foo"), []byte("bar"))
+	out := buf.Bytes()
+
+	// The response header mirrors the request but is otherwise the same format
+	res := out[:binaryHeaderSize]
+	res[0] = BinaryMagicRequest
+	decoded, err := readBinaryHeader(bytes.NewReader(res))
+	if err != nil {
+		t.Fatalf("unexpected error reading response header: %s", err)
+	}
+
+	expected := BinaryHeader{
+		Magic:        BinaryMagicRequest,
+		Opcode:       BinaryOpGetK,
+		KeyLength:    3,
+		ExtrasLength: 4,
+		VBucket:      uint16(BinaryStatusOk),
+		BodyLength:   10,
+		Opaque:       0xdeadbeef,
+		Cas:          42,
+	}
+
+	if decoded != expected {
+		t.Errorf("expected header %+v, got %+v", expected, decoded)
+	}
+
+	if body := string(out[binaryHeaderSize:]); body != "\x00\x00\x00\x05foobar" {
+		t.Errorf("expected extras, key, and value in body, got %q", body)
+	}
+}
+
+func TestBinaryEncoder_Error(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected BinaryStatus
+	}{
+		{err: core.ErrNotFound, expected: BinaryStatusNotFound},
+		{err: core.ErrExists, expected: BinaryStatusExists},
+		{err: core.ErrNotStored, expected: BinaryStatusNotStored},
+		{err: core.ErrObjectTooLarge, expected: BinaryStatusTooLarge},
+		{err: core.ErrNonNumeric, expected: BinaryStatusNonNumeric},
+		{err: core.ErrPermissionDenied, expected: BinaryStatusAuthError},
+		{err: core.ClientError("bad"), expected: BinaryStatusInvalid},
+		{err: core.ErrBadCommand, expected: BinaryStatusUnknownCommand},
+		{err: core.ServerError("broken"), expected: BinaryStatusInternalError},
+	}
+
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		NewBinaryEncoder(&buf).Error(&BinaryHeader{Opcode: BinaryOpGet}, tc.err)
+		out := buf.Bytes()
+
+		if status := BinaryStatus(binary.BigEndian.Uint16(out[6:8])); status != tc.expected {
+			t.Errorf("expected status %#x for %v, got %#x", tc.expected, tc.err, status)
+		}
+
+		if body := string(out[binaryHeaderSize:]); body != tc.err.Error() {
+			t.Errorf("expected error message as body, got %q", body)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/56quarters/jankcache/server/core"
 )
@@ -43,6 +44,10 @@ func (e *Encoder) Error(err error) *Encoder {
 		return e.Line(err.Error())
 	} else if errors.Is(err, core.ErrNotFound) {
 		return e.Line(err.Error())
+	} else if errors.Is(err, core.ErrExists) {
+		return e.Line(err.Error())
+	} else if errors.Is(err, core.ErrNotStored) {
+		return e.Line(err.Error())
 	}
 
 	return e.Line(core.ServerError(err.Error()).Error())
@@ -69,10 +74,26 @@ func (e *Encoder) Deleted() *Encoder {
 	return e.Line("DELETED")
 }
 
+func (e *Encoder) Touched() *Encoder {
+	return e.Line("TOUCHED")
+}
+
 func (e *Encoder) Ok() *Encoder {
 	return e.Line("OK")
 }
 
+func (e *Encoder) Reset() *Encoder {
+	return e.Line("RESET")
+}
+
+func (e *Encoder) Meta(status MetaStatus, flags ...string) *Encoder {
+	if len(flags) == 0 {
+		return e.Line(string(status))
+	}
+
+	return e.Line(string(status) + " " + strings.Join(flags, " "))
+}
+
 type MemcachedMarshaller interface {
 	MarshallMemcached(o *Encoder)
 }
@@ -0,0 +1,413 @@
+package proto
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/56quarters/jankcache/server/core"
+)
+
+const (
+	maxOpaqueSizeBytes = 32
+)
+
+// MetaStatus is the two character status code that starts every meta command response.
+type MetaStatus string
+
+const (
+	MetaStatusDebug     MetaStatus = "ME"
+	MetaStatusExists    MetaStatus = "EX"
+	MetaStatusHeader    MetaStatus = "HD"
+	MetaStatusMiss      MetaStatus = "EN"
+	MetaStatusNoOp      MetaStatus = "MN"
+	MetaStatusNotFound  MetaStatus = "NF"
+	MetaStatusNotStored MetaStatus = "NS"
+	MetaStatusValue     MetaStatus = "VA"
+)
+
+// MetaArithmeticMode is the operation performed by a meta arithmetic command.
+type MetaArithmeticMode int
+
+const (
+	MetaArithmeticIncr MetaArithmeticMode = iota
+	MetaArithmeticDecr
+)
+
+// MetaSetMode is the storage semantics used by a meta set command.
+type MetaSetMode int
+
+const (
+	MetaSetModeSet MetaSetMode = iota
+	MetaSetModeAdd
+	MetaSetModeReplace
+	MetaSetModeAppend
+	MetaSetModePrepend
+)
+
+// MetaFlags are flags shared by all meta commands that control the format of a
+// response: which parts of an entry are returned and whether "success" statuses
+// are returned at all.
+type MetaFlags struct {
+	Base64      bool
+	Opaque      string
+	Quiet       bool
+	ReturnCas   bool
+	ReturnFlags bool
+	ReturnKey   bool
+	ReturnSize  bool
+	ReturnTTL   bool
+	ReturnValue bool
+}
+
+type MetaArithmeticOp struct {
+	MetaFlags
+	Key          string
+	CompareCas   uint64 // zero disables comparison, it's never a valid CAS value
+	Mode         MetaArithmeticMode
+	Delta        uint64
+	Initial      uint64
+	AutoVivify   bool
+	VivifyExpire int64
+	UpdateExpire bool
+	Expire       int64
+}
+
+func (MetaArithmeticOp) Type() OpType {
+	return OpTypeMetaArithmetic
+}
+
+type MetaDebugOp struct {
+	MetaFlags
+	Key string
+}
+
+func (MetaDebugOp) Type() OpType {
+	return OpTypeMetaDebug
+}
+
+type MetaDeleteOp struct {
+	MetaFlags
+	Key        string
+	CompareCas uint64
+}
+
+func (MetaDeleteOp) Type() OpType {
+	return OpTypeMetaDelete
+}
+
+// MetaGetOp gets an entry, optionally updating its TTL. Clients can be told that they
+// should (re)populate an entry: AutoVivify creates an empty entry on a miss that only
+// the client that created it is told to populate, and Recache tells a single client
+// to populate an entry when its TTL drops below RecacheTTL.
+type MetaGetOp struct {
+	MetaFlags
+	Key          string
+	AutoVivify   bool
+	VivifyExpire int64
+	Recache      bool
+	RecacheTTL   int64
+	UpdateExpire bool
+	Expire       int64
+}
+
+func (MetaGetOp) Type() OpType {
+	return OpTypeMetaGet
+}
+
+type MetaNoOpOp struct{}
+
+func (MetaNoOpOp) Type() OpType {
+	return OpTypeMetaNoOp
+}
+
+type MetaSetOp struct {
+	MetaFlags
+	Key        string
+	CompareCas uint64
+	Mode       MetaSetMode
+	Flags      uint32
+	Expire     int64
+	Bytes      []byte
+}
+
+func (MetaSetOp) Type() OpType {
+	return OpTypeMetaSet
+}
+
+func (p *Parser) parseMetaArithmetic(line string, parts []string) (*MetaArithmeticOp, error) {
+	if len(parts) < 2 {
+		return nil, core.ClientError("bad ma command '%s'", line)
+	}
+
+	op := &MetaArithmeticOp{Delta: 1}
+	err := parseMetaFlags(parts[2:], &op.MetaFlags, func(flag byte, token string) error {
+		var err error
+		switch flag {
+		case 'C':
+			op.CompareCas, err = strconv.ParseUint(token, 10, 64)
+		case 'D':
+			op.Delta, err = strconv.ParseUint(token, 10, 64)
+		case 'J':
+			op.Initial, err = strconv.ParseUint(token, 10, 64)
+		case 'M':
+			op.Mode, err = parseArithmeticMode(token)
+		case 'N':
+			op.AutoVivify = true
+			op.VivifyExpire, err = strconv.ParseInt(token, 10, 64)
+		case 'T':
+			op.UpdateExpire = true
+			op.Expire, err = strconv.ParseInt(token, 10, 64)
+		default:
+			return errInvalidFlag(flag)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, core.ClientError("bad ma flags '%s': %s", line, err)
+	}
+
+	op.Key, err = decodeMetaKey(parts[1], op.Base64)
+	if err != nil {
+		return nil, core.ClientError("bad key: %s", err)
+	}
+
+	return op, nil
+}
+
+func (p *Parser) parseMetaDebug(line string, parts []string) (*MetaDebugOp, error) {
+	if len(parts) < 2 {
+		return nil, core.ClientError("bad me command '%s'", line)
+	}
+
+	op := &MetaDebugOp{}
+	err := parseMetaFlags(parts[2:], &op.MetaFlags, func(flag byte, _ string) error {
+		return errInvalidFlag(flag)
+	})
+
+	if err != nil {
+		return nil, core.ClientError("bad me flags '%s': %s", line, err)
+	}
+
+	op.Key, err = decodeMetaKey(parts[1], op.Base64)
+	if err != nil {
+		return nil, core.ClientError("bad key: %s", err)
+	}
+
+	return op, nil
+}
+
+func (p *Parser) parseMetaDelete(line string, parts []string) (*MetaDeleteOp, error) {
+	if len(parts) < 2 {
+		return nil, core.ClientError("bad md command '%s'", line)
+	}
+
+	op := &MetaDeleteOp{}
+	err := parseMetaFlags(parts[2:], &op.MetaFlags, func(flag byte, token string) error {
+		if flag == 'C' {
+			var err error
+			op.CompareCas, err = strconv.ParseUint(token, 10, 64)
+			return err
+		}
+
+		return errInvalidFlag(flag)
+	})
+
+	if err != nil {
+		return nil, core.ClientError("bad md flags '%s': %s", line, err)
+	}
+
+	op.Key, err = decodeMetaKey(parts[1], op.Base64)
+	if err != nil {
+		return nil, core.ClientError("bad key: %s", err)
+	}
+
+	return op, nil
+}
+
+func (p *Parser) parseMetaGet(line string, parts []string) (*MetaGetOp, error) {
+	if len(parts) < 2 {
+		return nil, core.ClientError("bad mg command '%s'", line)
+	}
+
+	op := &MetaGetOp{}
+	err := parseMetaFlags(parts[2:], &op.MetaFlags, func(flag byte, token string) error {
+		var err error
+		switch flag {
+		case 'N':
+			op.AutoVivify = true
+			op.VivifyExpire, err = strconv.ParseInt(token, 10, 64)
+		case 'R':
+			op.Recache = true
+			op.RecacheTTL, err = strconv.ParseInt(token, 10, 64)
+		case 'T':
+			op.UpdateExpire = true
+			op.Expire, err = strconv.ParseInt(token, 10, 64)
+		default:
+			return errInvalidFlag(flag)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, core.ClientError("bad mg flags '%s': %s", line, err)
+	}
+
+	op.Key, err = decodeMetaKey(parts[1], op.Base64)
+	if err != nil {
+		return nil, core.ClientError("bad key: %s", err)
+	}
+
+	return op, nil
+}
+
+func (p *Parser) parseMetaSet(line string, parts []string, payload io.Reader) (*MetaSetOp, error) {
+	if len(parts) < 3 {
+		return nil, core.ClientError("bad ms command '%s'", line)
+	}
+
+	length, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, core.ClientError("bad data length '%s': %s", line, err)
+	}
+
+	op := &MetaSetOp{}
+	err = parseMetaFlags(parts[3:], &op.MetaFlags, func(flag byte, token string) error {
+		switch flag {
+		case 'C':
+			var err error
+			op.CompareCas, err = strconv.ParseUint(token, 10, 64)
+			return err
+		case 'F':
+			flags, err := strconv.ParseUint(token, 10, 32)
+			op.Flags = uint32(flags)
+			return err
+		case 'M':
+			var err error
+			op.Mode, err = parseSetMode(token)
+			return err
+		case 'T':
+			var err error
+			op.Expire, err = strconv.ParseInt(token, 10, 64)
+			return err
+		default:
+			return errInvalidFlag(flag)
+		}
+	})
+
+	if err != nil {
+		return nil, swallow(payload, length, core.ClientError("bad ms flags '%s': %s", line, err))
+	}
+
+	op.Key, err = decodeMetaKey(parts[1], op.Base64)
+	if err != nil {
+		return nil, swallow(payload, length, core.ClientError("bad key: %s", err))
+	}
+
+	op.Bytes, err = p.readPayload(length, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// parseMetaFlags parses flags common to all meta commands into flags, delegating
+// any others to the command specific extra function which should return an error
+// for flags the command doesn't support.
+func parseMetaFlags(tokens []string, flags *MetaFlags, extra func(flag byte, token string) error) error {
+	for _, t := range tokens {
+		flag := t[0]
+		token := t[1:]
+
+		switch flag {
+		case 'b':
+			flags.Base64 = true
+		case 'c':
+			flags.ReturnCas = true
+		case 'f':
+			flags.ReturnFlags = true
+		case 'k':
+			flags.ReturnKey = true
+		case 'O':
+			if len(token) > maxOpaqueSizeBytes {
+				return fmt.Errorf("opaque length %d greater than max of %d", len(token), maxOpaqueSizeBytes)
+			}
+			flags.Opaque = token
+		case 'q':
+			flags.Quiet = true
+		case 's':
+			flags.ReturnSize = true
+		case 't':
+			flags.ReturnTTL = true
+		case 'v':
+			flags.ReturnValue = true
+		default:
+			if err := extra(flag, token); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseArithmeticMode(token string) (MetaArithmeticMode, error) {
+	switch strings.ToLower(token) {
+	case "i", "incr", "+":
+		return MetaArithmeticIncr, nil
+	case "d", "decr", "-":
+		return MetaArithmeticDecr, nil
+	}
+
+	return 0, fmt.Errorf("invalid mode '%s'", token)
+}
+
+func parseSetMode(token string) (MetaSetMode, error) {
+	switch strings.ToLower(token) {
+	case "s":
+		return MetaSetModeSet, nil
+	case "e":
+		return MetaSetModeAdd, nil
+	case "r":
+		return MetaSetModeReplace, nil
+	case "a":
+		return MetaSetModeAppend, nil
+	case "p":
+		return MetaSetModePrepend, nil
+	}
+
+	return 0, fmt.Errorf("invalid mode '%s'", token)
+}
+
+func decodeMetaKey(key string, b64 bool) (string, error) {
+	if !b64 {
+		return validateKey(key)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %w", err)
+	}
+
+	return validateKeyLength(string(decoded))
+}
+
+func errInvalidFlag(flag byte) error {
+	return fmt.Errorf("invalid flag '%c'", flag)
+}
+
+// EncodeKey returns the key in the form a client sent it: base64 encoded if
+// the client used the "b" flag, as-is otherwise.
+func (f *MetaFlags) EncodeKey(key string) string {
+	if f.Base64 {
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+
+	return key
+}
@@ -0,0 +1,193 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_ParseMetaGet(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "no flags",
+			line:     "mg foo",
+			expected: &MetaGetOp{Key: "foo"},
+		},
+		{
+			name:     "return flags",
+			line:     "mg foo v c f k s t Oabc q",
+			expected: &MetaGetOp{Key: "foo", MetaFlags: MetaFlags{ReturnValue: true, ReturnCas: true, ReturnFlags: true, ReturnKey: true, ReturnSize: true, ReturnTTL: true, Opaque: "abc", Quiet: true}},
+		},
+		{
+			name:     "base64 key",
+			line:     "mg Zm9v b",
+			expected: &MetaGetOp{Key: "foo", MetaFlags: MetaFlags{Base64: true}},
+		},
+		{
+			name:     "touch",
+			line:     "mg foo T30",
+			expected: &MetaGetOp{Key: "foo", UpdateExpire: true, Expire: 30},
+		},
+		{
+			name:     "autovivify",
+			line:     "mg foo N60",
+			expected: &MetaGetOp{Key: "foo", AutoVivify: true, VivifyExpire: 60},
+		},
+		{
+			name:     "recache",
+			line:     "mg foo R10",
+			expected: &MetaGetOp{Key: "foo", Recache: true, RecacheTTL: 10},
+		},
+		{
+			name: "invalid touch",
+			line: "mg foo Tabc",
+			err:  true,
+		},
+		{
+			name: "unsupported flag",
+			line: "mg foo E5",
+			err:  true,
+		},
+		{
+			name: "opaque too long",
+			line: "mg foo O" + strings.Repeat("a", maxOpaqueSizeBytes+1),
+			err:  true,
+		},
+		{
+			name: "missing key",
+			line: "mg",
+			err:  true,
+		},
+	})
+}
+
+func TestParser_ParseMetaSet(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "no flags",
+			line:     "ms foo 3",
+			payload:  "bar\r\n",
+			expected: &MetaSetOp{Key: "foo", Bytes: []byte("bar")},
+		},
+		{
+			name:     "all flags",
+			line:     "ms foo 3 C5 F7 T60 MA c k Oabc q",
+			payload:  "bar\r\n",
+			expected: &MetaSetOp{Key: "foo", CompareCas: 5, Flags: 7, Expire: 60, Mode: MetaSetModeAppend, Bytes: []byte("bar"), MetaFlags: MetaFlags{ReturnCas: true, ReturnKey: true, Opaque: "abc", Quiet: true}},
+		},
+		{
+			name:     "modes",
+			line:     "ms foo 0 ME",
+			payload:  "\r\n",
+			expected: &MetaSetOp{Key: "foo", Mode: MetaSetModeAdd, Bytes: []byte{}},
+		},
+		{
+			name:     "base64 key",
+			line:     "ms Zm9v 3 b",
+			payload:  "bar\r\n",
+			expected: &MetaSetOp{Key: "foo", Bytes: []byte("bar"), MetaFlags: MetaFlags{Base64: true}},
+		},
+		{
+			name:    "invalid mode",
+			line:    "ms foo 3 MX",
+			payload: "bar\r\n",
+			err:     true,
+		},
+		{
+			name:    "invalid length",
+			line:    "ms foo abc",
+			payload: "bar\r\n",
+			err:     true,
+		},
+		{
+			name:    "payload too short",
+			line:    "ms foo 5",
+			payload: "bar\r\n",
+			err:     true,
+		},
+		{
+			name: "missing length",
+			line: "ms foo",
+			err:  true,
+		},
+	})
+}
+
+func TestParser_ParseMetaDelete(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "no flags",
+			line:     "md foo",
+			expected: &MetaDeleteOp{Key: "foo"},
+		},
+		{
+			name:     "compare cas",
+			line:     "md foo C10 q k",
+			expected: &MetaDeleteOp{Key: "foo", CompareCas: 10, MetaFlags: MetaFlags{Quiet: true, ReturnKey: true}},
+		},
+		{
+			name: "invalid cas",
+			line: "md foo C-1",
+			err:  true,
+		},
+		{
+			name: "unsupported flag",
+			line: "md foo T30",
+			err:  true,
+		},
+	})
+}
+
+func TestParser_ParseMetaArithmetic(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "defaults",
+			line:     "ma foo",
+			expected: &MetaArithmeticOp{Key: "foo", Delta: 1},
+		},
+		{
+			name:     "all flags",
+			line:     "ma foo D5 J10 N60 T30 C3 MD v t",
+			expected: &MetaArithmeticOp{Key: "foo", Delta: 5, Initial: 10, AutoVivify: true, VivifyExpire: 60, UpdateExpire: true, Expire: 30, CompareCas: 3, Mode: MetaArithmeticDecr, MetaFlags: MetaFlags{ReturnValue: true, ReturnTTL: true}},
+		},
+		{
+			name:     "mode aliases",
+			line:     "ma foo M+",
+			expected: &MetaArithmeticOp{Key: "foo", Delta: 1, Mode: MetaArithmeticIncr},
+		},
+		{
+			name: "invalid delta",
+			line: "ma foo D-1",
+			err:  true,
+		},
+		{
+			name: "invalid mode",
+			line: "ma foo Mx",
+			err:  true,
+		},
+	})
+}
+
+func TestParser_ParseMetaNoOpDebug(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "no-op",
+			line:     "mn",
+			expected: MetaNoOpOp{},
+		},
+		{
+			name:     "debug",
+			line:     "me foo",
+			expected: &MetaDebugOp{Key: "foo"},
+		},
+		{
+			name:     "debug base64 key",
+			line:     "me Zm9v b",
+			expected: &MetaDebugOp{Key: "foo", MetaFlags: MetaFlags{Base64: true}},
+		},
+		{
+			name: "debug unsupported flag",
+			line: "me foo T30",
+			err:  true,
+		},
+	})
+}
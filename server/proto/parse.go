@@ -3,6 +3,7 @@ package proto
 import (
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 
@@ -12,21 +13,127 @@ import (
 type OpType int
 
 const (
-	OpTypeCacheMemLimit = iota
+	OpTypeAdd = iota
+	OpTypeAppend
+	OpTypeCacheMemLimit
+	OpTypeCas
+	OpTypeDecr
 	OpTypeDelete
+	OpTypeFlushAll
+	OpTypeGat
 	OpTypeGet
+	OpTypeIncr
+	OpTypeMetaArithmetic
+	OpTypeMetaDebug
+	OpTypeMetaDelete
+	OpTypeMetaGet
+	OpTypeMetaNoOp
+	OpTypeMetaSet
+	OpTypePrepend
 	OpTypeQuit
+	OpTypeReplace
+	OpTypeSaslAuth
+	OpTypeSaslListMechs
 	OpTypeSet
+	OpTypeTouch
 	OpTypeVersion
 	OpTypeStats
+	OpTypeCloseConn
+	OpTypeShutdown
 
 	maxKeySizeBytes = 250
 )
 
+// String returns the name of the text protocol command for an operation type.
+func (t OpType) String() string {
+	switch t {
+	case OpTypeAdd:
+		return "add"
+	case OpTypeAppend:
+		return "append"
+	case OpTypeCacheMemLimit:
+		return "cache_memlimit"
+	case OpTypeCas:
+		return "cas"
+	case OpTypeDecr:
+		return "decr"
+	case OpTypeDelete:
+		return "delete"
+	case OpTypeFlushAll:
+		return "flush_all"
+	case OpTypeGat:
+		return "gat"
+	case OpTypeGet:
+		return "get"
+	case OpTypeIncr:
+		return "incr"
+	case OpTypeMetaArithmetic:
+		return "ma"
+	case OpTypeMetaDebug:
+		return "me"
+	case OpTypeMetaDelete:
+		return "md"
+	case OpTypeMetaGet:
+		return "mg"
+	case OpTypeMetaNoOp:
+		return "mn"
+	case OpTypeMetaSet:
+		return "ms"
+	case OpTypePrepend:
+		return "prepend"
+	case OpTypeQuit:
+		return "quit"
+	case OpTypeReplace:
+		return "replace"
+	case OpTypeSaslAuth:
+		return "sasl_auth"
+	case OpTypeSaslListMechs:
+		return "sasl_list_mechs"
+	case OpTypeSet:
+		return "set"
+	case OpTypeTouch:
+		return "touch"
+	case OpTypeVersion:
+		return "version"
+	case OpTypeStats:
+		return "stats"
+	case OpTypeCloseConn:
+		return "close_conn"
+	case OpTypeShutdown:
+		return "shutdown"
+	}
+
+	return fmt.Sprintf("OpType(%d)", int(t))
+}
+
 type Op interface {
 	Type() OpType
 }
 
+type AddOp struct {
+	Key     string
+	Flags   uint32
+	Expire  int64
+	NoReply bool
+	Bytes   []byte
+}
+
+func (AddOp) Type() OpType {
+	return OpTypeAdd
+}
+
+type AppendOp struct {
+	Key     string
+	Flags   uint32
+	Expire  int64
+	NoReply bool
+	Bytes   []byte
+}
+
+func (AppendOp) Type() OpType {
+	return OpTypeAppend
+}
+
 type CacheMemLimitOp struct {
 	Bytes   int64
 	NoReply bool
@@ -36,6 +143,39 @@ func (CacheMemLimitOp) Type() OpType {
 	return OpTypeCacheMemLimit
 }
 
+// CloseConnOp closes the client connection with the given ID, as shown by `stats conns`.
+type CloseConnOp struct {
+	ID      uint64
+	NoReply bool
+}
+
+func (CloseConnOp) Type() OpType {
+	return OpTypeCloseConn
+}
+
+type CasOp struct {
+	Key     string
+	Flags   uint32
+	Expire  int64
+	Unique  uint64
+	NoReply bool
+	Bytes   []byte
+}
+
+func (CasOp) Type() OpType {
+	return OpTypeCas
+}
+
+type DecrOp struct {
+	Key     string
+	Delta   uint64
+	NoReply bool
+}
+
+func (DecrOp) Type() OpType {
+	return OpTypeDecr
+}
+
 type DeleteOp struct {
 	Key     string
 	NoReply bool
@@ -45,6 +185,25 @@ func (DeleteOp) Type() OpType {
 	return OpTypeDelete
 }
 
+type FlushAllOp struct {
+	Delay   int64
+	NoReply bool
+}
+
+func (FlushAllOp) Type() OpType {
+	return OpTypeFlushAll
+}
+
+type GatOp struct {
+	Keys   []string
+	Expire int64
+	Unique bool
+}
+
+func (GatOp) Type() OpType {
+	return OpTypeGat
+}
+
 type GetOp struct {
 	Keys   []string
 	Unique bool
@@ -54,24 +213,90 @@ func (GetOp) Type() OpType {
 	return OpTypeGet
 }
 
+type IncrOp struct {
+	Key     string
+	Delta   uint64
+	NoReply bool
+}
+
+func (IncrOp) Type() OpType {
+	return OpTypeIncr
+}
+
+type PrependOp struct {
+	Key     string
+	Flags   uint32
+	Expire  int64
+	NoReply bool
+	Bytes   []byte
+}
+
+func (PrependOp) Type() OpType {
+	return OpTypePrepend
+}
+
+// ShutdownOp stops the server after draining client connections. Memcached also
+// supports a non-graceful mode but shutting down is always graceful here.
+type ShutdownOp struct{}
+
+func (ShutdownOp) Type() OpType {
+	return OpTypeShutdown
+}
+
 type QuitOp struct{}
 
 func (QuitOp) Type() OpType {
 	return OpTypeQuit
 }
 
+type TouchOp struct {
+	Key     string
+	Expire  int64
+	NoReply bool
+}
+
+func (TouchOp) Type() OpType {
+	return OpTypeTouch
+}
+
 type VersionOp struct{}
 
 func (VersionOp) Type() OpType {
 	return OpTypeVersion
 }
 
-type StatsOp struct{}
+const (
+	StatsGeneral  = ""
+	StatsConns    = "conns"
+	StatsItems    = "items"
+	StatsLatency  = "latency"
+	StatsReset    = "reset"
+	StatsSettings = "settings"
+	StatsSizes    = "sizes"
+)
+
+// StatsOp requests a group of statistics. The general statistics are returned if
+// Group is empty.
+type StatsOp struct {
+	Group string
+}
 
 func (StatsOp) Type() OpType {
 	return OpTypeStats
 }
 
+type ReplaceOp struct {
+	Key     string
+	Flags   uint32
+	Expire  int64
+	NoReply bool
+	Bytes   []byte
+}
+
+func (ReplaceOp) Type() OpType {
+	return OpTypeReplace
+}
+
 type SetOp struct {
 	Key     string
 	Flags   uint32
@@ -95,35 +320,71 @@ func NewParser(maxItemSize uint64) *Parser {
 }
 
 func (p *Parser) ParseLine(line string, payload io.Reader) (Op, error) {
-	if line == "" {
-		return nil, core.ErrBadCommand
-	}
-
-	parts := strings.Split(line, " ")
+	// Clients may separate arguments with more than one space or leave a trailing space,
+	// neither of which should result in an empty key or argument.
+	parts := strings.Fields(line)
 	if len(parts) == 0 {
 		return nil, core.ErrBadCommand
 	}
 
 	cmd := strings.ToLower(parts[0])
 	switch cmd {
+	case "add":
+		return p.parseAdd(line, parts, payload)
+	case "append":
+		return p.parseAppend(line, parts, payload)
 	case "cache_memlimit":
 		return p.parseCacheMemLimit(line, parts)
+	case "cas":
+		return p.parseCas(line, parts, payload)
+	case "close_conn":
+		return p.parseCloseConn(line, parts)
+	case "decr":
+		return p.parseDecr(line, parts)
 	case "delete":
 		return p.parseDelete(line, parts)
+	case "flush_all":
+		return p.parseFlushAll(line, parts)
+	case "gat":
+		return p.parseGat(line, parts, false)
+	case "gats":
+		return p.parseGat(line, parts, true)
 	case "get":
 		return p.parseGet(line, parts, false)
 	case "gets":
 		return p.parseGet(line, parts, true)
+	case "incr":
+		return p.parseIncr(line, parts)
+	case "ma":
+		return p.parseMetaArithmetic(line, parts)
+	case "md":
+		return p.parseMetaDelete(line, parts)
+	case "me":
+		return p.parseMetaDebug(line, parts)
+	case "mg":
+		return p.parseMetaGet(line, parts)
+	case "mn":
+		return MetaNoOpOp{}, nil
+	case "ms":
+		return p.parseMetaSet(line, parts, payload)
+	case "prepend":
+		return p.parsePrepend(line, parts, payload)
 	case "quit":
 		return QuitOp{}, nil
+	case "replace":
+		return p.parseReplace(line, parts, payload)
 	case "set":
 		return p.parseSet(line, parts, payload)
+	case "shutdown":
+		return p.parseShutdown(line, parts)
 	case "stats":
-		return StatsOp{}, nil
+		return p.parseStats(line, parts)
+	case "touch":
+		return p.parseTouch(line, parts)
 	case "version":
 		return VersionOp{}, nil
-	case "add", "append", "cas", "decr", "flush_all", "gat", "gats", "incr", "lru",
-		"lru_crawler", "prepend", "replace", "shutdown", "slabs", "touch", "watch":
+	case "lru",
+		"lru_crawler", "slabs", "watch":
 		// Valid memcached commands that we've chosen not to implement because they
 		// aren't needed for our usecase or their implementation would impact performance
 		// or complexity of the commands we do support (or both).
@@ -133,6 +394,26 @@ func (p *Parser) ParseLine(line string, payload io.Reader) (Op, error) {
 	return nil, core.ErrBadCommand
 }
 
+func (p *Parser) parseAdd(line string, parts []string, payload io.Reader) (*AddOp, error) {
+	set, err := p.parseStorage("add", line, parts, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	op := AddOp(*set)
+	return &op, nil
+}
+
+func (p *Parser) parseAppend(line string, parts []string, payload io.Reader) (*AppendOp, error) {
+	set, err := p.parseStorage("append", line, parts, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	op := AppendOp(*set)
+	return &op, nil
+}
+
 func (p *Parser) parseCacheMemLimit(line string, parts []string) (*CacheMemLimitOp, error) {
 	if len(parts) < 2 {
 		return nil, core.ClientError("bad cache_memlimit command '%s'", line)
@@ -155,6 +436,34 @@ func (p *Parser) parseCacheMemLimit(line string, parts []string) (*CacheMemLimit
 	}, nil
 }
 
+func (p *Parser) parseCloseConn(line string, parts []string) (*CloseConnOp, error) {
+	if len(parts) < 2 {
+		return nil, core.ClientError("bad close_conn command '%s'", line)
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, core.ClientError("bad connection ID '%s': %s", line, err)
+	}
+
+	noreply := len(parts) > 2 && "noreply" == strings.ToLower(parts[2])
+
+	return &CloseConnOp{
+		ID:      id,
+		NoReply: noreply,
+	}, nil
+}
+
+func (p *Parser) parseDecr(line string, parts []string) (*DecrOp, error) {
+	incr, err := p.parseArithmetic("decr", line, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	op := DecrOp(*incr)
+	return &op, nil
+}
+
 func (p *Parser) parseDelete(line string, parts []string) (*DeleteOp, error) {
 	if len(parts) < 2 {
 		return nil, core.ClientError("bad delete command '%s'", line)
@@ -173,6 +482,42 @@ func (p *Parser) parseDelete(line string, parts []string) (*DeleteOp, error) {
 	}, nil
 }
 
+func (p *Parser) parseFlushAll(line string, parts []string) (*FlushAllOp, error) {
+	op := &FlushAllOp{}
+	args := parts[1:]
+
+	if len(args) > 0 && "noreply" != strings.ToLower(args[0]) {
+		delay, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || delay < 0 {
+			return nil, core.ClientError("bad flush_all delay '%s'", line)
+		}
+
+		op.Delay = delay
+		args = args[1:]
+	}
+
+	op.NoReply = len(args) > 0 && "noreply" == strings.ToLower(args[0])
+	return op, nil
+}
+
+func (p *Parser) parseGat(line string, parts []string, unique bool) (*GatOp, error) {
+	if len(parts) < 3 {
+		return nil, core.ClientError("bad gat command '%s'", line)
+	}
+
+	expire, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, core.ClientError("bad expire '%s': %s", line, err)
+	}
+
+	keys, err := validateKeys(parts[2:])
+	if err != nil {
+		return nil, core.ClientError("bad key(s): %s", err)
+	}
+
+	return &GatOp{Keys: keys, Expire: expire, Unique: unique}, nil
+}
+
 func (p *Parser) parseGet(line string, parts []string, unique bool) (*GetOp, error) {
 	if len(parts) < 2 {
 		return nil, core.ClientError("bad get command '%s'", line)
@@ -186,9 +531,47 @@ func (p *Parser) parseGet(line string, parts []string, unique bool) (*GetOp, err
 	return &GetOp{Keys: keys, Unique: unique}, nil
 }
 
-func (p *Parser) parseSet(line string, parts []string, payload io.Reader) (*SetOp, error) {
-	if len(parts) < 5 {
-		return nil, core.ClientError("bad set command '%s'", line)
+func (p *Parser) parseCas(line string, parts []string, payload io.Reader) (*CasOp, error) {
+	if len(parts) < 6 {
+		return nil, core.ClientError("bad cas command '%s'", line)
+	}
+
+	key, flags, expire, length, err := parseStorageHeader(line, parts, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	unique, err := strconv.ParseUint(parts[5], 10, 64)
+	if err != nil {
+		return nil, swallow(payload, length, core.ClientError("bad cas unique '%s': %s", line, err))
+	}
+
+	bytes, err := p.readPayload(length, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	noreply := len(parts) > 6 && "noreply" == strings.ToLower(parts[6])
+
+	return &CasOp{
+		Key:     key,
+		Flags:   flags,
+		Expire:  expire,
+		Unique:  unique,
+		NoReply: noreply,
+		Bytes:   bytes,
+	}, nil
+}
+
+func (p *Parser) parseIncr(line string, parts []string) (*IncrOp, error) {
+	return p.parseArithmetic("incr", line, parts)
+}
+
+// parseArithmetic parses either of the arithmetic commands "incr" and "decr", returning
+// an IncrOp that can be converted to the op type for the specific command.
+func (p *Parser) parseArithmetic(cmd string, line string, parts []string) (*IncrOp, error) {
+	if len(parts) < 3 {
+		return nil, core.ClientError("bad %s command '%s'", cmd, line)
 	}
 
 	key, err := validateKey(parts[1])
@@ -196,43 +579,193 @@ func (p *Parser) parseSet(line string, parts []string, payload io.Reader) (*SetO
 		return nil, core.ClientError("bad key: %s", err)
 	}
 
-	flags, err := strconv.ParseUint(parts[2], 10, 16)
+	delta, err := strconv.ParseUint(parts[2], 10, 64)
 	if err != nil {
-		return nil, core.ClientError("bad flags '%s': %s", line, err)
+		return nil, core.ClientError("invalid numeric delta argument")
 	}
 
-	expire, err := strconv.ParseInt(parts[3], 10, 64)
+	noreply := len(parts) > 3 && "noreply" == strings.ToLower(parts[3])
+
+	return &IncrOp{
+		Key:     key,
+		Delta:   delta,
+		NoReply: noreply,
+	}, nil
+}
+
+func (p *Parser) parsePrepend(line string, parts []string, payload io.Reader) (*PrependOp, error) {
+	set, err := p.parseStorage("prepend", line, parts, payload)
 	if err != nil {
-		return nil, core.ClientError("bad expire '%s': %s", line, err)
+		return nil, err
 	}
 
-	length, err := strconv.ParseUint(parts[4], 10, 64)
+	op := PrependOp(*set)
+	return &op, nil
+}
+
+func (p *Parser) parseReplace(line string, parts []string, payload io.Reader) (*ReplaceOp, error) {
+	set, err := p.parseStorage("replace", line, parts, payload)
 	if err != nil {
-		return nil, core.ClientError("bad bytes length '%s': %s", line, err)
+		return nil, err
 	}
 
-	if length > p.maxItemSize {
-		return nil, core.ErrObjectTooLarge
+	op := ReplaceOp(*set)
+	return &op, nil
+}
+
+func (p *Parser) parseSet(line string, parts []string, payload io.Reader) (*SetOp, error) {
+	return p.parseStorage("set", line, parts, payload)
+}
+
+func (p *Parser) parseShutdown(line string, parts []string) (Op, error) {
+	// Accept the graceful mode for compatibility with memcached clients. Shutting
+	// down is always graceful so there's no difference between the two.
+	if len(parts) > 2 || (len(parts) == 2 && "graceful" != strings.ToLower(parts[1])) {
+		return nil, core.ClientError("invalid shutdown mode '%s'", line)
 	}
 
-	bytes := make([]byte, length+2) // payload and trailing \r\n
-	n, err := io.ReadFull(payload, bytes)
+	return ShutdownOp{}, nil
+}
+
+// parseStorage parses any of the storage commands that share the syntax of "set",
+// returning a SetOp that can be converted to the op type for the specific command.
+func (p *Parser) parseStorage(cmd string, line string, parts []string, payload io.Reader) (*SetOp, error) {
+	if len(parts) < 5 {
+		return nil, core.ClientError("bad %s command '%s'", cmd, line)
+	}
+
+	key, flags, expire, length, err := parseStorageHeader(line, parts, payload)
 	if err != nil {
-		return nil, core.ServerError("unable to read %d+2 payload bytes, only read %d: %s", length, n, err)
+		return nil, err
+	}
+
+	bytes, err := p.readPayload(length, payload)
+	if err != nil {
+		return nil, err
 	}
 
-	bytes = bytes[:length] // truncate trailing \r\n
 	noreply := len(parts) > 5 && "noreply" == strings.ToLower(parts[5])
 
 	return &SetOp{
 		Key:     key,
-		Flags:   uint32(flags),
+		Flags:   flags,
 		Expire:  expire,
 		NoReply: noreply,
 		Bytes:   bytes,
 	}, nil
 }
 
+func (p *Parser) parseStats(line string, parts []string) (Op, error) {
+	if len(parts) > 2 {
+		return nil, core.ClientError("bad stats command '%s'", line)
+	}
+
+	var group string
+	if len(parts) == 2 {
+		group = strings.ToLower(parts[1])
+	}
+
+	return newStatsOp(group)
+}
+
+// newStatsOp returns a StatsOp for a group of statistics if the group is supported.
+func newStatsOp(group string) (Op, error) {
+	switch group {
+	case StatsGeneral, StatsConns, StatsItems, StatsLatency, StatsReset, StatsSettings, StatsSizes:
+		return StatsOp{Group: group}, nil
+	}
+
+	return nil, core.ClientError("unsupported stats group '%s'", group)
+}
+
+func (p *Parser) parseTouch(line string, parts []string) (*TouchOp, error) {
+	if len(parts) < 3 {
+		return nil, core.ClientError("bad touch command '%s'", line)
+	}
+
+	key, err := validateKey(parts[1])
+	if err != nil {
+		return nil, core.ClientError("bad key: %s", err)
+	}
+
+	expire, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, core.ClientError("bad expire '%s': %s", line, err)
+	}
+
+	noreply := len(parts) > 3 && "noreply" == strings.ToLower(parts[3])
+
+	return &TouchOp{
+		Key:     key,
+		Expire:  expire,
+		NoReply: noreply,
+	}, nil
+}
+
+// parseStorageHeader parses the key, flags, expire, and payload length arguments
+// that are common to all storage commands. If the payload length can be parsed but
+// any other argument is invalid, the payload is discarded. Callers must check that
+// parts contains at least five elements.
+func parseStorageHeader(line string, parts []string, payload io.Reader) (string, uint32, int64, uint64, error) {
+	length, err := strconv.ParseUint(parts[4], 10, 64)
+	if err != nil {
+		return "", 0, 0, 0, core.ClientError("bad bytes length '%s': %s", line, err)
+	}
+
+	key, err := validateKey(parts[1])
+	if err != nil {
+		return "", 0, 0, 0, swallow(payload, length, core.ClientError("bad key: %s", err))
+	}
+
+	flags, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		return "", 0, 0, 0, swallow(payload, length, core.ClientError("bad flags '%s': %s", line, err))
+	}
+
+	expire, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return "", 0, 0, 0, swallow(payload, length, core.ClientError("bad expire '%s': %s", line, err))
+	}
+
+	return key, uint32(flags), expire, length, nil
+}
+
+// readPayload reads a data block of length bytes and its trailing \r\n from payload,
+// returning the data block without the trailing \r\n.
+func (p *Parser) readPayload(length uint64, payload io.Reader) ([]byte, error) {
+	if length > p.maxItemSize {
+		return nil, swallow(payload, length, core.ErrObjectTooLarge)
+	}
+
+	bytes := make([]byte, length+2) // payload and trailing \r\n
+	n, err := io.ReadFull(payload, bytes)
+	if err != nil {
+		return nil, core.ServerError("unable to read %d+2 payload bytes, only read %d: %s", length, n, err)
+	}
+
+	if bytes[length] != '\r' || bytes[length+1] != '\n' {
+		return nil, core.ClientError("bad data chunk")
+	}
+
+	return bytes[:length], nil // truncate trailing \r\n
+}
+
+// swallow discards the data block (and trailing \r\n) of length bytes for a storage
+// command that has been rejected so that the next command is read from the start of
+// a line, the same as memcached. The original error is returned unless the data block
+// can't be discarded, which leaves the connection in an unusable state.
+func swallow(payload io.Reader, length uint64, err error) error {
+	if length > math.MaxInt64-2 {
+		return core.ServerError("unable to discard %d+2 payload bytes", length)
+	}
+
+	if n, cErr := io.CopyN(io.Discard, payload, int64(length)+2); cErr != nil {
+		return core.ServerError("unable to discard %d+2 payload bytes, only discarded %d: %s", length, n, cErr)
+	}
+
+	return err
+}
+
 func validateKeys(keys []string) ([]string, error) {
 	for _, k := range keys {
 		_, err := validateKey(k)
@@ -244,8 +777,30 @@ func validateKeys(keys []string) ([]string, error) {
 	return keys, nil
 }
 
+// validateKey checks that a key sent as part of a text command is a valid length
+// and doesn't contain any control characters or whitespace.
 func validateKey(key string) (string, error) {
+	if _, err := validateKeyLength(key); err != nil {
+		return "", err
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return "", fmt.Errorf("invalid character 0x%02x at position %d", key[i], i)
+		}
+	}
+
+	return key, nil
+}
+
+// validateKeyLength checks that a key is a valid length but places no restrictions
+// on its contents, for keys that are binary data (e.g. base64 encoded meta keys).
+func validateKeyLength(key string) (string, error) {
 	length := len(key)
+	if length == 0 {
+		return "", fmt.Errorf("empty key")
+	}
+
 	if length > maxKeySizeBytes {
 		return "", fmt.Errorf("length %d greater than max of %d", length, maxKeySizeBytes)
 	}
@@ -0,0 +1,320 @@
+package proto
+
+import (
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/56quarters/jankcache/server/core"
+)
+
+// parseTest is a command line and payload along with the Op it should be parsed as,
+// or whether it should fail to parse.
+type parseTest struct {
+	name     string
+	line     string
+	payload  string
+	expected Op
+	err      bool
+}
+
+func runParseTests(t *testing.T, tests []parseTest) {
+	t.Helper()
+
+	p := NewParser(1024)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			op, err := p.ParseLine(tc.line, strings.NewReader(tc.payload))
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error parsing %q, got %+v", tc.line, op)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error parsing %q: %s", tc.line, err)
+			}
+
+			if !reflect.DeepEqual(tc.expected, op) {
+				t.Errorf("expected %+v, got %+v", tc.expected, op)
+			}
+		})
+	}
+}
+
+func TestParser_ParseLineWhitespace(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Op
+	}{
+		{line: "get foo ", expected: &GetOp{Keys: []string{"foo"}}},
+		{line: "get  foo  bar", expected: &GetOp{Keys: []string{"foo", "bar"}}},
+		{line: "delete  foo", expected: &DeleteOp{Key: "foo"}},
+		{line: "delete foo  noreply ", expected: &DeleteOp{Key: "foo", NoReply: true}},
+		{line: "incr foo  5", expected: &IncrOp{Key: "foo", Delta: 5}},
+		{line: " touch foo 10", expected: &TouchOp{Key: "foo", Expire: 10}},
+		{line: "mg foo  v ", expected: &MetaGetOp{Key: "foo", MetaFlags: MetaFlags{ReturnValue: true}}},
+	}
+
+	p := NewParser(1024)
+	for _, tc := range tests {
+		t.Run(tc.line, func(t *testing.T) {
+			op, err := p.ParseLine(tc.line, strings.NewReader(""))
+			if err != nil {
+				t.Fatalf("unexpected error parsing %q: %s", tc.line, err)
+			}
+
+			if !reflect.DeepEqual(tc.expected, op) {
+				t.Errorf("expected %+v, got %+v", tc.expected, op)
+			}
+		})
+	}
+}
+
+func TestParser_ParseLineEmpty(t *testing.T) {
+	p := NewParser(1024)
+	for _, line := range []string{"", " ", "   "} {
+		if _, err := p.ParseLine(line, strings.NewReader("")); !errors.Is(err, core.ErrBadCommand) {
+			t.Errorf("expected bad command error for %q, got %v", line, err)
+		}
+	}
+}
+
+func TestParser_ParseCas(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "cas",
+			line:     "cas foo 5 60 3 10",
+			payload:  "bar\r\n",
+			expected: &CasOp{Key: "foo", Flags: 5, Expire: 60, Unique: 10, Bytes: []byte("bar")},
+		},
+		{
+			name:     "noreply",
+			line:     "cas foo 0 0 3 10 noreply",
+			payload:  "bar\r\n",
+			expected: &CasOp{Key: "foo", Unique: 10, NoReply: true, Bytes: []byte("bar")},
+		},
+		{
+			name:    "missing unique",
+			line:    "cas foo 0 0 3",
+			payload: "bar\r\n",
+			err:     true,
+		},
+		{
+			name:    "invalid unique",
+			line:    "cas foo 0 0 3 abc",
+			payload: "bar\r\n",
+			err:     true,
+		},
+	})
+}
+
+func TestParser_ParseAddReplace(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "add",
+			line:     "add foo 5 60 3",
+			payload:  "bar\r\n",
+			expected: &AddOp{Key: "foo", Flags: 5, Expire: 60, Bytes: []byte("bar")},
+		},
+		{
+			name:     "replace noreply",
+			line:     "replace foo 0 0 3 noreply",
+			payload:  "bar\r\n",
+			expected: &ReplaceOp{Key: "foo", NoReply: true, Bytes: []byte("bar")},
+		},
+		{
+			name:    "add missing length",
+			line:    "add foo 0 0",
+			payload: "bar\r\n",
+			err:     true,
+		},
+		{
+			name:    "replace invalid flags",
+			line:    "replace foo abc 0 3",
+			payload: "bar\r\n",
+			err:     true,
+		},
+	})
+}
+
+func TestParser_ParseAppendPrepend(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "append",
+			line:     "append foo 0 0 3",
+			payload:  "bar\r\n",
+			expected: &AppendOp{Key: "foo", Bytes: []byte("bar")},
+		},
+		{
+			name:     "prepend noreply",
+			line:     "prepend foo 0 0 3 noreply",
+			payload:  "bar\r\n",
+			expected: &PrependOp{Key: "foo", NoReply: true, Bytes: []byte("bar")},
+		},
+		{
+			name:    "append missing payload terminator",
+			line:    "append foo 0 0 3",
+			payload: "barbaz",
+			err:     true,
+		},
+	})
+}
+
+func TestParser_ParseIncrDecr(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "incr",
+			line:     "incr foo 5",
+			expected: &IncrOp{Key: "foo", Delta: 5},
+		},
+		{
+			name:     "decr noreply",
+			line:     "decr foo 18446744073709551615 noreply",
+			expected: &DecrOp{Key: "foo", Delta: math.MaxUint64, NoReply: true},
+		},
+		{
+			name: "negative delta",
+			line: "incr foo -1",
+			err:  true,
+		},
+		{
+			name: "delta too large",
+			line: "decr foo 18446744073709551616",
+			err:  true,
+		},
+		{
+			name: "missing delta",
+			line: "incr foo",
+			err:  true,
+		},
+	})
+}
+
+func TestParser_ParseTouchGat(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:     "touch",
+			line:     "touch foo 60 noreply",
+			expected: &TouchOp{Key: "foo", Expire: 60, NoReply: true},
+		},
+		{
+			name:     "gat",
+			line:     "gat 60 foo bar",
+			expected: &GatOp{Keys: []string{"foo", "bar"}, Expire: 60},
+		},
+		{
+			name:     "gats",
+			line:     "gats -1 foo",
+			expected: &GatOp{Keys: []string{"foo"}, Expire: -1, Unique: true},
+		},
+		{
+			name: "touch invalid expire",
+			line: "touch foo abc",
+			err:  true,
+		},
+		{
+			name: "gat missing keys",
+			line: "gat 60",
+			err:  true,
+		},
+	})
+}
+
+func TestParser_ParseFlushAll(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{name: "no args", line: "flush_all", expected: &FlushAllOp{}},
+		{name: "delay", line: "flush_all 60", expected: &FlushAllOp{Delay: 60}},
+		{name: "noreply", line: "flush_all noreply", expected: &FlushAllOp{NoReply: true}},
+		{name: "delay noreply", line: "flush_all 60 noreply", expected: &FlushAllOp{Delay: 60, NoReply: true}},
+		{name: "negative delay", line: "flush_all -1", err: true},
+		{name: "invalid delay", line: "flush_all abc", err: true},
+	})
+}
+
+func TestParser_ParseCloseConn(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{name: "id", line: "close_conn 12", expected: &CloseConnOp{ID: 12}},
+		{name: "noreply", line: "close_conn 12 noreply", expected: &CloseConnOp{ID: 12, NoReply: true}},
+		{name: "missing id", line: "close_conn", err: true},
+		{name: "invalid id", line: "close_conn abc", err: true},
+	})
+}
+
+func TestParser_ParseShutdown(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{name: "no mode", line: "shutdown", expected: ShutdownOp{}},
+		{name: "graceful", line: "shutdown graceful", expected: ShutdownOp{}},
+		{name: "invalid mode", line: "shutdown now", err: true},
+		{name: "too many args", line: "shutdown graceful now", err: true},
+	})
+}
+
+func TestParser_ParseStats(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{name: "general", line: "stats", expected: StatsOp{}},
+		{name: "settings", line: "stats settings", expected: StatsOp{Group: StatsSettings}},
+		{name: "items", line: "stats items", expected: StatsOp{Group: StatsItems}},
+		{name: "sizes", line: "stats sizes", expected: StatsOp{Group: StatsSizes}},
+		{name: "conns", line: "stats conns", expected: StatsOp{Group: StatsConns}},
+		{name: "reset", line: "stats reset", expected: StatsOp{Group: StatsReset}},
+		{name: "case insensitive", line: "stats SETTINGS", expected: StatsOp{Group: StatsSettings}},
+		{name: "unsupported group", line: "stats slabs", err: true},
+		{name: "too many args", line: "stats settings items", err: true},
+	})
+}
+
+func TestParser_ParseLineSwallowsRejectedPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		err  error
+	}{
+		{name: "bad key", line: "set foo\x01 0 0 5"},
+		{name: "bad flags", line: "set foo abc 0 5"},
+		{name: "bad expire", line: "add foo 0 abc 5"},
+		{name: "too large", line: "set foo 0 0 5000", err: core.ErrObjectTooLarge},
+		{name: "bad cas unique", line: "cas foo 0 0 5 abc"},
+		{name: "bad meta flags", line: "ms foo 5 MX"},
+		{name: "bad meta key", line: "ms foo\x01 5"},
+	}
+
+	p := NewParser(1024)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			length := 5
+			if tc.err != nil {
+				length = 5000
+			}
+
+			payload := strings.NewReader(strings.Repeat("a", length) + "\r\nget foo\r\n")
+			_, err := p.ParseLine(tc.line, payload)
+			if err == nil {
+				t.Fatalf("expected error parsing %q", tc.line)
+			}
+
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+
+			// The next command must be read from the start of its line
+			rest, _ := io.ReadAll(payload)
+			if string(rest) != "get foo\r\n" {
+				t.Errorf("expected payload to be discarded, got remaining %q", rest)
+			}
+		})
+	}
+}
+
+func TestParser_ParseLineSwallowTruncated(t *testing.T) {
+	// The data block can't be discarded so the connection is no longer usable
+	_, err := NewParser(1024).ParseLine("set foo abc 0 5", strings.NewReader("aa"))
+	if !errors.Is(err, core.ErrServer) {
+		t.Errorf("expected server error, got %v", err)
+	}
+}
@@ -2,29 +2,48 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 
 	"github.com/56quarters/jankcache/server/cache"
 	"github.com/56quarters/jankcache/server/proto"
 )
 
 type Config struct {
-	Cache  cache.Config
-	Server TCPConfig
-	Debug  DebugConfig
+	Auth    AuthConfig
+	Cache   cache.Config
+	Server  TCPConfig
+	UDP     UDPConfig
+	Unix    UnixConfig
+	SlowLog SlowLogConfig
+	Tenant  TenantConfig
+	Debug   DebugConfig
 }
 
 func (c *Config) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	c.Auth.RegisterFlags(prefix+"auth.", fs)
 	c.Cache.RegisterFlags(prefix+"cache.", fs)
 	c.Server.RegisterFlags(prefix+"server.", fs)
+	c.UDP.RegisterFlags(prefix+"server.udp-", fs)
+	c.Unix.RegisterFlags(prefix+"server.unix-", fs)
+	c.SlowLog.RegisterFlags(prefix+"server.slow-command-", fs)
+	c.Tenant.RegisterFlags(prefix+"tenant.", fs)
 	c.Debug.RegisterFlags(prefix+"debug.", fs)
 }
 
 func (c *Config) Validate() error {
+	if err := c.Auth.Validate(); err != nil {
+		return err
+	}
+
 	if err := c.Cache.Validate(); err != nil {
 		return err
 	}
@@ -33,15 +52,38 @@ func (c *Config) Validate() error {
 		return err
 	}
 
+	if err := c.UDP.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Unix.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.SlowLog.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tenant.Validate(); err != nil {
+		return err
+	}
+
+	if c.Tenant.Mode == TenantModeUser && c.Auth.CredentialsFile == "" {
+		return fmt.Errorf("authentication must be enabled for tenant mode '%s'", c.Tenant.Mode)
+	}
+
 	return c.Debug.Validate()
 }
 
 type Server struct {
 	services.Service
 
-	logger  log.Logger
-	manager *services.Manager
-	watcher *services.FailureWatcher
+	delay    time.Duration
+	shutdown *Shutdown
+	logger   log.Logger
+	manager  *services.Manager
+	watcher  *services.FailureWatcher
+	tenants  *Tenants
 }
 
 func New(cfg Config, logger log.Logger) (*Server, error) {
@@ -54,12 +96,49 @@ func New(cfg Config, logger log.Logger) (*Server, error) {
 
 	rtCtx := NewRuntimeContext()
 	parser := proto.NewParser(cfg.Cache.MaxItemSize)
-	handler := NewHandler(cache.New(cfg.Cache, logger), parser, metrics, rtCtx)
-	tcpSrv := NewTCPServer(cfg.Server, handler, metrics, logger)
+	var credentials *Credentials
+	if cfg.Auth.CredentialsFile != "" {
+		creds, err := LoadCredentials(cfg.Auth.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+
+		credentials = creds
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	conns := NewConnections()
+	tenants := NewTenants(cfg.Tenant, cfg.Cache, logger)
+	reg.MustRegister(NewCollector(tenants, metrics, rtCtx))
+
+	shutdown := NewShutdown()
+	handler := NewHandler(tenants, parser, credentials, metrics, NewCommandMetrics(reg), NewSlowLog(cfg.SlowLog, logger), conns, NewSettings(cfg), shutdown, rtCtx)
+	srvs := []services.Service{rtCtx}
+
+	var tlsConfig *tls.Config
+	if cfg.Server.TLS.Enabled() {
+		reloader, err := NewTLSReloader(cfg.Server.TLS, logger)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+
+		tlsConfig = reloader.Config()
+		srvs = append(srvs, reloader)
+	}
+
+	srvs = append(srvs, NewTCPServer(cfg.Server, tlsConfig, handler, conns, metrics, logger))
+	if cfg.UDP.Address != "" {
+		srvs = append(srvs, NewUDPServer(cfg.UDP, handler, metrics, logger))
+	}
+
+	if cfg.Unix.Path != "" {
+		srvs = append(srvs, NewUnixServer(cfg.Unix, cfg.Server, handler, conns, metrics, logger))
+	}
 
-	srvs := []services.Service{rtCtx, tcpSrv}
 	if cfg.Debug.Enabled {
-		srvs = append(srvs, NewDebugServer(cfg.Debug, logger))
+		srvs = append(srvs, NewDebugServer(cfg.Debug, reg, conns, logger))
 	}
 
 	manager, err := services.NewManager(srvs...)
@@ -71,9 +150,12 @@ func New(cfg Config, logger log.Logger) (*Server, error) {
 	watcher.WatchManager(manager)
 
 	s := &Server{
-		logger:  logger,
-		manager: manager,
-		watcher: watcher,
+		delay:    cfg.Server.ShutdownDelay,
+		shutdown: shutdown,
+		logger:   logger,
+		manager:  manager,
+		watcher:  watcher,
+		tenants:  tenants,
 	}
 
 	s.Service = services.NewBasicService(s.starting, s.loop, s.stopping)
@@ -81,7 +163,19 @@ func New(cfg Config, logger log.Logger) (*Server, error) {
 }
 
 func (s *Server) starting(ctx context.Context) error {
-	return services.StartManagerAndAwaitHealthy(ctx, s.manager)
+	// Subservices aren't started with the context of this service since it's cancelled
+	// as soon as this service is asked to stop. They need to keep running until after the
+	// shutdown delay and are stopped explicitly instead.
+	if err := s.manager.StartAsync(context.Background()); err != nil {
+		return err
+	}
+
+	if err := s.manager.AwaitHealthy(ctx); err != nil {
+		_ = services.StopManagerAndAwaitStopped(context.Background(), s.manager)
+		return err
+	}
+
+	return nil
 }
 
 func (s *Server) loop(ctx context.Context) error {
@@ -89,12 +183,29 @@ func (s *Server) loop(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-s.shutdown.Requested():
+			level.Info(s.logger).Log("msg", "stopping on shutdown command")
+			return nil
 		case err := <-s.watcher.Chan():
 			return fmt.Errorf("subservice error: %w", err)
 		}
 	}
 }
 
-func (s *Server) stopping(_ error) error {
-	return services.StopManagerAndAwaitStopped(context.Background(), s.manager)
+func (s *Server) stopping(err error) error {
+	// Keep running commands for a while before stopping so that load balancers have a
+	// chance to stop sending new connections here. There's no point if a subservice
+	// has already failed.
+	if err == nil && s.delay > 0 {
+		level.Info(s.logger).Log("msg", "waiting before stopping", "delay", s.delay)
+		time.Sleep(s.delay)
+	}
+
+	if err := services.StopManagerAndAwaitStopped(context.Background(), s.manager); err != nil {
+		return err
+	}
+
+	// Caches are closed once the servers using them have stopped
+	s.tenants.Close()
+	return nil
 }
@@ -0,0 +1,26 @@
+package server
+
+import "sync"
+
+// Shutdown is used by clients to ask the server to stop, e.g. with the `shutdown`
+// command. The server stops the same way it does when it receives a signal.
+type Shutdown struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func NewShutdown() *Shutdown {
+	return &Shutdown{ch: make(chan struct{})}
+}
+
+// Request asks the server to stop. Calling it more than once has no effect.
+func (s *Shutdown) Request() {
+	s.once.Do(func() {
+		close(s.ch)
+	})
+}
+
+// Requested returns a channel that is closed once the server has been asked to stop.
+func (s *Shutdown) Requested() <-chan struct{} {
+	return s.ch
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+type SlowLogConfig struct {
+	Threshold time.Duration
+	MaxPerSec uint64
+}
+
+func (c *SlowLogConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	fs.DurationVar(&c.Threshold, prefix+"threshold", 0, "Log commands that take longer than this to parse, execute, and write a response for. Set to 0 to disable")
+	fs.Uint64Var(&c.MaxPerSec, prefix+"max-per-second", 10, "Max number of slow commands to log each second. Commands over the limit are counted and the count is included with the next one logged")
+}
+
+func (c *SlowLogConfig) Validate() error {
+	if c.Threshold > 0 && c.MaxPerSec == 0 {
+		return fmt.Errorf("slow command max per second must be at least 1 when the threshold is set")
+	}
+
+	return nil
+}
+
+// SlowLog logs commands that take longer than a threshold to run. The number of commands
+// logged each second is limited so that a slow server doesn't also flood its logs.
+type SlowLog struct {
+	threshold time.Duration
+	maxPerSec uint64
+	logger    log.Logger
+
+	second  atomic.Int64
+	logged  atomic.Uint64
+	skipped atomic.Uint64
+}
+
+func NewSlowLog(config SlowLogConfig, logger log.Logger) *SlowLog {
+	return &SlowLog{
+		threshold: config.Threshold,
+		maxPerSec: config.MaxPerSec,
+		logger:    logger,
+	}
+}
+
+// Observe logs a command from remote that ended at end if it was slow.
+func (s *SlowLog) Observe(remote net.Addr, cmd *command, end time.Time) {
+	elapsed := end.Sub(cmd.start)
+	if s.threshold <= 0 || elapsed < s.threshold {
+		return
+	}
+
+	if !s.allow(end) {
+		s.skipped.Add(1)
+		return
+	}
+
+	parse, execute, encode := cmd.phases(end)
+	level.Warn(s.logger).Log(
+		"msg", "slow command",
+		"remote", remote,
+		"op", cmd.op.Type(),
+		"keys", opKeys(cmd.op),
+		"payload_bytes", opPayloadSize(cmd.op),
+		"duration", elapsed,
+		"parse", parse,
+		"execute", execute,
+		"encode", encode,
+		"skipped", s.skipped.Swap(0),
+	)
+}
+
+// allow returns true if another command can be logged during the current second. This
+// is approximate: a few extra commands may be logged when a new second starts.
+func (s *SlowLog) allow(now time.Time) bool {
+	second := now.Unix()
+	if prev := s.second.Load(); prev != second && s.second.CompareAndSwap(prev, second) {
+		s.logged.Store(0)
+	}
+
+	return s.logged.Add(1) <= s.maxPerSec
+}
+
+// opKeys returns the number of keys an operation is for.
+func opKeys(op proto.Op) int {
+	switch o := op.(type) {
+	case *proto.GetOp:
+		return len(o.Keys)
+	case *proto.GatOp:
+		return len(o.Keys)
+	case *proto.AddOp, *proto.AppendOp, *proto.CasOp, *proto.DecrOp, *proto.DeleteOp, *proto.IncrOp,
+		*proto.MetaArithmeticOp, *proto.MetaDebugOp, *proto.MetaDeleteOp, *proto.MetaGetOp, *proto.MetaSetOp,
+		*proto.PrependOp, *proto.ReplaceOp, *proto.SetOp, *proto.TouchOp:
+		return 1
+	}
+
+	return 0
+}
+
+// opPayloadSize returns the size of the value sent with an operation, zero if the
+// operation doesn't include a value.
+func opPayloadSize(op proto.Op) int {
+	switch o := op.(type) {
+	case *proto.AddOp:
+		return len(o.Bytes)
+	case *proto.AppendOp:
+		return len(o.Bytes)
+	case *proto.CasOp:
+		return len(o.Bytes)
+	case *proto.MetaSetOp:
+		return len(o.Bytes)
+	case *proto.PrependOp:
+		return len(o.Bytes)
+	case *proto.ReplaceOp:
+		return len(o.Bytes)
+	case *proto.SetOp:
+		return len(o.Bytes)
+	}
+
+	return 0
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// slowCommand returns a command that started at start and took the given time to
+// parse, execute, and encode, along with the time it ended.
+func slowCommand(op proto.Op, start time.Time, parse, execute, encode time.Duration) (*command, time.Time) {
+	cmd := &command{
+		op:       op,
+		start:    start,
+		parsed:   start.Add(parse),
+		executed: start.Add(parse + execute),
+	}
+
+	return cmd, cmd.executed.Add(encode)
+}
+
+func TestCommand_Phases(t *testing.T) {
+	start := time.Now()
+	cmd, end := slowCommand(&proto.GetOp{}, start, time.Millisecond, 2*time.Millisecond, 3*time.Millisecond)
+
+	parse, execute, encode := cmd.phases(end)
+	if parse != time.Millisecond || execute != 2*time.Millisecond || encode != 3*time.Millisecond {
+		t.Errorf("expected phases of 1ms, 2ms, and 3ms, got %s, %s, %s", parse, execute, encode)
+	}
+
+	// Commands without a response spend no time encoding one
+	cmd.executed = time.Time{}
+	if _, execute, encode := cmd.phases(end); execute != 5*time.Millisecond || encode != 0 {
+		t.Errorf("expected execute of 5ms and no encoding, got %s, %s", execute, encode)
+	}
+}
+
+func TestSlowLog_Threshold(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSlowLog(SlowLogConfig{Threshold: 10 * time.Millisecond, MaxPerSec: 10}, log.NewLogfmtLogger(&buf))
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	start := time.Now()
+
+	cmd, end := slowCommand(&proto.GetOp{Keys: []string{"a"}}, start, 0, time.Millisecond, 0)
+	s.Observe(remote, cmd, end)
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected fast command not to be logged, got %q", buf.String())
+	}
+
+	cmd, end = slowCommand(&proto.SetOp{Key: "a", Bytes: []byte("value")}, start, time.Millisecond, 20*time.Millisecond, time.Millisecond)
+	s.Observe(remote, cmd, end)
+
+	out := buf.String()
+	for _, expected := range []string{"remote=127.0.0.1:1234", "op=set", "keys=1", "payload_bytes=5", "duration=22ms", "execute=20ms", "skipped=0"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected slow command log to include %q, got %q", expected, out)
+		}
+	}
+}
+
+func TestSlowLog_Disabled(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSlowLog(SlowLogConfig{MaxPerSec: 10}, log.NewLogfmtLogger(&buf))
+
+	cmd, end := slowCommand(&proto.GetOp{}, time.Now(), 0, time.Hour, 0)
+	s.Observe(nil, cmd, end)
+
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be logged without a threshold, got %q", buf.String())
+	}
+}
+
+func TestSlowLog_Sampled(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSlowLog(SlowLogConfig{Threshold: time.Millisecond, MaxPerSec: 2}, log.NewLogfmtLogger(&buf))
+	second := time.Unix(1000, 0)
+
+	for i := 0; i < 5; i++ {
+		cmd, end := slowCommand(&proto.GetOp{}, second, 0, 10*time.Millisecond, 0)
+		s.Observe(nil, cmd, end)
+	}
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Fatalf("expected 2 commands to be logged, got %d", lines)
+	}
+
+	// The first command logged in the next second includes the count of those skipped
+	buf.Reset()
+	cmd, end := slowCommand(&proto.GetOp{}, second.Add(time.Second), 0, 10*time.Millisecond, 0)
+	s.Observe(nil, cmd, end)
+
+	if out := buf.String(); !strings.Contains(out, "skipped=3") {
+		t.Errorf("expected 3 skipped commands to be logged, got %q", out)
+	}
+}
+
+func TestOpKeysPayloadSize(t *testing.T) {
+	tests := []struct {
+		op      proto.Op
+		keys    int
+		payload int
+	}{
+		{op: &proto.GetOp{Keys: []string{"a", "b", "c"}}, keys: 3},
+		{op: &proto.GatOp{Keys: []string{"a", "b"}}, keys: 2},
+		{op: &proto.SetOp{Key: "a", Bytes: []byte("value")}, keys: 1, payload: 5},
+		{op: &proto.MetaSetOp{Key: "a", Bytes: []byte("val")}, keys: 1, payload: 3},
+		{op: &proto.DeleteOp{Key: "a"}, keys: 1},
+		{op: &proto.FlushAllOp{}},
+		{op: proto.VersionOp{}},
+	}
+
+	for _, tc := range tests {
+		if keys, payload := opKeys(tc.op), opPayloadSize(tc.op); keys != tc.keys || payload != tc.payload {
+			t.Errorf("expected %d keys and %d payload bytes for %s, got %d and %d", tc.keys, tc.payload, tc.op.Type(), keys, payload)
+		}
+	}
+}
+
+func TestSlowLogConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SlowLogConfig
+		err  bool
+	}{
+		{name: "disabled", cfg: SlowLogConfig{}},
+		{name: "enabled", cfg: SlowLogConfig{Threshold: time.Millisecond, MaxPerSec: 1}},
+		{name: "no commands per second", cfg: SlowLogConfig{Threshold: time.Millisecond}, err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.Validate(); (err != nil) != tc.err {
+				t.Errorf("expected error %t, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -2,17 +2,18 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/grafana/dskit/runutil"
 	"github.com/grafana/dskit/services"
 
 	"github.com/56quarters/jankcache/server/core"
@@ -22,47 +23,98 @@ type TCPConfig struct {
 	Address        string
 	IdleTimeout    time.Duration
 	MaxConnections uint64
+	DrainTimeout   time.Duration
+	ShutdownDelay  time.Duration
+	EnableShutdown bool
+	MaxLineSize    int
+	TLS            TLSConfig
 }
 
 func (c *TCPConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
 	fs.StringVar(&c.Address, prefix+"address", "localhost:11211", "Address and port for the cache server to bind to")
 	fs.DurationVar(&c.IdleTimeout, prefix+"idle-timeout", 0, "Max time a connection can be idle before being closed. Set to 0 to disable")
 	fs.Uint64Var(&c.MaxConnections, prefix+"max-connections", 1024, "Max number of client connections that can be open at once. Set to 0 to disable limit")
+	fs.DurationVar(&c.DrainTimeout, prefix+"drain-timeout", 10*time.Second, "Max time to wait for connections to finish their current command when shutting down before closing them. Set to 0 to close connections immediately")
+	fs.DurationVar(&c.ShutdownDelay, prefix+"shutdown-delay", 0, "Time to keep accepting connections and running commands after being asked to shut down, before draining connections. Allows load balancers to stop sending traffic first. Set to 0 to disable")
+	fs.IntVar(&c.MaxLineSize, prefix+"max-line-size", 65_536, "Max length of a command line in bytes, not including any value sent with it. Longer lines are rejected with an error")
+	fs.BoolVar(&c.EnableShutdown, prefix+"enable-shutdown", false, "Allow clients to stop the server with the shutdown command and close other client connections with the close_conn command. Clients must also be admins if authentication is enabled")
+	c.TLS.RegisterFlags(prefix+"tls-", fs)
 }
 
 func (c *TCPConfig) Validate() error {
-	return nil
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("drain timeout must not be negative")
+	}
+
+	if c.ShutdownDelay < 0 {
+		return fmt.Errorf("shutdown delay must not be negative")
+	}
+
+	if c.MaxLineSize < 1 {
+		return fmt.Errorf("invalid value for max-line-size: %d", c.MaxLineSize)
+	}
+
+	return c.TLS.Validate()
 }
 
 type TCPServer struct {
 	services.Service
 
-	config   TCPConfig
-	handler  *Handler
-	metrics  *Metrics
-	listener net.Listener
-	logger   log.Logger
+	config    TCPConfig
+	tlsConfig *tls.Config
+	handler   *Handler
+	conns     *Connections
+	metrics   *Metrics
+	listen    func(ctx context.Context) (net.Listener, error)
+	listener  net.Listener
+	logger    log.Logger
+
+	// Connections accepted by this server and the goroutines handling them, tracked
+	// so that they can be drained when the server is stopped.
+	mtx      sync.Mutex
+	draining bool
+	active   map[*bufferedConnection]struct{}
+	handlers sync.WaitGroup
 }
 
-func NewTCPServer(config TCPConfig, handler *Handler, metrics *Metrics, logger log.Logger) *TCPServer {
+// NewTCPServer creates a server for TCP connections. Connections use TLS when tlsConfig
+// is not nil.
+func NewTCPServer(config TCPConfig, tlsConfig *tls.Config, handler *Handler, conns *Connections, metrics *Metrics, logger log.Logger) *TCPServer {
 	s := &TCPServer{
-		config:  config,
-		handler: handler,
-		metrics: metrics,
-		logger:  logger,
+		config:    config,
+		tlsConfig: tlsConfig,
+		handler:   handler,
+		conns:     conns,
+		metrics:   metrics,
+		logger:    logger,
+		active:    make(map[*bufferedConnection]struct{}),
 	}
 
+	s.listen = s.listenTCP
 	s.Service = services.NewBasicService(s.start, s.loop, s.stop)
 	return s
 }
 
-func (s *TCPServer) start(ctx context.Context) error {
-	level.Info(s.logger).Log("msg", "starting TCP server", "address", s.config.Address)
+func (s *TCPServer) listenTCP(ctx context.Context) (net.Listener, error) {
+	level.Info(s.logger).Log("msg", "starting TCP server", "address", s.config.Address, "tls", s.tlsConfig != nil)
 
 	var lc net.ListenConfig
 	listener, err := lc.Listen(ctx, "tcp", s.config.Address)
 	if err != nil {
-		return fmt.Errorf("unable to bind to %s: %w", s.config.Address, err)
+		return nil, fmt.Errorf("unable to bind to %s: %w", s.config.Address, err)
+	}
+
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+
+	return listener, nil
+}
+
+func (s *TCPServer) start(ctx context.Context) error {
+	listener, err := s.listen(ctx)
+	if err != nil {
+		return err
 	}
 
 	s.listener = listener
@@ -93,7 +145,11 @@ func (s *TCPServer) loop(ctx context.Context) error {
 		}
 
 		level.Debug(s.logger).Log("msg", "accepting connection", "remote", conn.RemoteAddr())
-		go s.handle(conn)
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handle(conn)
+		}()
 	}
 }
 
@@ -102,9 +158,98 @@ func (s *TCPServer) stop(err error) error {
 		level.Error(s.logger).Log("msg", "stopping TCP server due to error", "err", err)
 	}
 
+	s.drain()
 	return nil
 }
 
+// drain waits for connections to finish the command they are running, if any, and
+// closes them. Connections still running a command after the drain timeout are closed
+// without waiting for them to finish.
+func (s *TCPServer) drain() {
+	if n := s.closeIdle(); n > 0 {
+		level.Info(s.logger).Log("msg", "draining connections", "busy", n, "timeout", s.config.DrainTimeout)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	timeout := time.NewTimer(s.config.DrainTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-done:
+		level.Debug(s.logger).Log("msg", "all connections drained")
+	case <-timeout.C:
+		level.Warn(s.logger).Log("msg", "closing connections still running commands after drain timeout", "remaining", s.closeAll())
+	}
+}
+
+// closeIdle marks the server as draining so that connections exit after their current
+// command and interrupts connections waiting for a command so that they exit as well.
+// Returns the number of connections in the middle of a command.
+func (s *TCPServer) closeIdle() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Connections set their idle deadline and state before checking if the server is
+	// draining, so any connection that missed the check is waiting for a command or still
+	// doing the TLS handshake and is interrupted here. Reads are interrupted instead of
+	// closing the connection so that responses to pipelined commands are still flushed.
+	s.draining = true
+	busy := 0
+	for conn := range s.active {
+		if !conn.interruptIfIdle() {
+			busy++
+		}
+	}
+
+	return busy
+}
+
+// closeAll closes every connection, interrupting any command they are running. Returns
+// the number of connections closed.
+func (s *TCPServer) closeAll() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for conn := range s.active {
+		_ = conn.conn.Close()
+	}
+
+	return len(s.active)
+}
+
+// track adds a connection to the set that will be drained when the server is stopped,
+// returning false if the server is already draining and the connection should be closed.
+func (s *TCPServer) track(conn *bufferedConnection) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.active[conn] = struct{}{}
+	return true
+}
+
+func (s *TCPServer) untrack(conn *bufferedConnection) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.active, conn)
+}
+
+func (s *TCPServer) isDraining() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.draining
+}
+
 func (s *TCPServer) shutdown(ctx context.Context) {
 	<-ctx.Done()
 	level.Debug(s.logger).Log("msg", "shutting down TCP server")
@@ -122,27 +267,84 @@ func (s *TCPServer) handle(conn net.Conn) {
 
 	defer func() {
 		s.metrics.CurrentConnections.Add(-1)
-		runutil.CloseWithLogOnErr(s.logger, conn, "closing connection")
+		// Connections closed by the server, with `close_conn` or after the drain timeout,
+		// are already closed by the time they get here.
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			level.Warn(s.logger).Log("msg", "error closing connection", "remote", conn.RemoteAddr(), "err", err)
+		}
 	}()
 
 	currConnections := s.metrics.CurrentConnections.Load()
 	if s.config.MaxConnections > 0 && currConnections > int64(s.config.MaxConnections) {
 		s.metrics.RejectedConnections.Add(1)
+		// Writing the error to a TLS connection performs the handshake first, which
+		// needs the same timeout as handshakes for connections that are accepted.
+		if _, ok := conn.(*tls.Conn); ok {
+			if err := conn.SetDeadline(time.Now().Add(s.config.TLS.HandshakeTimeout)); err != nil {
+				level.Error(s.logger).Log("msg", "unable to set TLS handshake timeout on connection", "remote", conn.RemoteAddr(), "err", err)
+				return
+			}
+		}
+
 		s.handler.Reject(conn, "max connections")
 		level.Debug(s.logger).Log("msg", "server at max connections", "current", currConnections, "max", s.config.MaxConnections)
 		return
 	}
 
+	// Connections are tracked before the TLS handshake so that they can be closed if
+	// the server starts draining during the handshake.
+	buffered := newBufferedConnection(conn, s.metrics)
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS {
+		buffered.setState(connStateHandshake)
+	}
+
+	s.conns.add(buffered)
+	defer func() {
+		s.conns.remove(buffered)
+		_ = buffered.Close()
+	}()
+
+	if !s.track(buffered) {
+		level.Debug(s.logger).Log("msg", "closing connection accepted while shutting down", "remote", conn.RemoteAddr())
+		return
+	}
+
+	defer s.untrack(buffered)
+
+	if isTLS {
+		if !s.handshake(tlsConn) {
+			return
+		}
+
+		buffered.setState(connStateReading)
+		s.metrics.CurrentTLSConnections.Add(1)
+		s.metrics.TotalTLSConnections.Add(1)
+		defer s.metrics.CurrentTLSConnections.Add(-1)
+	}
+
+	var handle func(*bufferedConnection) error
 	for {
 		if s.config.IdleTimeout > 0 {
-			err := conn.SetDeadline(time.Now().Add(s.config.IdleTimeout))
+			err := buffered.setDeadline(time.Now().Add(s.config.IdleTimeout))
 			if err != nil {
 				level.Error(s.logger).Log("msg", "unable to set idle timeout on connection", "remote", conn.RemoteAddr(), "err", err)
 				return
 			}
 		}
 
-		err := s.handler.Handle(conn)
+		// Checked after setting the idle timeout so that it can't replace the deadline
+		// set to interrupt idle connections when the server starts draining.
+		if s.isDraining() {
+			level.Debug(s.logger).Log("msg", "closing connection for shutdown", "remote", conn.RemoteAddr())
+			return
+		}
+
+		if handle == nil {
+			handle = s.handler.detect(buffered)
+		}
+
+		err := handle(buffered)
 		if errors.Is(err, os.ErrDeadlineExceeded) {
 			level.Debug(s.logger).Log("msg", "closing idle connection", "remote", conn.RemoteAddr())
 			return
@@ -152,9 +354,38 @@ func (s *TCPServer) handle(conn net.Conn) {
 		} else if errors.Is(err, core.ErrQuit) {
 			level.Debug(s.logger).Log("msg", "client quit", "remote", conn.RemoteAddr())
 			return
+		} else if errors.Is(err, net.ErrClosed) {
+			level.Debug(s.logger).Log("msg", "connection closed by server", "remote", conn.RemoteAddr())
+			return
 		} else if err != nil {
 			level.Warn(s.logger).Log("msg", "error handling connection", "remote", conn.RemoteAddr(), "err", err)
 			return
 		}
 	}
 }
+
+// handshake performs the TLS handshake for a connection up front, rather than as part
+// of the first read, so that failures can be counted and logged separately from other
+// errors. The handshake always has a timeout, even if idle connections are allowed, so
+// that clients can't hold connections open without ever sending anything. Returns false
+// if the handshake failed.
+func (s *TCPServer) handshake(conn *tls.Conn) bool {
+	if err := conn.SetDeadline(time.Now().Add(s.config.TLS.HandshakeTimeout)); err != nil {
+		level.Error(s.logger).Log("msg", "unable to set TLS handshake timeout on connection", "remote", conn.RemoteAddr(), "err", err)
+		return false
+	}
+
+	if err := conn.Handshake(); err != nil {
+		s.metrics.TLSHandshakeErrors.Add(1)
+		level.Debug(s.logger).Log("msg", "TLS handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		return false
+	}
+
+	// Idle timeouts, if enabled, are set before reading each command
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		level.Error(s.logger).Log("msg", "unable to clear TLS handshake timeout on connection", "remote", conn.RemoteAddr(), "err", err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// newTestTCPServer creates a TCPServer that handles connections passed to handle
+// directly, without listening.
+func newTestTCPServer(config TCPConfig) *TCPServer {
+	h := newTestHandler()
+	return NewTCPServer(config, nil, h, h.conns, h.metrics, log.NewNopLogger())
+}
+
+// waitActive waits until the server is tracking n connections.
+func waitActive(t *testing.T, s *TCPServer, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mtx.Lock()
+		active := len(s.active)
+		s.mtx.Unlock()
+
+		if active == n {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected %d active connections, got %d", n, active)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBufferedConnection_InterruptedWhileBusy(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	buffered := newBufferedConnection(serverConn, NewMetrics())
+	defer buffered.Close()
+
+	// The server starts draining just as the first byte of a command arrives, after
+	// the connection stopped waiting for it but before it was marked busy.
+	if !buffered.interruptIfIdle() {
+		t.Fatalf("expected connection waiting for a command to be interrupted")
+	}
+
+	buffered.busy()
+	if buffered.interruptIfIdle() {
+		t.Fatalf("expected busy connection not to be interrupted")
+	}
+
+	go func() {
+		_, _ = clientConn.Write([]byte("get foo\r\n"))
+	}()
+
+	line, err := buffered.ReadLine(1024)
+	if err != nil || line != "get foo" {
+		t.Errorf("expected rest of command to be read, got %q, %v", line, err)
+	}
+}
+
+func TestHandler_PipelinedCommandIsBusy(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	h := newTestHandler()
+	buffered := newBufferedConnection(serverConn, h.metrics)
+	defer buffered.Close()
+
+	go func() {
+		_, _ = clientConn.Write([]byte("get a\r\nget b\r\n"))
+		_, _ = io.Copy(io.Discard, clientConn)
+	}()
+
+	// Read the first command, leaving the second one buffered
+	if err := h.begin(buffered); err != nil {
+		t.Fatalf("unexpected error beginning command: %s", err)
+	}
+
+	if _, err := buffered.ReadLine(1024); err != nil {
+		t.Fatalf("unexpected error reading command: %s", err)
+	}
+
+	h.finish(buffered)
+	if err := h.begin(buffered); err != nil {
+		t.Fatalf("unexpected error beginning command: %s", err)
+	}
+
+	if buffered.interruptIfIdle() {
+		t.Errorf("expected connection with a buffered command not to be interrupted")
+	}
+}
+
+func TestTCPServer_DrainDuringHandshake(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "first")
+	config := newTestTLSConfig(dir)
+	config.HandshakeTimeout = time.Minute
+
+	reloader, err := NewTLSReloader(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating reloader: %s", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// The client connects but never sends a ClientHello
+	s := newTestTCPServer(TCPConfig{TLS: config, MaxLineSize: 2048})
+	done := make(chan struct{})
+	go func() {
+		s.handle(tls.Server(serverConn, reloader.Config()))
+		close(done)
+	}()
+
+	waitActive(t, s, 1)
+	if busy := s.closeIdle(); busy != 0 {
+		t.Errorf("expected no busy connections, got %d", busy)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection in handshake wasn't closed when draining")
+	}
+}
+
+// waitDone waits for a connection handled by a server to be closed.
+func waitDone(t *testing.T, done <-chan struct{}, msg string) {
+	t.Helper()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(msg)
+	}
+}
+
+func TestTCPConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  TCPConfig
+		err  bool
+	}{
+		{name: "valid", cfg: TCPConfig{MaxLineSize: 2048, DrainTimeout: time.Second, ShutdownDelay: time.Second}},
+		{name: "no drain timeout or delay", cfg: TCPConfig{MaxLineSize: 2048}},
+		{name: "negative drain timeout", cfg: TCPConfig{MaxLineSize: 2048, DrainTimeout: -time.Second}, err: true},
+		{name: "negative shutdown delay", cfg: TCPConfig{MaxLineSize: 2048, ShutdownDelay: -time.Second}, err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.Validate(); (err != nil) != tc.err {
+				t.Errorf("expected error %t, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestTCPServer_DrainIdle(t *testing.T) {
+	s := newTestTCPServer(TCPConfig{MaxLineSize: 2048, DrainTimeout: time.Minute})
+	client, done := handleTestConnection(t, s)
+	waitActive(t, s, 1)
+
+	drained := make(chan struct{})
+	go func() {
+		s.drain()
+		close(drained)
+	}()
+
+	waitDone(t, done, "idle connection wasn't closed when draining")
+	waitDone(t, drained, "drain didn't finish once connections were closed")
+
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected client to see the connection closed, got %v", err)
+	}
+}
+
+func TestTCPServer_DrainFinishesCommand(t *testing.T) {
+	s := newTestTCPServer(TCPConfig{MaxLineSize: 2048, DrainTimeout: time.Minute})
+	client, done := handleTestConnection(t, s)
+	waitActive(t, s, 1)
+
+	// The server starts draining after the command has been started but before its
+	// payload has been sent.
+	if _, err := client.Write([]byte("set a 0 0 5\r\n")); err != nil {
+		t.Fatalf("unexpected error writing command: %s", err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.drain()
+		close(drained)
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte("hello\r\n"))
+	}()
+
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "STORED\r\n" {
+		t.Errorf("expected command to finish while draining, got %q, %v", buf[:n], err)
+	}
+
+	waitDone(t, done, "connection wasn't closed after finishing its command")
+	waitDone(t, drained, "drain didn't finish once connections were closed")
+}
+
+func TestTCPServer_DrainTimeout(t *testing.T) {
+	s := newTestTCPServer(TCPConfig{MaxLineSize: 2048, DrainTimeout: 10 * time.Millisecond})
+	client, done := handleTestConnection(t, s)
+	waitActive(t, s, 1)
+
+	// The payload for the command never arrives
+	if _, err := client.Write([]byte("set a 0 0 5\r\n")); err != nil {
+		t.Fatalf("unexpected error writing command: %s", err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.drain()
+		close(drained)
+	}()
+
+	waitDone(t, drained, "drain didn't finish after the drain timeout")
+	waitDone(t, done, "busy connection wasn't closed after the drain timeout")
+}
+
+func TestTCPServer_RejectsWhileDraining(t *testing.T) {
+	s := newTestTCPServer(TCPConfig{MaxLineSize: 2048, DrainTimeout: time.Minute})
+	s.drain()
+
+	client, done := handleTestConnection(t, s)
+	waitDone(t, done, "connection accepted while draining wasn't closed")
+
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected client to see the connection closed, got %v", err)
+	}
+}
+
+func TestHandler_Shutdown(t *testing.T) {
+	h := newTestHandler()
+	out := serve(t, h, &chunkedConn{chunks: []string{"shutdown\r\n"}})
+	if out != "CLIENT_ERROR shutdown not enabled\r\n" {
+		t.Errorf("expected shutdown to be rejected, got %q", out)
+	}
+
+	select {
+	case <-h.shutdown.Requested():
+		t.Fatalf("expected shutdown not to be requested when disabled")
+	default:
+	}
+
+	// Same as memcached, there's no response and commands after it aren't run
+	h.settings.ShutdownCommand = true
+	out = serve(t, h, &chunkedConn{chunks: []string{"shutdown graceful\r\nmn\r\n"}})
+	if out != "" {
+		t.Errorf("expected no response to shutdown, got %q", out)
+	}
+
+	select {
+	case <-h.shutdown.Requested():
+	default:
+		t.Fatalf("expected shutdown to be requested")
+	}
+
+	// Requesting shutdown more than once is harmless
+	h.shutdown.Request()
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+
+	"github.com/56quarters/jankcache/server/cache"
+	"github.com/56quarters/jankcache/server/core"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+const (
+	TenantModeNone   = ""
+	TenantModeUser   = "user"
+	TenantModePrefix = "prefix"
+)
+
+type TenantConfig struct {
+	Mode      string
+	Delimiter string
+	MaxSizeMb TenantBudgets
+}
+
+func (c *TenantConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	c.MaxSizeMb = TenantBudgets{}
+
+	fs.StringVar(&c.Mode, prefix+"mode", TenantModeNone, "How to pick the tenant for a command: 'user' for the authenticated user, 'prefix' for the part of the key before the delimiter. Set to an empty string to disable tenants")
+	fs.StringVar(&c.Delimiter, prefix+"delimiter", ":", "Delimiter between the tenant and the rest of the key when using the 'prefix' tenant mode")
+	fs.Var(&c.MaxSizeMb, prefix+"max-size-mb", "Comma separated list of tenant=megabytes pairs. Each tenant gets a separate cache of this size. Commands for any other tenant use the default cache")
+}
+
+func (c *TenantConfig) Validate() error {
+	switch c.Mode {
+	case TenantModeNone:
+		return nil
+	case TenantModeUser:
+	case TenantModePrefix:
+		if c.Delimiter == "" {
+			return fmt.Errorf("tenant delimiter must be set for tenant mode '%s'", c.Mode)
+		}
+	default:
+		return fmt.Errorf("invalid tenant mode '%s'", c.Mode)
+	}
+
+	if len(c.MaxSizeMb) == 0 {
+		return fmt.Errorf("at least one tenant must be configured for tenant mode '%s'", c.Mode)
+	}
+
+	return nil
+}
+
+// TenantBudgets are the max cache size in megabytes of each tenant, set from a flag
+// as a comma separated list of tenant=megabytes pairs.
+type TenantBudgets map[string]uint64
+
+func (b *TenantBudgets) String() string {
+	pairs := make([]string, 0, len(*b))
+	for name, size := range *b {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, size))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (b *TenantBudgets) Set(s string) error {
+	budgets := TenantBudgets{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+
+		name, size, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid tenant size '%s', expected tenant=megabytes", pair)
+		}
+
+		mb, err := strconv.ParseUint(size, 10, 64)
+		if err != nil || mb < 1 {
+			return fmt.Errorf("invalid size for tenant '%s': %s", name, size)
+		}
+
+		budgets[name] = mb
+	}
+
+	*b = budgets
+	return nil
+}
+
+// Tenant is a named cache with its own memory budget. The default tenant, used for
+// commands that don't belong to any configured tenant, has an empty name.
+type Tenant struct {
+	Name  string
+	Cache *cache.Cache
+}
+
+// Tenants picks the cache to use for each command based on the user running it or
+// the key it's for. Each tenant's cache is independent, so a tenant can only evict
+// its own entries.
+type Tenants struct {
+	mode      string
+	delimiter string
+	fallback  *cache.Cache
+	byName    map[string]*cache.Cache
+	all       []Tenant
+}
+
+func NewTenants(cfg TenantConfig, cacheCfg cache.Config, logger log.Logger) *Tenants {
+	fallback := cache.New(cacheCfg, logger)
+	t := &Tenants{
+		mode:      cfg.Mode,
+		delimiter: cfg.Delimiter,
+		fallback:  fallback,
+		byName:    make(map[string]*cache.Cache),
+		all:       []Tenant{{Name: "", Cache: fallback}},
+	}
+
+	if cfg.Mode == TenantModeNone {
+		return t
+	}
+
+	names := make([]string, 0, len(cfg.MaxSizeMb))
+	for name := range cfg.MaxSizeMb {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		c := cache.New(cache.Config{
+			Backend:        cacheCfg.Backend,
+			MaxSizeMb:      cfg.MaxSizeMb[name],
+			MaxItemSize:    cacheCfg.MaxItemSize,
+			ReadYourWrites: cacheCfg.ReadYourWrites,
+		}, log.With(logger, "tenant", name))
+		t.byName[name] = c
+		t.all = append(t.all, Tenant{Name: name, Cache: c})
+	}
+
+	return t
+}
+
+// For returns the cache for a command run by user for key. The user is nil if
+// authentication is disabled or the client hasn't authenticated.
+func (t *Tenants) For(user *User, key string) *cache.Cache {
+	var name string
+	switch t.mode {
+	case TenantModeUser:
+		if user == nil {
+			return t.fallback
+		}
+		name = user.Name
+	case TenantModePrefix:
+		prefix, _, ok := strings.Cut(key, t.delimiter)
+		if !ok {
+			return t.fallback
+		}
+		name = prefix
+	default:
+		return t.fallback
+	}
+
+	if c, ok := t.byName[name]; ok {
+		return c
+	}
+
+	return t.fallback
+}
+
+// Default returns the cache used for commands that don't belong to a tenant.
+func (t *Tenants) Default() *cache.Cache {
+	return t.fallback
+}
+
+// All returns every tenant, starting with the default tenant.
+func (t *Tenants) All() []Tenant {
+	return t.all
+}
+
+// Get runs a get for keys that may belong to different tenants, returning entries
+// in the same order as the keys.
+func (t *Tenants) Get(user *User, op *proto.GetOp) ([]*cache.Entry, error) {
+	if c, ok := t.single(user, op.Keys); ok {
+		return c.Get(op)
+	}
+
+	var out []*cache.Entry
+	for _, k := range op.Keys {
+		res, err := t.For(user, k).Get(&proto.GetOp{Keys: []string{k}, Unique: op.Unique})
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, res...)
+	}
+
+	return out, nil
+}
+
+// Gat runs a get-and-touch for keys that may belong to different tenants, returning
+// entries in the same order as the keys.
+func (t *Tenants) Gat(user *User, op *proto.GatOp) ([]*cache.Entry, error) {
+	if c, ok := t.single(user, op.Keys); ok {
+		return c.Gat(op)
+	}
+
+	var out []*cache.Entry
+	for _, k := range op.Keys {
+		res, err := t.For(user, k).Gat(&proto.GatOp{Keys: []string{k}, Expire: op.Expire, Unique: op.Unique})
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, res...)
+	}
+
+	return out, nil
+}
+
+// CacheMemLimit changes the max size of the cache. It's rejected when tenants are
+// enabled since each tenant has its own budget and a single limit can't be applied
+// to all of them.
+func (t *Tenants) CacheMemLimit(op *proto.CacheMemLimitOp) error {
+	if t.mode != TenantModeNone {
+		return core.ClientError("cache_memlimit is not supported when tenants are enabled")
+	}
+
+	return t.fallback.CacheMemLimit(op)
+}
+
+// FlushAll flushes the cache of every tenant.
+func (t *Tenants) FlushAll(op *proto.FlushAllOp) error {
+	for _, tenant := range t.all {
+		if err := tenant.Cache.FlushAll(op); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ResetStats zeroes the counters of every tenant for a `stats reset` command.
+func (t *Tenants) ResetStats() {
+	for _, tenant := range t.all {
+		tenant.Cache.Counters().Reset()
+	}
+}
+
+// Close closes the cache of every tenant.
+func (t *Tenants) Close() {
+	for _, tenant := range t.all {
+		tenant.Cache.Close()
+	}
+}
+
+// single returns the cache for keys if they all belong to the same tenant.
+func (t *Tenants) single(user *User, keys []string) (*cache.Cache, bool) {
+	if len(keys) == 0 {
+		return t.fallback, true
+	}
+
+	c := t.For(user, keys[0])
+	for _, k := range keys[1:] {
+		if t.For(user, k) != c {
+			return nil, false
+		}
+	}
+
+	return c, true
+}
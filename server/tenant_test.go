@@ -0,0 +1,169 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/56quarters/jankcache/server/cache"
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+func newTestTenants(mode string) *Tenants {
+	cacheCfg := cache.Config{Backend: cache.BackendLRU, MaxSizeMb: 16, MaxItemSize: 1024 * 1024}
+	tenantCfg := TenantConfig{Mode: mode, Delimiter: ":", MaxSizeMb: TenantBudgets{"a": 1, "b": 2}}
+	return NewTenants(tenantCfg, cacheCfg, log.NewNopLogger())
+}
+
+func TestTenants_CacheMemLimit(t *testing.T) {
+	op := &proto.CacheMemLimitOp{Bytes: 32 * 1024 * 1024}
+
+	single := newTestTenants(TenantModeNone)
+	if err := single.CacheMemLimit(op); err != nil {
+		t.Fatalf("unexpected error changing limit without tenants: %s", err)
+	}
+
+	if max := single.Default().MaxBytes(); max != uint64(op.Bytes) {
+		t.Errorf("expected max bytes %d, got %d", op.Bytes, max)
+	}
+
+	multi := newTestTenants(TenantModePrefix)
+	if err := multi.CacheMemLimit(op); err == nil {
+		t.Errorf("expected error changing limit with tenants enabled")
+	}
+
+	for _, tenant := range multi.All() {
+		if max := tenant.Cache.MaxBytes(); max == uint64(op.Bytes) {
+			t.Errorf("expected limit of tenant %q to be unchanged", tenant.Name)
+		}
+	}
+}
+
+func TestTenants_For(t *testing.T) {
+	prefix := newTestTenants(TenantModePrefix)
+	user := newTestTenants(TenantModeUser)
+	byName := make(map[string]*cache.Cache)
+	for _, tenant := range prefix.All() {
+		byName[tenant.Name] = tenant.Cache
+	}
+
+	tests := []struct {
+		name     string
+		tenants  *Tenants
+		user     *User
+		key      string
+		expected string
+	}{
+		{name: "prefix", tenants: prefix, key: "a:foo", expected: "a"},
+		{name: "prefix other tenant", tenants: prefix, key: "b:foo", expected: "b"},
+		{name: "prefix unknown tenant", tenants: prefix, key: "c:foo", expected: ""},
+		{name: "prefix without delimiter", tenants: prefix, key: "foo", expected: ""},
+		{name: "prefix ignores user", tenants: prefix, user: &User{Name: "b"}, key: "a:foo", expected: "a"},
+		{name: "user", tenants: user, user: &User{Name: "b"}, key: "a:foo", expected: "b"},
+		{name: "user unauthenticated", tenants: user, key: "a:foo", expected: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var expected *cache.Cache
+			for _, tenant := range tc.tenants.All() {
+				if tenant.Name == tc.expected {
+					expected = tenant.Cache
+				}
+			}
+
+			if c := tc.tenants.For(tc.user, tc.key); c != expected {
+				t.Errorf("expected cache of tenant %q for key %s", tc.expected, tc.key)
+			}
+		})
+	}
+
+	if max := byName["b"].MaxBytes(); max != 2*1024*1024 {
+		t.Errorf("expected tenant budget of 2MB, got %d bytes", max)
+	}
+}
+
+func TestTenants_GetAcrossTenants(t *testing.T) {
+	tenants := newTestTenants(TenantModePrefix)
+	for _, key := range []string{"a:1", "b:2", "3"} {
+		if _, err := tenants.For(nil, key).Set(&proto.SetOp{Key: key, Bytes: []byte(key)}); err != nil {
+			t.Fatalf("unexpected error setting %s: %s", key, err)
+		}
+	}
+
+	// Each entry is only stored in the cache of its tenant
+	if entries, _ := tenants.Default().Get(&proto.GetOp{Keys: []string{"a:1"}}); len(entries) != 0 {
+		t.Errorf("expected tenant entry not to be stored in the default cache")
+	}
+
+	entries, err := tenants.Get(nil, &proto.GetOp{Keys: []string{"3", "b:2", "missing", "a:1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var values []string
+	for _, e := range entries {
+		values = append(values, string(e.Value))
+	}
+
+	if strings.Join(values, ",") != "3,b:2,a:1" {
+		t.Errorf("expected entries in the order of the keys, got %v", values)
+	}
+}
+
+func TestTenants_FlushAll(t *testing.T) {
+	tenants := newTestTenants(TenantModePrefix)
+	keys := []string{"a:1", "b:2", "3"}
+	for _, key := range keys {
+		if _, err := tenants.For(nil, key).Set(&proto.SetOp{Key: key, Bytes: []byte(key)}); err != nil {
+			t.Fatalf("unexpected error setting %s: %s", key, err)
+		}
+	}
+
+	if err := tenants.FlushAll(&proto.FlushAllOp{}); err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+
+	if entries, _ := tenants.Get(nil, &proto.GetOp{Keys: keys}); len(entries) != 0 {
+		t.Errorf("expected entries of every tenant to be flushed, got %d", len(entries))
+	}
+}
+
+func TestTenantBudgets_Set(t *testing.T) {
+	var budgets TenantBudgets
+	if err := budgets.Set("b=2,a=1,"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := budgets.String(); s != "a=1,b=2" {
+		t.Errorf("expected sorted budgets, got %s", s)
+	}
+
+	for _, invalid := range []string{"a", "=1", "a=0", "a=abc"} {
+		if err := budgets.Set(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestTenantConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TenantConfig
+		valid  bool
+	}{
+		{name: "disabled", config: TenantConfig{}, valid: true},
+		{name: "user", config: TenantConfig{Mode: TenantModeUser, MaxSizeMb: TenantBudgets{"a": 1}}, valid: true},
+		{name: "prefix", config: TenantConfig{Mode: TenantModePrefix, Delimiter: ":", MaxSizeMb: TenantBudgets{"a": 1}}, valid: true},
+		{name: "prefix without delimiter", config: TenantConfig{Mode: TenantModePrefix, MaxSizeMb: TenantBudgets{"a": 1}}},
+		{name: "no tenants", config: TenantConfig{Mode: TenantModeUser}},
+		{name: "invalid mode", config: TenantConfig{Mode: "host", MaxSizeMb: TenantBudgets{"a": 1}}},
+	}
+
+	for _, tc := range tests {
+		if err := tc.config.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v, got %v", tc.name, tc.valid, err)
+		}
+	}
+}
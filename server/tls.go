@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type TLSConfig struct {
+	CertFile          string
+	KeyFile           string
+	CAFile            string
+	RequireClientCert bool
+	MinVersion        string
+	CipherSuites      string
+	ReloadInterval    time.Duration
+	HandshakeTimeout  time.Duration
+}
+
+func (c *TLSConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	fs.StringVar(&c.CertFile, prefix+"cert-file", "", "Path to a PEM encoded certificate to serve TLS connections with. Set to an empty string to disable TLS")
+	fs.StringVar(&c.KeyFile, prefix+"key-file", "", "Path to the PEM encoded private key for the TLS certificate")
+	fs.StringVar(&c.CAFile, prefix+"ca-file", "", "Path to PEM encoded CA certificates used to verify client certificates")
+	fs.BoolVar(&c.RequireClientCert, prefix+"require-client-cert", false, "Require clients to present a certificate signed by the CA. Requires a CA file to be set")
+	fs.StringVar(&c.MinVersion, prefix+"min-version", "1.2", "Minimum TLS version to accept: 1.0, 1.1, 1.2, or 1.3")
+	fs.StringVar(&c.CipherSuites, prefix+"cipher-suites", "", "Comma separated list of TLS 1.2 and earlier cipher suite names to allow. Set to an empty string to use the Go defaults")
+	fs.DurationVar(&c.ReloadInterval, prefix+"reload-interval", 10*time.Second, "How often to check certificate files for changes. Certificates are also reloaded on SIGHUP. Set to 0 to disable checking")
+	fs.DurationVar(&c.HandshakeTimeout, prefix+"handshake-timeout", 10*time.Second, "Max time a client has to complete the TLS handshake after connecting")
+}
+
+func (c *TLSConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.KeyFile == "" {
+		return errors.New("TLS key file must be set when a certificate file is set")
+	}
+
+	if c.RequireClientCert && c.CAFile == "" {
+		return errors.New("TLS CA file must be set when client certificates are required")
+	}
+
+	if c.HandshakeTimeout <= 0 {
+		return errors.New("TLS handshake timeout must be greater than 0")
+	}
+
+	if _, err := c.minVersion(); err != nil {
+		return err
+	}
+
+	if _, err := c.cipherSuites(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Enabled returns true if a certificate has been configured and connections should use TLS.
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c *TLSConfig) minVersion() (uint16, error) {
+	v, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS minimum version '%s'", c.MinVersion)
+	}
+
+	return v, nil
+}
+
+func (c *TLSConfig) cipherSuites() ([]uint16, error) {
+	if c.CipherSuites == "" {
+		return nil, nil
+	}
+
+	byName := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		byName[s.Name] = s.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(c.CipherSuites, ",") {
+		id, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid or insecure TLS cipher suite '%s'", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// TLSReloader maintains the TLS configuration for client connections, reloading the
+// certificate and CA from disk when they change or when the process receives a SIGHUP.
+// Existing connections are unaffected by a reload, only new handshakes use new certificates.
+type TLSReloader struct {
+	services.Service
+
+	config  TLSConfig
+	base    *tls.Config
+	logger  log.Logger
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime map[string]time.Time
+	mtx     sync.RWMutex
+}
+
+func NewTLSReloader(config TLSConfig, logger log.Logger) (*TLSReloader, error) {
+	minVersion, err := config.minVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	suites, err := config.cipherSuites()
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuth := tls.NoClientCert
+	if config.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	} else if config.CAFile != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	r := &TLSReloader{
+		config: config,
+		base: &tls.Config{
+			MinVersion:   minVersion,
+			CipherSuites: suites,
+			ClientAuth:   clientAuth,
+		},
+		logger: logger,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	r.Service = services.NewBasicService(nil, r.loop, nil)
+	return r, nil
+}
+
+// Config returns a TLS configuration that always uses the most recently loaded
+// certificate and CA for each new handshake.
+func (r *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.base.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mtx.RLock()
+			defer r.mtx.RUnlock()
+
+			cfg := r.base.Clone()
+			cfg.Certificates = []tls.Certificate{*r.cert}
+			cfg.ClientCAs = r.pool
+			return cfg, nil
+		},
+	}
+}
+
+func (r *TLSReloader) loop(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if r.config.ReloadInterval > 0 {
+		ticker := time.NewTicker(r.config.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			level.Info(r.logger).Log("msg", "reloading TLS certificates on SIGHUP")
+			if err := r.reload(); err != nil {
+				level.Error(r.logger).Log("msg", "unable to reload TLS certificates, using previous certificates", "err", err)
+			}
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+
+			level.Info(r.logger).Log("msg", "reloading changed TLS certificates")
+			if err := r.reload(); err != nil {
+				level.Error(r.logger).Log("msg", "unable to reload TLS certificates, using previous certificates", "err", err)
+			}
+		}
+	}
+}
+
+// changed returns true if the modification time of any of the certificate files is
+// different from when they were last loaded.
+func (r *TLSReloader) changed() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	for path, loaded := range r.modTime {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Files may be briefly missing while being replaced, try again next time
+			continue
+		}
+
+		if !info.ModTime().Equal(loaded) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *TLSReloader) reload() error {
+	modTime := make(map[string]time.Time)
+	for _, path := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("unable to read TLS file: %w", err)
+		}
+
+		modTime[path] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.config.CAFile != "" {
+		pem, err := os.ReadFile(r.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read TLS CA file: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid certificates in TLS CA file %s", r.config.CAFile)
+		}
+	}
+
+	r.mtx.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.modTime = modTime
+	r.mtx.Unlock()
+
+	return nil
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+)
+
+// writeCert generates a self-signed certificate for localhost with the given common
+// name and writes it and its key to dir, returning the parsed certificate.
+func writeCert(t *testing.T, dir string, name string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %s", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPem, 0o600); err != nil {
+		t.Fatalf("unable to write certificate: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), keyPem, 0o600); err != nil {
+		t.Fatalf("unable to write key: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unable to parse certificate: %s", err)
+	}
+
+	return cert
+}
+
+func newTestTLSConfig(dir string) TLSConfig {
+	return TLSConfig{
+		CertFile:         filepath.Join(dir, "cert.pem"),
+		KeyFile:          filepath.Join(dir, "key.pem"),
+		MinVersion:       "1.2",
+		ReloadInterval:   10 * time.Millisecond,
+		HandshakeTimeout: time.Second,
+	}
+}
+
+// newTestTLSServer creates a TCPServer with just enough set to perform handshakes.
+func newTestTLSServer(config TLSConfig) *TCPServer {
+	return &TCPServer{
+		config:  TCPConfig{TLS: config},
+		metrics: NewMetrics(),
+		logger:  log.NewNopLogger(),
+	}
+}
+
+// handshake performs a TLS handshake between the server and a client using clientCfg
+// over an in-memory connection, returning the result from the server and the client.
+func handshake(t *testing.T, s *TCPServer, serverCfg *tls.Config, clientCfg *tls.Config) (bool, *tls.ConnectionState) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	states := make(chan *tls.ConnectionState, 1)
+	go func() {
+		client := tls.Client(clientConn, clientCfg)
+		if err := client.Handshake(); err != nil {
+			// Make sure the server doesn't wait for the rest of the handshake
+			_ = clientConn.Close()
+			states <- nil
+			return
+		}
+
+		state := client.ConnectionState()
+		states <- &state
+	}()
+
+	ok := s.handshake(tls.Server(serverConn, serverCfg))
+	return ok, <-states
+}
+
+func TestTCPServer_HandshakeSuccess(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeCert(t, dir, "first")
+	config := newTestTLSConfig(dir)
+
+	reloader, err := NewTLSReloader(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating reloader: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	s := newTestTLSServer(config)
+	ok, state := handshake(t, s, reloader.Config(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if !ok || state == nil {
+		t.Fatalf("expected handshake to succeed")
+	}
+
+	if errs := s.metrics.TLSHandshakeErrors.Load(); errs != 0 {
+		t.Errorf("expected no handshake errors, got %d", errs)
+	}
+}
+
+func TestTCPServer_HandshakeUntrustedClient(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "first")
+	config := newTestTLSConfig(dir)
+
+	reloader, err := NewTLSReloader(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating reloader: %s", err)
+	}
+
+	// The client doesn't trust the server certificate and aborts the handshake
+	s := newTestTLSServer(config)
+	ok, state := handshake(t, s, reloader.Config(), &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "localhost"})
+	if ok || state != nil {
+		t.Fatalf("expected handshake to fail")
+	}
+
+	if errs := s.metrics.TLSHandshakeErrors.Load(); errs != 1 {
+		t.Errorf("expected 1 handshake error, got %d", errs)
+	}
+}
+
+func TestTCPServer_HandshakeTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "first")
+	config := newTestTLSConfig(dir)
+	config.HandshakeTimeout = 50 * time.Millisecond
+
+	reloader, err := NewTLSReloader(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating reloader: %s", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// The client connects but never sends a ClientHello
+	s := newTestTLSServer(config)
+	done := make(chan bool, 1)
+	go func() {
+		done <- s.handshake(tls.Server(serverConn, reloader.Config()))
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatalf("expected handshake to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handshake didn't time out")
+	}
+
+	if errs := s.metrics.TLSHandshakeErrors.Load(); errs != 1 {
+		t.Errorf("expected 1 handshake error, got %d", errs)
+	}
+}
+
+func TestTCPServer_HandshakeTimeoutMaxConnections(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "first")
+	config := newTestTLSConfig(dir)
+	config.HandshakeTimeout = 50 * time.Millisecond
+
+	reloader, err := NewTLSReloader(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating reloader: %s", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// The server is already at max connections so the client is rejected, but it never
+	// sends a ClientHello for the handshake needed to write the rejection.
+	s := newTestTLSServer(config)
+	s.config.MaxConnections = 1
+	s.handler = newTestHandler()
+	s.metrics.CurrentConnections.Store(1)
+
+	done := make(chan struct{})
+	go func() {
+		s.handle(tls.Server(serverConn, reloader.Config()))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rejecting connection didn't time out")
+	}
+
+	if rejected := s.metrics.RejectedConnections.Load(); rejected != 1 {
+		t.Errorf("expected 1 rejected connection, got %d", rejected)
+	}
+}
+
+func TestTLSReloader_ReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	first := writeCert(t, dir, "first")
+	config := newTestTLSConfig(dir)
+
+	reloader, err := NewTLSReloader(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating reloader: %s", err)
+	}
+
+	if err := services.StartAndAwaitRunning(context.Background(), reloader); err != nil {
+		t.Fatalf("unexpected error starting reloader: %s", err)
+	}
+
+	defer func() {
+		_ = services.StopAndAwaitTerminated(context.Background(), reloader)
+	}()
+
+	s := newTestTLSServer(config)
+	serverCfg := reloader.Config()
+	peer := func() string {
+		ok, state := handshake(t, s, serverCfg, &tls.Config{InsecureSkipVerify: true})
+		if !ok || state == nil {
+			t.Fatalf("expected handshake to succeed")
+		}
+
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+
+	if name := peer(); name != first.Subject.CommonName {
+		t.Fatalf("expected certificate %s, got %s", first.Subject.CommonName, name)
+	}
+
+	// Make sure the modification time changes even on filesystems with coarse timestamps
+	second := writeCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{config.CertFile, config.KeyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatalf("unable to change modification time: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for peer() != second.Subject.CommonName {
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate wasn't reloaded after files changed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+)
+
+const (
+	udpHeaderSize      = 8
+	udpMaxPayloadSize  = 1_400
+	udpMaxDatagramSize = 65_535
+)
+
+type UDPConfig struct {
+	Address     string
+	MaxRequests uint64
+}
+
+func (c *UDPConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	fs.StringVar(&c.Address, prefix+"address", "", "Address and port for the UDP cache server to bind to. Set to an empty string to disable")
+	fs.Uint64Var(&c.MaxRequests, prefix+"max-requests", 256, "Max number of UDP requests that can be handled at once. Datagrams received while at the limit are dropped")
+}
+
+func (c *UDPConfig) Validate() error {
+	if c.Address != "" && c.MaxRequests < 1 {
+		return fmt.Errorf("invalid value for udp-max-requests: %d", c.MaxRequests)
+	}
+
+	return nil
+}
+
+// udpFrame is the header at the start of every memcached UDP datagram, used to
+// reassemble responses that are split across multiple datagrams.
+type udpFrame struct {
+	RequestID uint16
+	Sequence  uint16
+	Total     uint16
+}
+
+// UDPServer handles memcached commands sent over UDP. Each request must fit in a
+// single datagram while responses may be split across many.
+type UDPServer struct {
+	services.Service
+
+	config   UDPConfig
+	handler  *Handler
+	metrics  *Metrics
+	conn     net.PacketConn
+	requests chan struct{}
+	logger   log.Logger
+}
+
+func NewUDPServer(config UDPConfig, handler *Handler, metrics *Metrics, logger log.Logger) *UDPServer {
+	s := &UDPServer{
+		config:   config,
+		handler:  handler,
+		metrics:  metrics,
+		requests: make(chan struct{}, config.MaxRequests),
+		logger:   logger,
+	}
+
+	s.Service = services.NewBasicService(s.start, s.loop, s.stop)
+	return s
+}
+
+func (s *UDPServer) start(ctx context.Context) error {
+	level.Info(s.logger).Log("msg", "starting UDP server", "address", s.config.Address)
+
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", s.config.Address)
+	if err != nil {
+		return fmt.Errorf("unable to bind to %s: %w", s.config.Address, err)
+	}
+
+	s.conn = conn
+	// Spawn a goroutine to wait for this context to be cancelled (happens when this service
+	// is shutdown) and close the connection so ReadFrom will return an error. Otherwise, the
+	// ReadFrom() call would block indefinitely.
+	go s.shutdown(ctx)
+	return nil
+}
+
+func (s *UDPServer) loop(ctx context.Context) error {
+	buf := make([]byte, udpMaxDatagramSize)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				// Server is shutting down, ignore the error since this is intentional.
+				return nil
+			default:
+				return fmt.Errorf("unable to read datagram: %w", err)
+			}
+		}
+
+		// Limit the number of requests handled at once so that a flood of datagrams
+		// can't use an unbounded amount of memory. Clients are expected to retry
+		// requests that don't get a response, the same as any other lost datagram.
+		select {
+		case s.requests <- struct{}{}:
+		default:
+			s.metrics.UDPDropped.Add(1)
+			level.Debug(s.logger).Log("msg", "dropping datagram, too many requests in progress", "remote", addr, "max", s.config.MaxRequests)
+			continue
+		}
+
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		go func() {
+			defer func() { <-s.requests }()
+			s.handle(addr, datagram)
+		}()
+	}
+}
+
+func (s *UDPServer) stop(err error) error {
+	if err != nil {
+		level.Error(s.logger).Log("msg", "stopping UDP server due to error", "err", err)
+	}
+
+	return nil
+}
+
+func (s *UDPServer) shutdown(ctx context.Context) {
+	<-ctx.Done()
+	level.Debug(s.logger).Log("msg", "shutting down UDP server")
+
+	if s.conn != nil {
+		if err := s.conn.Close(); err != nil {
+			level.Warn(s.logger).Log("msg", "error closing UDP connection", "err", err)
+		}
+	}
+}
+
+func (s *UDPServer) handle(addr net.Addr, datagram []byte) {
+	if len(datagram) < udpHeaderSize {
+		level.Debug(s.logger).Log("msg", "dropping datagram without frame header", "remote", addr, "size", len(datagram))
+		return
+	}
+
+	frame := udpFrame{
+		RequestID: binary.BigEndian.Uint16(datagram[0:2]),
+		Sequence:  binary.BigEndian.Uint16(datagram[2:4]),
+		Total:     binary.BigEndian.Uint16(datagram[4:6]),
+	}
+
+	if frame.Total != 1 || frame.Sequence != 0 {
+		level.Debug(s.logger).Log("msg", "dropping multi-datagram request", "remote", addr, "total", frame.Total)
+		return
+	}
+
+	var out bytes.Buffer
+	in := bytes.NewReader(datagram[udpHeaderSize:])
+	buffered := newBufferedConnection(struct {
+		io.Reader
+		io.Writer
+	}{in, &out}, s.metrics)
+	buffered.remote = addr
+
+	// Handle every command in the datagram, stopping once there's no input left
+	// (io.EOF) or the client has sent something that we can't continue after.
+	handle := s.handler.detect(buffered)
+	for {
+		if err := handle(buffered); err != nil {
+			break
+		}
+	}
+
+	_ = buffered.Close()
+	s.respond(addr, frame.RequestID, out.Bytes())
+}
+
+// respond sends the response to a request split into as many datagrams as required,
+// each with a frame header that allows the client to reassemble them in order.
+func (s *UDPServer) respond(addr net.Addr, requestID uint16, response []byte) {
+	if len(response) == 0 {
+		return
+	}
+
+	chunkSize := udpMaxPayloadSize - udpHeaderSize
+	total := (len(response) + chunkSize - 1) / chunkSize
+	if total > math.MaxUint16 {
+		level.Warn(s.logger).Log("msg", "dropping response too large for UDP", "remote", addr, "size", len(response))
+		return
+	}
+
+	datagram := make([]byte, udpMaxPayloadSize)
+	for seq := 0; seq < total; seq++ {
+		start := seq * chunkSize
+		end := start + chunkSize
+		if end > len(response) {
+			end = len(response)
+		}
+
+		binary.BigEndian.PutUint16(datagram[0:2], requestID)
+		binary.BigEndian.PutUint16(datagram[2:4], uint16(seq))
+		binary.BigEndian.PutUint16(datagram[4:6], uint16(total))
+		binary.BigEndian.PutUint16(datagram[6:8], 0)
+		n := copy(datagram[udpHeaderSize:], response[start:end])
+
+		if _, err := s.conn.WriteTo(datagram[:udpHeaderSize+n], addr); err != nil {
+			level.Warn(s.logger).Log("msg", "unable to send datagram", "remote", addr, "err", err)
+			return
+		}
+	}
+}
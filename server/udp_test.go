@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+
+	"github.com/56quarters/jankcache/server/proto"
+)
+
+// newTestUDPServer starts a UDPServer on a random local port and returns its handler
+// along with a client connected to it.
+func newTestUDPServer(t *testing.T) (*Handler, net.Conn) {
+	t.Helper()
+
+	h := newTestHandler()
+	s := NewUDPServer(UDPConfig{Address: "127.0.0.1:0", MaxRequests: 16}, h, h.metrics, log.NewNopLogger())
+	if err := services.StartAndAwaitRunning(context.Background(), s); err != nil {
+		t.Fatalf("unexpected error starting server: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(context.Background(), s)
+	})
+
+	client, err := net.Dial("udp", s.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+
+	t.Cleanup(func() { _ = client.Close() })
+	return h, client
+}
+
+// udpRequest encodes a single datagram request with a frame header.
+func udpRequest(requestID uint16, payload string) []byte {
+	buf := make([]byte, udpHeaderSize, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(buf[0:2], requestID)
+	binary.BigEndian.PutUint16(buf[4:6], 1)
+	return append(buf, payload...)
+}
+
+// readDatagrams reads datagrams from client until one is missing or n are read,
+// returning the frame header and payload of each.
+func readDatagrams(t *testing.T, client net.Conn, n int) ([]udpFrame, []string) {
+	t.Helper()
+
+	var frames []udpFrame
+	var payloads []string
+	buf := make([]byte, udpMaxDatagramSize)
+	for len(frames) < n {
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		read, err := client.Read(buf)
+		if err != nil {
+			break
+		}
+
+		if read < udpHeaderSize {
+			t.Fatalf("datagram without frame header: %q", buf[:read])
+		}
+
+		frames = append(frames, udpFrame{
+			RequestID: binary.BigEndian.Uint16(buf[0:2]),
+			Sequence:  binary.BigEndian.Uint16(buf[2:4]),
+			Total:     binary.BigEndian.Uint16(buf[4:6]),
+		})
+		payloads = append(payloads, string(buf[udpHeaderSize:read]))
+	}
+
+	return frames, payloads
+}
+
+func TestUDPServer_SingleDatagram(t *testing.T) {
+	_, client := newTestUDPServer(t)
+	if _, err := client.Write(udpRequest(7, "set a 0 0 1\r\n1\r\nget a\r\n")); err != nil {
+		t.Fatalf("unexpected error sending request: %s", err)
+	}
+
+	frames, payloads := readDatagrams(t, client, 1)
+	if len(frames) != 1 || frames[0] != (udpFrame{RequestID: 7, Sequence: 0, Total: 1}) {
+		t.Fatalf("expected a single datagram for request 7, got %+v", frames)
+	}
+
+	if expected := "STORED\r\nVALUE a 0 1\r\n1\r\nEND\r\n"; payloads[0] != expected {
+		t.Errorf("expected %q, got %q", expected, payloads[0])
+	}
+}
+
+func TestUDPServer_SplitResponse(t *testing.T) {
+	h, client := newTestUDPServer(t)
+	value := strings.Repeat("abcdefghij", 500)
+	if _, err := h.tenants.Default().Set(&proto.SetOp{Key: "a", Bytes: []byte(value)}); err != nil {
+		t.Fatalf("unexpected error setting entry: %s", err)
+	}
+
+	if _, err := client.Write(udpRequest(9, "get a\r\n")); err != nil {
+		t.Fatalf("unexpected error sending request: %s", err)
+	}
+
+	expected := "VALUE a 0 5000\r\n" + value + "\r\nEND\r\n"
+	total := (len(expected) + udpMaxPayloadSize - udpHeaderSize - 1) / (udpMaxPayloadSize - udpHeaderSize)
+	frames, payloads := readDatagrams(t, client, total)
+	if len(frames) != total {
+		t.Fatalf("expected %d datagrams, got %d", total, len(frames))
+	}
+
+	// Datagrams may arrive out of order so reassemble them by sequence number
+	parts := make([]string, total)
+	for i, f := range frames {
+		if f.RequestID != 9 || f.Total != uint16(total) || int(f.Sequence) >= total {
+			t.Fatalf("unexpected frame header %+v", f)
+		}
+
+		parts[f.Sequence] = payloads[i]
+	}
+
+	if out := strings.Join(parts, ""); out != expected {
+		t.Errorf("expected reassembled response of %d bytes, got %d bytes", len(expected), len(out))
+	}
+}
+
+func TestUDPServer_DropsInvalidRequests(t *testing.T) {
+	_, client := newTestUDPServer(t)
+
+	multi := udpRequest(1, "get a\r\n")
+	binary.BigEndian.PutUint16(multi[4:6], 2)
+
+	for _, req := range [][]byte{multi, []byte("get")} {
+		if _, err := client.Write(req); err != nil {
+			t.Fatalf("unexpected error sending request: %s", err)
+		}
+	}
+
+	// Neither request gets a response, only this one does
+	if _, err := client.Write(udpRequest(2, "version\r\n")); err != nil {
+		t.Fatalf("unexpected error sending request: %s", err)
+	}
+
+	frames, payloads := readDatagrams(t, client, 1)
+	if len(frames) != 1 || frames[0].RequestID != 2 || !strings.HasPrefix(payloads[0], "VERSION ") {
+		t.Errorf("expected only a response to the version request, got %+v %q", frames, payloads)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+)
+
+type UnixConfig struct {
+	Path  string
+	Mode  FileMode
+	Owner string
+}
+
+func (c *UnixConfig) RegisterFlags(prefix string, fs *flag.FlagSet) {
+	c.Mode = 0o700
+
+	fs.StringVar(&c.Path, prefix+"path", "", "Path of a Unix socket for the cache server to listen on in addition to TCP. Set to an empty string to disable")
+	fs.Var(&c.Mode, prefix+"mode", "Octal file mode to set on the Unix socket")
+	fs.StringVar(&c.Owner, prefix+"owner", "", "Owner to set on the Unix socket as 'user' or 'user:group'. Set to an empty string to leave unchanged")
+}
+
+func (c *UnixConfig) Validate() error {
+	if c.Path == "" || c.Owner == "" {
+		return nil
+	}
+
+	if _, _, err := lookupOwner(c.Owner); err != nil {
+		return fmt.Errorf("invalid Unix socket owner: %w", err)
+	}
+
+	return nil
+}
+
+// FileMode is an os.FileMode that can be set from a flag as an octal number.
+type FileMode os.FileMode
+
+func (m *FileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *FileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid octal file mode '%s': %w", s, err)
+	}
+
+	if v > uint64(os.ModePerm) {
+		return fmt.Errorf("file mode '%s' has bits other than permissions set", s)
+	}
+
+	*m = FileMode(v)
+	return nil
+}
+
+// NewUnixServer creates a server for a Unix socket that otherwise handles connections
+// exactly like the TCP server, including idle timeouts and connection limits.
+func NewUnixServer(config UnixConfig, server TCPConfig, handler *Handler, conns *Connections, metrics *Metrics, logger log.Logger) *TCPServer {
+	s := &TCPServer{
+		config:  server,
+		handler: handler,
+		conns:   conns,
+		metrics: metrics,
+		logger:  logger,
+		active:  make(map[*bufferedConnection]struct{}),
+	}
+
+	s.listen = func(ctx context.Context) (net.Listener, error) {
+		return listenUnix(ctx, config, logger)
+	}
+
+	s.Service = services.NewBasicService(s.start, s.loop, s.stop)
+	return s
+}
+
+func listenUnix(ctx context.Context, config UnixConfig, logger log.Logger) (net.Listener, error) {
+	level.Info(logger).Log("msg", "starting Unix socket server", "path", config.Path)
+
+	if err := removeStaleSocket(config.Path, logger); err != nil {
+		return nil, err
+	}
+
+	listener, err := listenPrivate(ctx, config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to bind to %s: %w", config.Path, err)
+	}
+
+	// Closing the listener removes the socket file so there's nothing else to clean
+	// up on shutdown. Make sure that happens if we can't set permissions either. The
+	// owner is set first so that other users never get the configured mode.
+	if config.Owner != "" {
+		uid, gid, err := lookupOwner(config.Owner)
+		if err == nil {
+			err = os.Chown(config.Path, uid, gid)
+		}
+
+		if err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("unable to set owner of %s: %w", config.Path, err)
+		}
+	}
+
+	if err := os.Chmod(config.Path, os.FileMode(config.Mode)); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("unable to set mode of %s: %w", config.Path, err)
+	}
+
+	return listener, nil
+}
+
+// listenPrivate listens on a Unix socket that is created without any permissions so
+// that no other user can connect to it before its mode and owner are set.
+func listenPrivate(ctx context.Context, path string) (net.Listener, error) {
+	// The umask is process wide but nothing else creates files while servers start.
+	old := syscall.Umask(0o777)
+	defer syscall.Umask(old)
+
+	var lc net.ListenConfig
+	return lc.Listen(ctx, "unix", path)
+}
+
+// removeStaleSocket removes a socket file left behind by a server that didn't shut down
+// cleanly. Files that aren't sockets or sockets with a server still listening on them
+// are left alone and result in an error.
+func removeStaleSocket(path string, logger log.Logger) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to check for existing socket %s: %w", path, err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unable to bind to %s: file exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("unable to bind to %s: socket is in use by another process", path)
+	}
+
+	level.Info(logger).Log("msg", "removing stale Unix socket", "path", path)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("unable to remove stale socket %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// lookupOwner resolves an owner of the form 'user' or 'user:group' to a user and group
+// ID. The primary group of the user is used if no group is given.
+func lookupOwner(owner string) (int, int, error) {
+	name, group, hasGroup := strings.Cut(owner, ":")
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	gidStr := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		gidStr = g.Gid
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("non-numeric uid %s for user %s", u.Uid, name)
+	}
+
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("non-numeric gid %s for user %s", gidStr, name)
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestListenPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	listener, err := listenPrivate(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error checking socket: %s", err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0 {
+		t.Errorf("expected socket to be created without permissions, got %#o", perm)
+	}
+}
+
+func TestListenUnix_Mode(t *testing.T) {
+	config := UnixConfig{Path: filepath.Join(t.TempDir(), "test.sock"), Mode: 0o660}
+	listener, err := listenUnix(context.Background(), config, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(config.Path)
+	if err != nil {
+		t.Fatalf("unexpected error checking socket: %s", err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0o660 {
+		t.Errorf("expected socket mode %#o, got %#o", 0o660, perm)
+	}
+}
+
+func TestFileMode_Set(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected FileMode
+		err      bool
+	}{
+		{value: "700", expected: 0o700},
+		{value: "0660", expected: 0o660},
+		{value: "7777", err: true},
+		{value: "800", err: true},
+		{value: "abc", err: true},
+	}
+
+	for _, tc := range tests {
+		var m FileMode
+		err := m.Set(tc.value)
+		if tc.err && err == nil {
+			t.Errorf("expected error for %q, got %s", tc.value, m.String())
+		} else if !tc.err && (err != nil || m != tc.expected) {
+			t.Errorf("expected %#o for %q, got %#o, %v", tc.expected, tc.value, m, err)
+		}
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket left behind by a server that didn't shut down cleanly
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+
+	listener.SetUnlinkOnClose(false)
+	_ = listener.Close()
+
+	if err := removeStaleSocket(stale, log.NewNopLogger()); err != nil {
+		t.Errorf("unexpected error removing stale socket: %s", err)
+	}
+
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected stale socket to be removed, got %v", err)
+	}
+
+	// A socket that another server is still listening on
+	inUse := filepath.Join(dir, "in-use.sock")
+	listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: inUse, Net: "unix"})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	defer listener.Close()
+
+	if err := removeStaleSocket(inUse, log.NewNopLogger()); err == nil {
+		t.Errorf("expected error for socket in use")
+	}
+
+	// A regular file
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0o600); err != nil {
+		t.Fatalf("unexpected error writing file: %s", err)
+	}
+
+	if err := removeStaleSocket(file, log.NewNopLogger()); err == nil {
+		t.Errorf("expected error for file that isn't a socket")
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("expected file to be left alone, got %v", err)
+	}
+}